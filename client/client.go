@@ -4,14 +4,21 @@ import (
 	"crypto/md5"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"CS425/CS425-MP3/erasure"
 	"CS425/CS425-MP3/model"
 
 	"encoding/json"
@@ -22,6 +29,25 @@ type Client struct {
 	config model.NodeConfig
 }
 
+// maxBlockFetches num of blocks of a file fetched at the same time, each is held in memory until written
+const maxBlockFetches = 4
+
+// attrFlag key=value attributes given by repeated -attr flags
+type attrFlag map[string]string
+
+func (a attrFlag) String() string {
+	return fmt.Sprint(map[string]string(a))
+}
+
+func (a attrFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("attribute should be key=value, got %q", value)
+	}
+	a[kv[0]] = kv[1]
+	return nil
+}
+
 func (c *Client) loadConfigFromJSON(jsonFile []byte) error {
 	return json.Unmarshal(jsonFile, &c.config)
 }
@@ -34,14 +60,90 @@ func (c *Client) readFileContent(filename string) ([]byte, error) {
 	return content, nil
 }
 
+// hashFile md5 and size of local file ./files/{filename} with its first bytes, read without loading it whole
+func (c *Client) hashFile(filename string) ([model.SIZE]byte, int64, []byte, error) {
+	var sum [model.SIZE]byte
+	f, err := os.Open("./files/" + filename)
+	if err != nil {
+		return sum, 0, nil, err
+	}
+	defer f.Close()
+
+	// enough for http.DetectContentType
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return sum, 0, nil, err
+	}
+	head = head[:n]
+
+	h := md5.New()
+	h.Write(head)
+	rest, err := io.Copy(h, f)
+	if err != nil {
+		return sum, 0, nil, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, int64(n) + rest, head, nil
+}
+
 func (c *Client) writeFile(filename string, fileContent []byte) error {
-	err := ioutil.WriteFile(filename, fileContent, 0644)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filename, fileContent, 0644)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// uploader identity recorded with the files this client puts
+func (c *Client) uploader() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = c.config.IP
+	}
+	return name + "@" + host
+}
+
+// contentType guess content type of filename from its extension, then from its content
+func (c *Client) contentType(filename string, fileContent []byte) string {
+	t := mime.TypeByExtension(filepath.Ext(filename))
+	if t == "" {
+		t = http.DetectContentType(fileContent)
+	}
+	return t
+}
+
+// timeLayouts layouts accepted by parseTime, the zone is UTC if not given
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTime parse value in one of timeLayouts, the zero time if value is ""
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("time %q should look like 2026-10-01T12:00Z", value)
+}
+
 func (c *Client) getIPFromID(nodeID string) string {
 	return strings.Split(nodeID, "-")[0]
 }
@@ -57,6 +159,20 @@ func (c *Client) callGetFileRPC(client *rpc.Client, filename string) (model.RPCF
 	return reply, nil
 }
 
+func (c *Client) callGetFileAsOfRPC(client *rpc.Client, filename string, asOf time.Time) (model.RPCFilenameWithReplica, error) {
+	args := model.RPCGetFileAsOfArgs{
+		Filename: filename,
+		AsOf:     asOf,
+	}
+	var reply model.RPCFilenameWithReplica
+	err := client.Call("SDFS.RPCGetFileAsOf", &args, &reply)
+	if err != nil {
+		fmt.Println(err)
+		return model.RPCFilenameWithReplica{}, err
+	}
+	return reply, nil
+}
+
 func (c *Client) callRemoveFileRPC(client *rpc.Client, filename string) ([]string, error) {
 	// fmt.Println("filename: ", filename)
 	var reply []string
@@ -65,290 +181,1375 @@ func (c *Client) callRemoveFileRPC(client *rpc.Client, filename string) ([]strin
 		fmt.Println(err)
 		return nil, err
 	}
-	return reply, nil
-}
+	return reply, nil
+}
+
+func (c *Client) callTrashRPC(client *rpc.Client) ([]model.Tombstone, error) {
+	var a string
+	trash := []model.Tombstone{}
+	err := client.Call("SDFS.RPCTrash", &a, &trash)
+	if err != nil {
+		return nil, err
+	}
+	return trash, nil
+}
+
+func (c *Client) callUndeleteRPC(client *rpc.Client, filename string) error {
+	var ok bool
+	err := client.Call("SDFS.RPCUndelete", &filename, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("undelete %s failed", filename)
+	}
+	return nil
+}
+
+func (c *Client) callSnapshotRPC(client *rpc.Client, method string, name string) error {
+	var ok bool
+	err := client.Call("SDFS."+method, &name, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s %s failed", method, name)
+	}
+	return nil
+}
+
+func (c *Client) callListSnapshotsRPC(client *rpc.Client) ([]model.SnapshotInfo, error) {
+	var a string
+	infos := []model.SnapshotInfo{}
+	err := client.Call("SDFS.RPCListSnapshots", &a, &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (c *Client) callDiffSnapshotsRPC(client *rpc.Client, from string, to string) (model.SnapshotDiff, error) {
+	args := model.RPCDiffSnapshotsArgs{
+		From: from,
+		To:   to,
+	}
+	var diff model.SnapshotDiff
+	err := client.Call("SDFS.RPCDiffSnapshots", &args, &diff)
+	if err != nil {
+		return model.SnapshotDiff{}, err
+	}
+	return diff, nil
+}
+
+func (c *Client) callRestoreSnapshotRPC(client *rpc.Client, name string, filename string) ([]string, error) {
+	args := model.RPCRestoreSnapshotArgs{
+		Snapshot: name,
+		Filename: filename,
+	}
+	restored := []string{}
+	err := client.Call("SDFS.RPCRestoreSnapshot", &args, &restored)
+	return restored, err
+}
+
+func (c *Client) callTagRPC(client *rpc.Client, method string, filename string, version int, tag string) error {
+	args := model.RPCTagArgs{
+		Filename: filename,
+		Version:  version,
+		Tag:      tag,
+	}
+	var ok bool
+	err := client.Call("SDFS."+method, &args, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s %s of %s failed", method, tag, filename)
+	}
+	return nil
+}
+
+func (c *Client) callTagsRPC(client *rpc.Client, filename string) (map[string]int, error) {
+	tags := make(map[string]int)
+	err := client.Call("SDFS.RPCTags", &filename, &tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (c *Client) callDiffVersionsRPC(client *rpc.Client, filename string, from, to int) (model.RPCDiffReply, error) {
+	args := model.RPCDiffArgs{
+		Filename: filename,
+		From:     from,
+		To:       to,
+	}
+	var reply model.RPCDiffReply
+	err := client.Call("SDFS.RPCDiffVersions", &args, &reply)
+	if err != nil {
+		return model.RPCDiffReply{}, err
+	}
+	return reply, nil
+}
+
+func (c *Client) callPullFileRPC(client *rpc.Client, filename string) (model.RPCFile, error) {
+	var reply model.RPCFile
+	err := client.Call("SDFS.RPCPullFile", &filename, &reply)
+	if err != nil {
+		fmt.Println(err)
+		return model.RPCFile{}, err
+	}
+	return reply, nil
+}
+
+func (c *Client) callGetVersionsRPC(client *rpc.Client, filename string, numVersions int, since, until time.Time) ([]model.RPCGetLatestVersionsReply, error) {
+	args := model.RPCGetLatestVersionsArgs{
+		Filename: filename,
+		Versions: numVersions,
+		Since:    since,
+		Until:    until,
+	}
+	var reply []model.RPCGetLatestVersionsReply
+	err := client.Call("SDFS.RPCGetLatestVersions", &args, &reply)
+	if err != nil {
+		fmt.Println(err)
+		return []model.RPCGetLatestVersionsReply{}, err
+	}
+	return reply, nil
+}
+
+func (c *Client) pushFileToNode(filename string, filenameVersion string, nodeID string) error {
+	fmt.Printf("pushFileToNode: DialHTTP: ip: %s, port: %d\n", c.getIPFromID(nodeID), c.config.Port)
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nodeID), c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	fmt.Printf("pushFileToNode: readFileContent: %v\n", filename)
+	fileContent, err := c.readFileContent(filename)
+	if err != nil {
+		return err
+	}
+	return c.pushContentToNode(client, fileContent, filenameVersion, nodeID)
+}
+
+// pushContentToNode push fileContent as replica file filenameVersion to nodeID through client
+func (c *Client) pushContentToNode(client *rpc.Client, fileContent []byte, filenameVersion string, nodeID string) error {
+	args := model.RPCFile{
+		Filename:    filenameVersion,
+		FileContent: fileContent,
+	}
+
+	var ok bool
+	fmt.Printf("pushFileToNode: calling SDFS.RPCPushFile")
+	err := client.Call("SDFS.RPCPushFile", &args, &ok)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("push file to %s failed", nodeID)
+	}
+	return nil
+}
+
+func (c *Client) callPutFileRPC(client *rpc.Client, filename string, sdfsFilename string, replicas int, meta model.FileMeta) (model.RPCFilenameWithReplica, error) {
+	var reply model.RPCFilenameWithReplica
+	sum, size, head, err := c.hashFile(filename)
+	if err != nil {
+		return model.RPCFilenameWithReplica{}, err
+	}
+	meta.Uploader = c.uploader()
+	if meta.ContentType == "" {
+		meta.ContentType = c.contentType(filename, head)
+	}
+	file := model.RPCAddFileArgs{
+		Filename: sdfsFilename,
+		MD5:      sum,
+		Size:     size,
+		Replicas: replicas,
+		Meta:     meta,
+	}
+	err = client.Call("SDFS.RPCPutFile", &file, &reply)
+	if err != nil {
+		fmt.Println(err)
+		return model.RPCFilenameWithReplica{}, err
+	}
+	fmt.Printf("Replica list: %v\n", reply.ReplicaList)
+	if reply.Stored {
+		fmt.Printf("Content of %s is already stored, nothing to upload\n", filename)
+		return reply, nil
+	}
+	if reply.Coding.Data > 0 {
+		fileContent, err := c.readFileContent(filename)
+		if err != nil {
+			return reply, err
+		}
+		return reply, c.pushShards(fileContent, reply)
+	}
+	if len(reply.Blocks) > 0 {
+		err = c.pushBlocks(filename, reply)
+		if err != nil {
+			fmt.Printf("put %s failed: %v\n", sdfsFilename, err)
+		}
+		return reply, err
+	}
+	for _, nID := range reply.ReplicaList {
+		fmt.Printf("Pushing file %s to %v", reply.Filename, nID)
+		c.pushFileToNode(filename, reply.Filename, nID)
+	}
+	return reply, nil
+}
+
+// pushShards encode fileContent by reply.Coding and push shard k to reply.ReplicaList[k]
+func (c *Client) pushShards(fileContent []byte, reply model.RPCFilenameWithReplica) error {
+	shards, err := erasure.Encode(fileContent, reply.Coding.Data, reply.Coding.Parity)
+	if err != nil {
+		return err
+	}
+	if len(shards) != len(reply.ReplicaList) {
+		return fmt.Errorf("%s has %d shards but %d nodes", reply.Filename, len(shards), len(reply.ReplicaList))
+	}
+	for k, nID := range reply.ReplicaList {
+		fmt.Printf("Pushing shard %d of %s to %v\n", k, reply.Filename, nID)
+		client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nID), c.config.Port))
+		if err != nil {
+			log.Fatal("dialing:", err)
+		}
+		err = c.pushContentToNode(client, shards[k], reply.Filename, nID)
+		if err != nil {
+			fmt.Printf("push shard %d of %s to %v failed: %v\n", k, reply.Filename, nID, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) callSetReplicationRPC(client *rpc.Client, filename string, replicas int) (model.RPCFilenameWithReplica, error) {
+	args := model.RPCSetReplicationArgs{
+		Filename: filename,
+		Replicas: replicas,
+	}
+	var reply model.RPCFilenameWithReplica
+	err := client.Call("SDFS.RPCSetReplication", &args, &reply)
+	if err != nil {
+		return reply, err
+	}
+	return reply, nil
+}
+
+func (c *Client) callSetRetentionRPC(client *rpc.Client, args model.RPCSetRetentionArgs) error {
+	var ok bool
+	err := client.Call("SDFS.RPCSetRetention", &args, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("set retention of %s failed", args.Filename)
+	}
+	return nil
+}
+
+func (c *Client) callSetQuotaRPC(client *rpc.Client, q model.Quota) error {
+	var ok bool
+	err := client.Call("SDFS.RPCSetQuota", &q, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("set quota failed")
+	}
+	return nil
+}
+
+func (c *Client) callQuotasRPC(client *rpc.Client) ([]model.QuotaUsage, error) {
+	var a string
+	usages := []model.QuotaUsage{}
+	err := client.Call("SDFS.RPCQuotas", &a, &usages)
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+func (c *Client) callSetCodingRPC(client *rpc.Client, args model.RPCSetCodingArgs) error {
+	var ok bool
+	err := client.Call("SDFS.RPCSetCoding", &args, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("set coding of %s failed", args.Name)
+	}
+	return nil
+}
+
+func (c *Client) callCodingsRPC(client *rpc.Client) (map[string]model.Coding, error) {
+	var codings map[string]model.Coding
+	err := client.Call("SDFS.RPCCodings", "", &codings)
+	if err != nil {
+		return nil, err
+	}
+	return codings, nil
+}
+
+func (c *Client) callRebalanceRPC(client *rpc.Client, dryRun bool) ([]model.Move, error) {
+	args := model.RPCRebalanceArgs{
+		DryRun: dryRun,
+	}
+	moves := []model.Move{}
+	err := client.Call("SDFS.RPCRebalance", &args, &moves)
+	if err != nil {
+		return nil, err
+	}
+	return moves, nil
+}
+
+func (c *Client) callDecommissionRPC(client *rpc.Client, nodeID string) (model.DecommissionStatus, error) {
+	status := model.DecommissionStatus{}
+	err := client.Call("SDFS.RPCDecommission", &nodeID, &status)
+	if err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+func (c *Client) callDecommissionStatusRPC(client *rpc.Client, nodeID string) (model.DecommissionStatus, error) {
+	status := model.DecommissionStatus{}
+	err := client.Call("SDFS.RPCDecommissionStatus", &nodeID, &status)
+	if err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+func (c *Client) callFsckRPC(client *rpc.Client, repair bool) (model.RPCFsckReply, error) {
+	args := model.RPCFsckArgs{
+		Repair: repair,
+	}
+	var reply model.RPCFsckReply
+	err := client.Call("SDFS.RPCFsck", &args, &reply)
+	if err != nil {
+		return reply, err
+	}
+	return reply, nil
+}
+
+func (c *Client) callStatRPC(client *rpc.Client, filename string, version int) (model.FileStat, error) {
+	args := model.RPCStatArgs{
+		Filename: filename,
+		Version:  version,
+	}
+	var reply model.FileStat
+	err := client.Call("SDFS.RPCStat", &args, &reply)
+	if err != nil {
+		return reply, err
+	}
+	return reply, nil
+}
+
+func (c *Client) callMoveFileRPC(client *rpc.Client, src string, dst string) (string, error) {
+	args := model.RPCMoveFileArgs{
+		Src: src,
+		Dst: dst,
+	}
+	var reply string
+	err := client.Call("SDFS.RPCMoveFile", &args, &reply)
+	if err != nil {
+		return "", err
+	}
+	return reply, nil
+}
+
+func (c *Client) callMkdirRPC(client *rpc.Client, dir string) error {
+	var ok bool
+	err := client.Call("SDFS.RPCMkdir", &dir, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("mkdir %s failed", dir)
+	}
+	return nil
+}
+
+func (c *Client) callRmdirRPC(client *rpc.Client, dir string) error {
+	var ok bool
+	err := client.Call("SDFS.RPCRmdir", &dir, &ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("rmdir %s failed", dir)
+	}
+	return nil
+}
+
+func (c *Client) callListDirRPC(client *rpc.Client, dir string, recursive bool) ([]model.DirEntry, error) {
+	args := model.RPCListDirArgs{
+		Dir:       dir,
+		Recursive: recursive,
+	}
+	entries := []model.DirEntry{}
+	err := client.Call("SDFS.RPCListDir", &args, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *Client) callListAllRPC(client *rpc.Client, pattern string, after string, limit int) (model.RPCListAllReply, error) {
+	args := model.RPCListAllArgs{
+		Pattern: pattern,
+		After:   after,
+		Limit:   limit,
+	}
+	reply := model.RPCListAllReply{}
+	err := client.Call("SDFS.RPCListAll", &args, &reply)
+	if err != nil {
+		return model.RPCListAllReply{}, err
+	}
+	return reply, nil
+}
+
+func (c *Client) callLsRPC(client *rpc.Client, filename string) ([]string, error) {
+	replicaList := []string{}
+	err := client.Call("SDFS.RPCLsReplicasOfFile", &filename, &replicaList)
+	if err != nil {
+		return nil, err
+	}
+
+	return replicaList, nil
+}
+
+func (c *Client) callStoresRPC(client *rpc.Client, nodeID string) ([]string, error) {
+	fileList := []string{}
+	err := client.Call("SDFS.RPCStoresOnNode", &nodeID, &fileList)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileList, nil
+}
+
+// putFile put local file ./files/{filename} as sdfsFilename, the content type is guessed if meta has none
+func (c *Client) putFile(filename string, sdfsFilename string, replicas int, meta model.FileMeta) {
+	t0 := time.Now()
+	fmt.Println("putFile: ", filename)
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	fmt.Println("Connection made")
+
+	reply, err := c.callPutFileRPC(client, filename, sdfsFilename, replicas, meta)
+	if err != nil {
+		fmt.Printf("Time for -put: %v\n", time.Since(t0))
+		return
+	}
+
+	log.Printf("%s is on %v\n", sdfsFilename, reply.ReplicaList)
+	fmt.Printf("Time for -put: %v\n", time.Since(t0))
+}
+
+func (c *Client) putFolder(folder string, replicas int, meta model.FileMeta) {
+	t0 := time.Now()
+
+	fmt.Println("putFolder: ", folder)
+
+	// ./files/{folder}/a/b is put as /{folder}/a/b
+	root := filepath.Join("./files", folder)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel("./files", p)
+		if err != nil {
+			return err
+		}
+		c.putFile(rel, "/"+filepath.ToSlash(rel), replicas, meta)
+		fmt.Printf("Push %s finished!", rel)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Time for -put-folder: %v\n", time.Since(t0))
+}
+
+func (c *Client) getFile(filename string, asOf time.Time) {
+	fmt.Println("getFile: ", filename)
+	t0 := time.Now()
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	fmt.Println("Connection made")
+	var reply model.RPCFilenameWithReplica
+	if asOf.IsZero() {
+		reply, err = c.callGetFileRPC(client, filename)
+	} else {
+		reply, err = c.callGetFileAsOfRPC(client, filename, asOf)
+	}
+	if err != nil {
+		return
+	}
+	fmt.Printf("GETFILE: replicalist %v\n", reply.ReplicaList)
+
+	fmt.Printf("Files with %s: %v \n", filename, reply.ReplicaList)
+
+	if len(reply.ReplicaList) == 0 {
+		log.Println("File not available")
+		fmt.Printf("Time for -get: %v\n", time.Since(t0))
+		return
+	}
+
+	log.Printf("Nodes with FileName: %v \n", reply.ReplicaList)
+
+	if reply.Coding.Data > 0 {
+		content, err := c.getShards(reply.Filename, reply.Coding, reply.ReplicaList, reply.Size)
+		if err != nil {
+			fmt.Printf("getFile: %v\n", err)
+			return
+		}
+		c.writeFile("./fetched_files/"+filename, content)
+		fmt.Printf("Time for -get: %v\n", time.Since(t0))
+		return
+	}
+	if len(reply.Blocks) > 0 {
+		err := c.getBlocks(reply.Filename, reply.Blocks, "./fetched_files/"+filename)
+		if err != nil {
+			fmt.Printf("getFile: %v\n", err)
+		}
+		fmt.Printf("Time for -get: %v\n", time.Since(t0))
+		return
+	}
+
+	for _, id := range reply.ReplicaList {
+		cl, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(id), c.config.Port))
+		if err != nil {
+			log.Fatal("dialing:", err)
+		}
+		// TODO: Could possible use a goroutine
+		file, err := c.callPullFileRPC(cl, reply.Filename)
+		if err != nil {
+			return
+		}
+		// TODO: could possible save in cache
+		fmt.Printf("Saved in files folder:\n%s\n", file.FileContent)
+		c.writeFile("./fetched_files/"+filename, file.FileContent)
+		fmt.Printf("Time for -get: %v\n", time.Since(t0))
+		break
+	}
+	fmt.Printf("Time for -get: %v\n", time.Since(t0))
+}
+
+// pushBlocks read local file filename one block at a time and push each block to the nodes of the block.
+// An error if a block reached none of its nodes, blocks which reached some are copied to the others later.
+func (c *Client) pushBlocks(filename string, reply model.RPCFilenameWithReplica) error {
+	f, err := os.Open("./files/" + filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	content := make([]byte, reply.Blocks[0].Size)
+	var offset int64
+	for k, block := range reply.Blocks {
+		n, err := f.ReadAt(content[:block.Size], offset)
+		if int64(n) < block.Size {
+			return fmt.Errorf("read block %d of %s: %v", k, filename, err)
+		}
+		offset += block.Size
+
+		// the index names block k of version file_v file_v.k on disk
+		blockName := fmt.Sprintf("%s.%d", reply.Filename, k)
+		pushed := 0
+		for _, nID := range block.Nodes {
+			fmt.Printf("Pushing block %d of %s to %v\n", k, reply.Filename, nID)
+			err := c.pushBlockToNode(content[:block.Size], blockName, nID)
+			if err != nil {
+				fmt.Printf("push block %d of %s to %v failed: %v\n", k, reply.Filename, nID, err)
+				continue
+			}
+			pushed++
+		}
+		if pushed == 0 {
+			return fmt.Errorf("block %d of %s reached none of %v", k, reply.Filename, block.Nodes)
+		}
+	}
+	return nil
+}
+
+// pushBlockToNode push content of a block to node nID as blockName
+func (c *Client) pushBlockToNode(content []byte, blockName string, nID string) error {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nID), c.config.Port))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return c.pushContentToNode(client, content, blockName, nID)
+}
+
+// getBlocks fetch the blocks of replica file filename, at most maxBlockFetches at a time, and write each
+// in place into local file out. Block k is read from its nodes starting at the k-th, so that the reads
+// spread over them. out is removed if a block could not be fetched.
+func (c *Client) getBlocks(filename string, blocks []model.Block, out string) error {
+	err := os.MkdirAll(filepath.Dir(out), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	slots := make(chan bool, maxBlockFetches)
+	errs := make(chan error, len(blocks))
+	var offset int64
+	for k, block := range blocks {
+		go func(k int, block model.Block, offset int64) {
+			slots <- true
+			defer func() { <-slots }()
+			errs <- c.getBlock(f, fmt.Sprintf("%s.%d", filename, k), k, block, offset)
+		}(k, block, offset)
+		offset += block.Size
+	}
+
+	for range blocks {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		// a partly written file is not the file
+		f.Close()
+		os.Remove(out)
+	}
+	return err
+}
+
+// getBlock fetch block k of replica file filename, on disk as blockName, and write it into f at offset
+func (c *Client) getBlock(f *os.File, blockName string, k int, block model.Block, offset int64) error {
+	for n := range block.Nodes {
+		nID := block.Nodes[(k+n)%len(block.Nodes)]
+		cl, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nID), c.config.Port))
+		if err != nil {
+			fmt.Printf("getBlock: dialing %v: %v\n", nID, err)
+			continue
+		}
+		file, err := c.callPullFileRPC(cl, blockName)
+		cl.Close()
+		if err != nil || int64(len(file.FileContent)) != block.Size {
+			continue
+		}
+		_, err = f.WriteAt(file.FileContent, offset)
+		return err
+	}
+	return fmt.Errorf("no node of %v holds %s", block.Nodes, blockName)
+}
+
+// getShards content of size bytes of replica file filename decoded from the first coding.Data
+// shards fetched, shards[k] is the node of shard k, "" if lost
+func (c *Client) getShards(filename string, coding model.Coding, shards []string, size int64) ([]byte, error) {
+	contents := make([][]byte, len(shards))
+	got := 0
+	for k, nID := range shards {
+		if got == coding.Data {
+			break
+		}
+		if nID == "" {
+			continue
+		}
+		contents[k] = c.getFileFromNode(filename, nID)
+		if contents[k] != nil {
+			got++
+		}
+	}
+	return erasure.Join(contents, coding.Data, coding.Parity, size)
+}
+
+func (c *Client) getFileFromNode(filename string, nodeID string) []byte {
+	cl, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nodeID), c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	file, err := c.callPullFileRPC(cl, filename)
+	if err != nil {
+		return nil
+	}
+	return file.FileContent
+}
+
+func (c *Client) deleteFile(filename string) {
+	t0 := time.Now()
+	fmt.Println("deleteFile: ", filename)
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	reply, err := c.callRemoveFileRPC(client, filename)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("deleteFile: Files with %s: %v \n", filename, reply)
+
+	if len(reply) == 0 {
+		log.Println("File not available")
+		return
+	}
+
+	log.Printf("Nodes with FileName: %v \n", reply)
+
+	// the replicas stay on their nodes until the trash is purged
+	fmt.Printf("Moved to trash: %s\n", filename)
+	fmt.Printf("Time for -del: %v\n", time.Since(t0))
+}
+
+func (c *Client) trashLs() {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	trash, err := c.callTrashRPC(client)
+	if err != nil {
+		fmt.Printf("trashLs: callTrashRPC failed, err: %v\n", err)
+		return
+	}
+
+	for _, tomb := range trash {
+		fmt.Printf("\t%s\tdeleted %v\t%d versions\n", tomb.Filename, tomb.Deleted.Format(time.RFC3339), len(tomb.Versions))
+	}
+	fmt.Printf("%d files in trash\n", len(trash))
+}
+
+func (c *Client) undelete(filename string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	err = c.callUndeleteRPC(client, filename)
+	if err != nil {
+		fmt.Printf("undelete: callUndeleteRPC failed, err: %v\n", err)
+		return
+	}
+	fmt.Printf("Undeleted %s\n", filename)
+}
+
+// snapshot run a snapshot command: create {name}, ls, diff {from} [to], restore {name} [file], delete {name}
+// quotaLimit limit for -quota output, "-" for no limit
+func quotaLimit(limit int64) string {
+	if limit == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+func (c *Client) quota(command string, args []string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	// "*" is any identity and "/" the whole namespace
+	q := model.Quota{}
+	if len(args) >= 2 {
+		if args[0] != "*" {
+			q.Identity = args[0]
+		}
+		if args[1] != "/" {
+			q.Prefix = args[1]
+		}
+	}
+
+	switch {
+	case command == "ls":
+		usages, err := c.callQuotasRPC(client)
+		if err != nil {
+			fmt.Printf("quota: callQuotasRPC failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("You are %s\n", c.uploader())
+		for _, usage := range usages {
+			identity, prefix := usage.Identity, usage.Prefix
+			if identity == "" {
+				identity = "*"
+			}
+			if prefix == "" {
+				prefix = "/"
+			}
+			fmt.Printf("\t%s\t%s\t%d/%s bytes\t%d/%s files\n", identity, prefix, usage.Bytes, quotaLimit(usage.MaxBytes), usage.Files, quotaLimit(int64(usage.MaxFiles)))
+		}
+	case command == "set" && len(args) == 4:
+		q.MaxBytes, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			fmt.Printf("max-bytes should be a number!")
+			return
+		}
+		q.MaxFiles, err = strconv.Atoi(args[3])
+		if err != nil {
+			fmt.Printf("max-files should be a number!")
+			return
+		}
+		err = c.callSetQuotaRPC(client, q)
+		if err != nil {
+			fmt.Printf("quota: set failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("Set quota of %s under %s to %s bytes and %s files\n", args[0], args[1], quotaLimit(q.MaxBytes), quotaLimit(int64(q.MaxFiles)))
+	case command == "clear" && len(args) == 2:
+		err = c.callSetQuotaRPC(client, q)
+		if err != nil {
+			fmt.Printf("quota: clear failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("Removed quota of %s under %s\n", args[0], args[1])
+	default:
+		fmt.Println("usage: quota ls | set {identity|*} {prefix|/} {max-bytes} {max-files} | clear {identity|*} {prefix|/}")
+	}
+}
+
+// coding run a coding command: ls, set {file|dir} {data} {parity}, clear {file|dir}
+func (c *Client) coding(command string, args []string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	switch {
+	case command == "ls":
+		codings, err := c.callCodingsRPC(client)
+		if err != nil {
+			fmt.Printf("coding: callCodingsRPC failed, err: %v\n", err)
+			return
+		}
+		names := []string{}
+		for name := range codings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("\t%s\t%d+%d\n", name, codings[name].Data, codings[name].Parity)
+		}
+	case command == "set" && len(args) == 3:
+		data, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Printf("data should be a number!")
+			return
+		}
+		parity, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Printf("parity should be a number!")
+			return
+		}
+		err = c.callSetCodingRPC(client, model.RPCSetCodingArgs{
+			Name:   args[0],
+			Coding: model.Coding{Data: data, Parity: parity},
+		})
+		if err != nil {
+			fmt.Printf("coding: set failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("New versions of %s are stored as %d data + %d parity shards\n", args[0], data, parity)
+	case command == "clear" && len(args) == 1:
+		err = c.callSetCodingRPC(client, model.RPCSetCodingArgs{
+			Name:  args[0],
+			Clear: true,
+		})
+		if err != nil {
+			fmt.Printf("coding: clear failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("New versions of %s are replicated\n", args[0])
+	default:
+		fmt.Println("usage: coding ls | set {file|dir} {data} {parity} | clear {file|dir}")
+	}
+}
+
+func (c *Client) snapshot(command string, args []string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	switch {
+	case command == "ls":
+		infos, err := c.callListSnapshotsRPC(client)
+		if err != nil {
+			fmt.Printf("snapshot: callListSnapshotsRPC failed, err: %v\n", err)
+			return
+		}
+		for _, info := range infos {
+			fmt.Printf("\t%s\t%v\t%d files\t%d bytes\n", info.Name, info.Created.Format(time.RFC3339), info.Files, info.Bytes)
+		}
+	case command == "create" && len(args) == 1:
+		err = c.callSnapshotRPC(client, "RPCCreateSnapshot", args[0])
+		if err != nil {
+			fmt.Printf("snapshot: create failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("Created snapshot %s\n", args[0])
+	case command == "delete" && len(args) == 1:
+		err = c.callSnapshotRPC(client, "RPCDeleteSnapshot", args[0])
+		if err != nil {
+			fmt.Printf("snapshot: delete failed, err: %v\n", err)
+			return
+		}
+		fmt.Printf("Deleted snapshot %s\n", args[0])
+	case command == "diff" && (len(args) == 1 || len(args) == 2):
+		to := ""
+		if len(args) == 2 {
+			to = args[1]
+		}
+		diff, err := c.callDiffSnapshotsRPC(client, args[0], to)
+		if err != nil {
+			fmt.Printf("snapshot: callDiffSnapshotsRPC failed, err: %v\n", err)
+			return
+		}
+		for _, filename := range diff.Added {
+			fmt.Printf("\t+ %s\n", filename)
+		}
+		for _, filename := range diff.Removed {
+			fmt.Printf("\t- %s\n", filename)
+		}
+		for _, filename := range diff.Changed {
+			fmt.Printf("\tM %s\n", filename)
+		}
+	case command == "restore" && (len(args) == 1 || len(args) == 2):
+		filename := ""
+		if len(args) == 2 {
+			filename = args[1]
+		}
+		restored, err := c.callRestoreSnapshotRPC(client, args[0], filename)
+		for _, name := range restored {
+			fmt.Printf("\tRestored %s\n", name)
+		}
+		if err != nil {
+			fmt.Printf("snapshot: callRestoreSnapshotRPC failed, err: %v\n", err)
+		}
+	default:
+		fmt.Println("usage: snapshot create {name} | ls | diff {from} [to] | restore {name} [file] | delete {name}")
+	}
+}
+
+func (c *Client) tag(filename string, version int, tag string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	err = c.callTagRPC(client, "RPCTag", filename, version, tag)
+	if err != nil {
+		fmt.Printf("tag: callTagRPC failed, err: %v\n", err)
+		return
+	}
+	fmt.Printf("Tagged %s@%s\n", filename, tag)
+}
+
+func (c *Client) untag(filename string, tag string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	err = c.callTagRPC(client, "RPCUntag", filename, -1, tag)
+	if err != nil {
+		fmt.Printf("untag: callTagRPC failed, err: %v\n", err)
+		return
+	}
+	fmt.Printf("Removed tag %s@%s\n", filename, tag)
+}
+
+func (c *Client) tags(filename string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	tags, err := c.callTagsRPC(client, filename)
+	if err != nil {
+		fmt.Printf("tags: callTagsRPC failed, err: %v\n", err)
+		return
+	}
+
+	names := []string{}
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	for _, tag := range names {
+		fmt.Printf("\t%s\tversion %d\n", tag, tags[tag])
+	}
+}
+
+func (c *Client) diffVersions(filename string, from, to int) {
+	t0 := time.Now()
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+
+	reply, err := c.callDiffVersionsRPC(client, filename, from, to)
+	if err != nil {
+		fmt.Printf("diff: callDiffVersionsRPC failed, err: %v\n", err)
+		return
+	}
+
+	if !reply.Binary {
+		if reply.Diff == "" {
+			fmt.Printf("Version %d and %d of %s are the same\n", reply.From, reply.To, reply.Filename)
+		}
+		fmt.Print(reply.Diff)
+	} else {
+		fmt.Printf("Binary version %d (%d bytes) and %d (%d bytes) of %s differ in %d ranges:\n", reply.From, reply.FromSize, reply.To, reply.ToSize, reply.Filename, reply.TotalRanges)
+		for _, r := range reply.Ranges {
+			fmt.Printf("\t[%d, %d) %d bytes\n", r.Offset, r.Offset+r.Length, r.Length)
+		}
+		if more := reply.TotalRanges - len(reply.Ranges); more > 0 {
+			fmt.Printf("\t... %d more ranges\n", more)
+		}
+	}
+	fmt.Printf("Time for -diff: %v\n", time.Since(t0))
+}
+
+func (c *Client) getVersionForFile(filename string, numVersions int, outFileName string, since, until time.Time) {
+
+	table := make(map[string]int)
+	fmt.Printf("filename: %s, versions: %d\n\n", filename, numVersions)
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	reply, err := c.callGetVersionsRPC(client, filename, numVersions, since, until)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("version information: %v \n\n", reply)
+	for _, version := range reply {
+		if version.Coding.Data > 0 {
+			left := 0
+			for _, nID := range version.ReplicaList {
+				if nID != "" {
+					left++
+				}
+			}
+			if left < version.Coding.Data {
+				fmt.Printf("Version %d of %s is lost, %d of %d shards left\n", version.Version, filename, left, version.Replication)
+			} else if left < version.Replication {
+				fmt.Printf("Version %d of %s is missing %d of %d shards\n", version.Version, filename, version.Replication-left, version.Replication)
+			}
+		} else if len(version.Blocks) > 0 {
+			lost, under := 0, 0
+			for _, block := range version.Blocks {
+				if len(block.Nodes) == 0 {
+					lost++
+				} else if len(block.Nodes) < version.Replication {
+					under++
+				}
+			}
+			if lost > 0 {
+				fmt.Printf("Version %d of %s is lost, %d of %d blocks have no copy\n", version.Version, filename, lost, len(version.Blocks))
+			} else if under > 0 {
+				fmt.Printf("Version %d of %s is under-replicated: %d of %d blocks have fewer than %d copies\n", version.Version, filename, under, len(version.Blocks), version.Replication)
+			}
+		} else if len(version.ReplicaList) == 0 {
+			fmt.Printf("Version %d of %s is lost, no node holds it\n", version.Version, filename)
+		} else if len(version.ReplicaList) < version.Replication {
+			fmt.Printf("Version %d of %s is under-replicated: %d of %d copies\n", version.Version, filename, len(version.ReplicaList), version.Replication)
+		}
+	}
+
+	if len(reply) == 0 {
+		log.Println("File not available")
+		return
+	}
+
+	outContent := make([]byte, 0)
+
+	// TODO: Could possible use a goroutine
+	for _, version := range reply {
+		if len(version.Blocks) > 0 {
+			fmt.Printf("Version %d of %s is split into %d blocks, too large to fetch with the others\n", version.Version, filename, len(version.Blocks))
+			continue
+		}
+		if version.Coding.Data > 0 {
+			content, err := c.getShards(version.Filename, version.Coding, version.ReplicaList, version.Size)
+			if err != nil {
+				fmt.Printf("getVersions: %v\n", err)
+				continue
+			}
+			outContent = append(outContent, []byte(fmt.Sprintf("Version: %d, committed %s: \n", version.Version, version.Timestamp.Format(time.RFC3339)))...)
+			outContent = append(outContent, []byte("----------------File begining--------------\n\n")...)
+			outContent = append(outContent, content...)
+			outContent = append(outContent, []byte("\n------------------End File-----------------\n\n")...)
+			continue
+		}
+		for _, nID := range version.ReplicaList {
+			_, ok := table[version.Filename]
+			if ok {
+				continue
+			}
+			table[version.Filename] = 1
+			content := c.getFileFromNode(version.Filename, nID)
+			fmt.Printf("Fetched %s version%d: \n----------------File begining--------------\n%s\n......\n%s\n------------------End File-----------------\n\n", filename, version.Version, content[:100], content[len(content)-100:])
+			outContent = append(outContent, []byte(fmt.Sprintf("Version: %d, committed %s: \n", version.Version, version.Timestamp.Format(time.RFC3339)))...)
+			outContent = append(outContent, []byte("----------------File begining--------------\n\n")...)
+			outContent = append(outContent, content...)
+			outContent = append(outContent, []byte("\n------------------End File-----------------\n\n")...)
+		}
+	}
 
-func (c *Client) callPullFileRPC(client *rpc.Client, filename string) (model.RPCFile, error) {
-	var reply model.RPCFile
-	err := client.Call("SDFS.RPCPullFile", &filename, &reply)
-	if err != nil {
-		fmt.Println(err)
-		return model.RPCFile{}, err
-	}
-	return reply, nil
+	c.writeFile("./fetched_files/"+outFileName, outContent)
 }
 
-func (c *Client) callDeleteFileStarRPC(client *rpc.Client, filename string) (bool, error) {
-	var reply bool
-	err := client.Call("SDFS.RPCDeleteFileStar", &filename, &reply)
+func (c *Client) setReplication(filename string, replicas int) {
+	t0 := time.Now()
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
-		fmt.Println(err)
-		return false, err
+		log.Fatal("dialing:", err)
 	}
-	return reply, nil
-}
 
-func (c *Client) callGetVersionsRPC(client *rpc.Client, filename string, numVersions int) ([]model.RPCGetLatestVersionsReply, error) {
-	args := model.RPCGetLatestVersionsArgs{
-		Filename: filename,
-		Versions: numVersions,
-	}
-	var reply []model.RPCGetLatestVersionsReply
-	err := client.Call("SDFS.RPCGetLatestVersions", &args, &reply)
+	reply, err := c.callSetReplicationRPC(client, filename, replicas)
 	if err != nil {
-		fmt.Println(err)
-		return []model.RPCGetLatestVersionsReply{}, err
+		fmt.Printf("setReplication: callSetReplicationRPC failed, err: %v\n", err)
 	}
-	return reply, nil
+
+	fmt.Printf("File %s is replicated on nodes: %v\n", filename, reply.ReplicaList)
+	fmt.Printf("Time for -set-replication: %v\n", time.Since(t0))
 }
 
-func (c *Client) pushFileToNode(filename string, filenameVersion string, nodeID string) error {
-	fmt.Printf("pushFileToNode: DialHTTP: ip: %s, port: %d\n", c.getIPFromID(nodeID), c.config.Port)
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nodeID), c.config.Port))
+func (c *Client) setRetention(args model.RPCSetRetentionArgs) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
 
-	fmt.Printf("pushFileToNode: readFileContent: %v\n", filename)
-	fileContent, err := c.readFileContent(filename)
+	err = c.callSetRetentionRPC(client, args)
 	if err != nil {
-		return err
+		fmt.Printf("setRetention: callSetRetentionRPC failed, err: %v\n", err)
+		return
 	}
 
-	args := model.RPCFile{
-		Filename:    filenameVersion,
-		FileContent: fileContent,
+	if args.Clear {
+		fmt.Printf("File %s uses the cluster-wide retention policy\n", args.Filename)
+	} else {
+		fmt.Printf("File %s keeps the last %d versions and versions newer than %d seconds\n", args.Filename, args.Policy.KeepVersions, args.Policy.MaxAge)
 	}
+}
 
-	var ok bool
-	fmt.Printf("pushFileToNode: calling SDFS.RPCPushFile")
-	err = client.Call("SDFS.RPCPushFile", &args, &ok)
+func (c *Client) rebalance(dryRun bool) {
+	t0 := time.Now()
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
-		return err
-	}
-
-	if !ok {
-		return fmt.Errorf("push file to %s failed", nodeID)
+		log.Fatal("dialing:", err)
 	}
-	return nil
-}
 
-func (c *Client) callPutFileRPC(client *rpc.Client, filename string) (model.RPCFilenameWithReplica, error) {
-	var reply model.RPCFilenameWithReplica
-	fileContent, err := c.readFileContent(filename)
+	moves, err := c.callRebalanceRPC(client, dryRun)
 	if err != nil {
-		return model.RPCFilenameWithReplica{}, err
-	}
-	file := model.RPCAddFileArgs{
-		Filename: filename,
-		MD5:      md5.Sum(fileContent),
+		fmt.Printf("rebalance: callRebalanceRPC failed, err: %v\n", err)
+		return
 	}
-	err = client.Call("SDFS.RPCPutFile", &file, &reply)
-	if err != nil {
-		fmt.Println(err)
-		return model.RPCFilenameWithReplica{}, err
+
+	if dryRun {
+		fmt.Printf("Planned moves: %d\n", len(moves))
+	} else {
+		fmt.Printf("Moved: %d\n", len(moves))
 	}
-	fmt.Printf("Replica list: %v\n", reply.ReplicaList)
-	for _, nID := range reply.ReplicaList {
-		fmt.Printf("Pushing file %s to %v", reply.Filename, nID)
-		c.pushFileToNode(filename, reply.Filename, nID)
+	for _, move := range moves {
+		fmt.Printf("\t%s_%d (%d bytes): %s -> %s\n", move.File.Filename, move.File.Version, move.File.Size, move.From, move.To)
 	}
-	return reply, nil
+	fmt.Printf("Time for -rebalance: %v\n", time.Since(t0))
 }
 
-func (c *Client) callLsRPC(client *rpc.Client, filename string) ([]string, error) {
-	replicaList := []string{}
-	err := client.Call("SDFS.RPCLsReplicasOfFile", &filename, &replicaList)
+// decommission drain nodeID and print its progress every second until it has left the group
+func (c *Client) decommission(nodeID string) {
+	t0 := time.Now()
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
-		return nil, err
+		log.Fatal("dialing:", err)
 	}
 
-	return replicaList, nil
-}
-
-func (c *Client) callStoresRPC(client *rpc.Client, nodeID string) ([]string, error) {
-	fileList := []string{}
-	err := client.Call("SDFS.RPCStoresOnNode", &nodeID, &fileList)
+	status, err := c.callDecommissionRPC(client, nodeID)
 	if err != nil {
-		return nil, err
+		fmt.Printf("decommission: callDecommissionRPC failed, err: %v\n", err)
+		return
 	}
 
-	return fileList, nil
+	last := ""
+	for {
+		line := fmt.Sprintf("%s: %s, %d of %d copies made, %d failed", status.Node, status.State, status.Copied, status.Copies, status.Failed)
+		if line != last {
+			fmt.Println(line)
+			last = line
+		}
+		if status.State == model.DecommissionDone || status.State == model.DecommissionFailed {
+			break
+		}
+		time.Sleep(time.Second)
+		status, err = c.callDecommissionStatusRPC(client, nodeID)
+		if err != nil {
+			fmt.Printf("decommission: callDecommissionStatusRPC failed, err: %v\n", err)
+			return
+		}
+	}
+
+	if status.Error != "" {
+		fmt.Printf("decommission: %s\n", status.Error)
+	}
+	fmt.Printf("Time for -decommission: %v\n", time.Since(t0))
 }
 
-func (c *Client) putFile(filename string) {
+func (c *Client) fsck(repair bool) {
 	t0 := time.Now()
-	fmt.Println("putFile: ", filename)
 	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
-	fmt.Println("Connection made")
 
-	reply, err := c.callPutFileRPC(client, filename)
+	reply, err := c.callFsckRPC(client, repair)
 	if err != nil {
-		fmt.Printf("Time for -put: %v\n", time.Since(t0))
+		fmt.Printf("fsck: callFsckRPC failed, err: %v\n", err)
 		return
 	}
 
-	log.Printf("%s is on %v\n", filename, reply.ReplicaList)
-	fmt.Printf("Time for -put: %v\n", time.Since(t0))
+	fmt.Printf("Problems: %d\n", len(reply.Problems))
+	for _, problem := range reply.Problems {
+		fmt.Printf("\t%s\n", problem)
+	}
+	if reply.Repaired {
+		fmt.Println("Index repaired")
+	}
+	fmt.Printf("Time for -fsck: %v\n", time.Since(t0))
 }
 
-func (c *Client) putFolder(folder string) {
-	t0 := time.Now()
-
-	fmt.Println("putFolder: ", folder)
-
-	files, err := ioutil.ReadDir("./files/" + folder)
+func (c *Client) stat(filename string, version int) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("dialing:", err)
 	}
 
-	for _, f := range files {
-		filename := f.Name()
-		c.putFile(filename)
-		fmt.Printf("Push %s finished!", filename)
+	stat, err := c.callStatRPC(client, filename, version)
+	if err != nil {
+		fmt.Printf("stat: callStatRPC failed, err: %v\n", err)
+		return
 	}
 
-	fmt.Printf("Time for -put-folder: %v\n", time.Since(t0))
+	fmt.Printf("File: %s\n", stat.Filename)
+	fmt.Printf("Version: %d\n", stat.Version)
+	fmt.Printf("Size: %d bytes\n", stat.Size)
+	fmt.Printf("MD5: %x\n", stat.Hash)
+	fmt.Printf("Shared by: %d versions\n", stat.Refs)
+	fmt.Printf("Tags: %v\n", stat.Tags)
+	fmt.Printf("Created: %v\n", stat.Timestamp)
+	fmt.Printf("Uploader: %s\n", stat.Meta.Uploader)
+	fmt.Printf("Content type: %s\n", stat.Meta.ContentType)
+	fmt.Printf("Attributes:\n")
+	for k, v := range stat.Meta.Attributes {
+		fmt.Printf("\t%s=%s\n", k, v)
+	}
+	fmt.Printf("Replicas: %v\n", stat.Nodes)
+	if stat.Coding.Data > 0 {
+		fmt.Printf("Coding: %d data + %d parity shards\n", stat.Coding.Data, stat.Coding.Parity)
+		fmt.Printf("Shards: %v\n", stat.Shards)
+	}
+	for k, block := range stat.Blocks {
+		fmt.Printf("Block %d: %d bytes on %v\n", k, block.Size, block.Nodes)
+	}
 }
 
-func (c *Client) getFile(filename string) {
-	fmt.Println("getFile: ", filename)
+func (c *Client) moveFile(src string, dst string) {
 	t0 := time.Now()
 	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
-	fmt.Println("Connection made")
-	reply, err := c.callGetFileRPC(client, filename)
-	if err != nil {
-		return
-	}
-	fmt.Printf("GETFILE: replicalist %v\n", reply.ReplicaList)
 
-	fmt.Printf("Files with %s: %v \n", filename, reply.ReplicaList)
-
-	if len(reply.ReplicaList) == 0 {
-		log.Println("File not available")
-		fmt.Printf("Time for -get: %v\n", time.Since(t0))
+	to, err := c.callMoveFileRPC(client, src, dst)
+	if err != nil {
+		fmt.Printf("moveFile: callMoveFileRPC failed, err: %v\n", err)
 		return
 	}
-
-	log.Printf("Nodes with FileName: %v \n", reply.ReplicaList)
-
-	for _, id := range reply.ReplicaList {
-		cl, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(id), c.config.Port))
-		if err != nil {
-			log.Fatal("dialing:", err)
-		}
-		// TODO: Could possible use a goroutine
-		file, err := c.callPullFileRPC(cl, reply.Filename)
-		if err != nil {
-			return
-		}
-		// TODO: could possible save in cache
-		fmt.Printf("Saved in files folder:\n%s\n", file.FileContent)
-		c.writeFile("./fetched_files/"+filename, file.FileContent)
-		fmt.Printf("Time for -get: %v\n", time.Since(t0))
-		break
-	}
-	fmt.Printf("Time for -get: %v\n", time.Since(t0))
+	fmt.Printf("Moved %s to %s\n", src, to)
+	fmt.Printf("Time for -mv: %v\n", time.Since(t0))
 }
 
-func (c *Client) getFileFromNode(filename string, nodeID string) []byte {
-	cl, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(nodeID), c.config.Port))
+func (c *Client) mkdir(dir string) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
-	file, err := c.callPullFileRPC(cl, filename)
+
+	err = c.callMkdirRPC(client, dir)
 	if err != nil {
-		return nil
+		fmt.Printf("mkdir: callMkdirRPC failed, err: %v\n", err)
+		return
 	}
-	return file.FileContent
+	fmt.Printf("Made directory %s\n", dir)
 }
 
-func (c *Client) deleteFile(filename string) {
-	t0 := time.Now()
-	fmt.Println("deleteFile: ", filename)
+func (c *Client) rmdir(dir string) {
 	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
-	reply, err := c.callRemoveFileRPC(client, filename)
+
+	err = c.callRmdirRPC(client, dir)
 	if err != nil {
+		fmt.Printf("rmdir: callRmdirRPC failed, err: %v\n", err)
 		return
 	}
+	fmt.Printf("Removed directory %s\n", dir)
+}
 
-	fmt.Printf("deleteFile: Files with %s: %v \n", filename, reply)
+func (c *Client) listDir(dir string, recursive bool) {
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
 
-	if len(reply) == 0 {
-		log.Println("File not available")
+	entries, err := c.callListDirRPC(client, dir, recursive)
+	if err != nil {
+		fmt.Printf("listDir: callListDirRPC failed, err: %v\n", err)
 		return
 	}
 
-	log.Printf("Nodes with FileName: %v \n", reply)
-
-	for _, id := range reply {
-		cl, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.getIPFromID(id), c.config.Port))
-		if err != nil {
-			log.Fatal("dialing:", err)
-		}
-		// TODO: Could possible use a goroutine
-		del, err := c.callDeleteFileStarRPC(cl, filename)
-		if err != nil {
-			return
-		}
-		if del {
-			fmt.Printf("Deleted: %s\n", filename)
+	for _, entry := range entries {
+		if entry.IsDir {
+			fmt.Printf("\t%s/\n", entry.Name)
 		} else {
-			fmt.Printf("Failed to delete: %s\n", filename)
+			fmt.Printf("\t%s\tversion %d\t%d bytes\n", entry.Name, entry.Version, entry.Size)
 		}
 	}
-	fmt.Printf("Time for -del: %v\n", time.Since(t0))
 }
 
-func (c *Client) getVersionForFile(filename string, numVersions int, outFileName string) {
-
-	table := make(map[string]int)
-	fmt.Printf("filename: %s, versions: %d\n\n", filename, numVersions)
+func (c *Client) listAll(pattern string, pageSize int) {
 	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", c.config.IP, c.config.Port))
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
-	reply, err := c.callGetVersionsRPC(client, filename, numVersions)
-	if err != nil {
-		return
-	}
-
-	fmt.Printf("version information: %v \n\n", reply)
-
-	if len(reply) == 0 {
-		log.Println("File not available")
-		return
-	}
 
-	outContent := make([]byte, 0)
-
-	// TODO: Could possible use a goroutine
-	for _, version := range reply {
-		for _, nID := range version.ReplicaList {
-			_, ok := table[version.Filename]
-			if ok {
-				continue
-			}
-			table[version.Filename] = 1
-			content := c.getFileFromNode(version.Filename, nID)
-			fmt.Printf("Fetched %s version%d: \n----------------File begining--------------\n%s\n......\n%s\n------------------End File-----------------\n\n", filename, version.Version, content[:100], content[len(content)-100:])
-			outContent = append(outContent, []byte(fmt.Sprintf("Version: %d: \n", version.Version))...)
-			outContent = append(outContent, []byte("----------------File begining--------------\n\n")...)
-			outContent = append(outContent, content...)
-			outContent = append(outContent, []byte("\n------------------End File-----------------\n\n")...)
+	total := 0
+	after := ""
+	for {
+		reply, err := c.callListAllRPC(client, pattern, after, pageSize)
+		if err != nil {
+			fmt.Printf("listAll: callListAllRPC failed, err: %v\n", err)
+			return
+		}
+		for _, file := range reply.Files {
+			fmt.Printf("\t%s\tversion %d\t%d bytes\t%d replicas\n", file.Filename, file.Version, file.Size, file.Replicas)
 		}
+		total += len(reply.Files)
+		if reply.Next == "" {
+			break
+		}
+		after = reply.Next
 	}
-
-	c.writeFile("./fetched_files/"+outFileName, outContent)
+	fmt.Printf("%d files\n", total)
 }
 
 func (c *Client) lsReplicasOfFile(filename string) {
@@ -442,52 +1643,232 @@ func main() {
 	c := &Client{}
 	c.loadConfigFromJSON(configFile)
 
-	getFilename := flag.String("get", "", "get {filename}")
+	getFilename := flag.String("get", "", "get {filename} [--as-of {time}] | get {filename}@{tag}")
+	asOf := flag.String("as-of", "", "as-of {time}, -get the version which was the latest at time, as 2026-10-01T12:00Z")
+	since := flag.String("since", "", "since {time}, -get-versions only of versions committed at or after time")
+	until := flag.String("until", "", "until {time}, -get-versions only of versions committed at or before time")
 	putFilename := flag.String("put", "", "put {filename}")
 	putFolder := flag.String("put-folder", "", "put-folder {folder}")
-	deleteFilename := flag.String("del", "", "del {filename}")
+	replicas := flag.Int("replicas", 0, "replicas {num}, num of replicas for -put and -put-folder")
+	contentType := flag.String("content-type", "", "content-type {type} for -put and -put-folder, guessed if not set")
+	attrs := attrFlag{}
+	flag.Var(attrs, "attr", "attr {key=value}, user attribute for -put and -put-folder, can be repeated")
+	stat := flag.String("stat", "", "stat {sdfsfilename} [version]")
+	deleteFilename := flag.String("del", "", "del {filename}, moves it to the trash")
+	trash := flag.String("trash", "", "trash ls")
+	undelete := flag.String("undelete", "", "undelete {filename}")
+	tag := flag.String("tag", "", "tag {sdfsfilename} {version|latest} {tag}")
+	untag := flag.String("untag", "", "untag {sdfsfilename} {tag}")
+	tags := flag.String("tags", "", "tags {sdfsfilename}")
+	snapshot := flag.String("snapshot", "", "snapshot create {name} | ls | diff {from} [to] | restore {name} [file] | delete {name}")
+	quota := flag.String("quota", "", "quota ls | set {identity|*} {prefix|/} {max-bytes} {max-files} | clear {identity|*} {prefix|/}, 0 is no limit")
+	coding := flag.String("coding", "", "coding ls | set {file|dir} {data} {parity} | clear {file|dir}, erasure-code new versions instead of replicating them")
 	ls := flag.String("ls", "", "ls {filename}")
+	lsDir := flag.String("ls-dir", "", "ls-dir {dir} [--r]")
+	recursive := flag.Bool("r", false, "r, list subdirectories of -ls-dir too")
+	listAll := flag.Bool("list-all", false, "list-all [--page-size {num}] [glob|prefix]")
+	pageSize := flag.Int("page-size", 0, "page-size {num}, num of files fetched per call of -list-all")
+	mv := flag.String("mv", "", "mv {src} {dst}")
+	mkdir := flag.String("mkdir", "", "mkdir {dir}")
+	rmdir := flag.String("rmdir", "", "rmdir {dir}")
 	stores := flag.String("stores", "", "stores {nodeID}")
+	decommission := flag.String("decommission", "", "decommission {nodeID}, copy its replicas to other nodes, then make it leave the group")
 	memList := flag.String("memList", "", "memList")
 	index := flag.String("index", "", "index")
 	rpcs := flag.String("rpcs", "", "rpcs")
-	getVersions := flag.String("get-versions", "", "getVersions {sdfsfilename} {num-versions} {localfilenam}")
+	diffFile := flag.String("diff", "", "diff {sdfsfilename} {version|latest} {version|latest}")
+	getVersions := flag.String("get-versions", "", "getVersions {sdfsfilename} [--since {time}] [--until {time}] {num-versions} {localfilenam}")
+	setReplication := flag.String("set-replication", "", "set-replication {sdfsfilename} {num-replicas}")
+	fsck := flag.Bool("fsck", false, "fsck [--repair]")
+	repair := flag.Bool("repair", false, "repair, fix the problems -fsck finds")
+	rebalance := flag.Bool("rebalance", false, "rebalance [--dry-run]")
+	dryRun := flag.Bool("dry-run", false, "dry-run, only print the planned moves of -rebalance")
+	setRetention := flag.String("set-retention", "", "set-retention {sdfsfilename} {keep-versions} {max-age-seconds} | set-retention {sdfsfilename} default")
 	// numVersions := flag.Int("numVersions", 0, "numVersion {number}")
 
 	flag.Parse()
 
 	if *getFilename != "" {
-		c.getFile(*getFilename)
+		t, err := parseTime(*asOf)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		c.getFile(*getFilename, t)
 	} else if *putFilename != "" {
-		c.putFile(*putFilename)
+		c.putFile(*putFilename, *putFilename, *replicas, model.FileMeta{ContentType: *contentType, Attributes: attrs})
 	} else if *putFolder != "" {
-		c.putFolder(*putFolder)
+		c.putFolder(*putFolder, *replicas, model.FileMeta{ContentType: *contentType, Attributes: attrs})
+	} else if *stat != "" {
+		version := -1
+		if args := flag.Args(); len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Printf("version should be a number!")
+				return
+			}
+			version = v
+		}
+		c.stat(*stat, version)
 	} else if *ls != "" {
 		c.lsReplicasOfFile(*ls)
+	} else if *lsDir != "" {
+		c.listDir(*lsDir, *recursive)
+	} else if *listAll {
+		pattern := ""
+		if args := flag.Args(); len(args) > 0 {
+			pattern = args[0]
+		}
+		c.listAll(pattern, *pageSize)
+	} else if *mv != "" {
+		args := os.Args[2:]
+		if len(args) < 2 {
+			fmt.Println("not enough args: mv {src} {dst}")
+		} else {
+			c.moveFile(args[0], args[1])
+		}
+	} else if *mkdir != "" {
+		c.mkdir(*mkdir)
+	} else if *rmdir != "" {
+		c.rmdir(*rmdir)
 	} else if *stores != "" {
 		c.storesOnNode(*stores)
+	} else if *decommission != "" {
+		c.decommission(*decommission)
 	} else if *deleteFilename != "" {
 		c.deleteFile(*deleteFilename)
+	} else if *trash != "" {
+		if *trash != "ls" {
+			fmt.Println("unknown trash command: trash ls")
+			return
+		}
+		c.trashLs()
+	} else if *undelete != "" {
+		c.undelete(*undelete)
+	} else if *quota != "" {
+		c.quota(*quota, flag.Args())
+	} else if *coding != "" {
+		c.coding(*coding, flag.Args())
+	} else if *snapshot != "" {
+		c.snapshot(*snapshot, flag.Args())
+	} else if *tag != "" {
+		args := flag.Args()
+		if len(args) < 2 {
+			fmt.Println("not enough args: tag {sdfsfilename} {version|latest} {tag}")
+			return
+		}
+		version := -1
+		if args[0] != "latest" {
+			v, err := strconv.Atoi(args[0])
+			if err != nil {
+				fmt.Printf("version should be a number or latest!")
+				return
+			}
+			version = v
+		}
+		c.tag(*tag, version, args[1])
+	} else if *untag != "" {
+		args := flag.Args()
+		if len(args) < 1 {
+			fmt.Println("not enough args: untag {sdfsfilename} {tag}")
+			return
+		}
+		c.untag(*untag, args[0])
+	} else if *tags != "" {
+		c.tags(*tags)
 	} else if *memList != "" {
 		c.memList()
 	} else if *index != "" {
 		c.index()
 	} else if *rpcs != "" {
 		c.rpcs()
+	} else if *diffFile != "" {
+		args := flag.Args()
+		if len(args) < 2 {
+			fmt.Println("not enough args: diff {sdfsfilename} {version|latest} {version|latest}")
+			return
+		}
+		versions := []int{-1, -1}
+		for k := range versions {
+			if args[k] == "latest" {
+				continue
+			}
+			v, err := strconv.Atoi(args[k])
+			if err != nil {
+				fmt.Printf("version should be a number or latest!")
+				return
+			}
+			versions[k] = v
+		}
+		c.diffVersions(*diffFile, versions[0], versions[1])
 	} else if *getVersions != "" {
-		args := os.Args[2:]
-		if len(args) < 3 {
-			fmt.Println("not enough args: getVersions {sdfsfilename} {num-versions} {localfilenam}")
+		args := flag.Args()
+		if len(args) < 2 {
+			fmt.Println("not enough args: getVersions {sdfsfilename} [--since {time}] [--until {time}] {num-versions} {localfilenam}")
 		} else {
 			t0 := time.Now()
-			versions, err := strconv.Atoi(args[1])
+			versions, err := strconv.Atoi(args[0])
 			if err != nil {
 				fmt.Printf("num-versions should be a number!")
 			}
-			//fmt.Printf("getVersions {%s} {%d} {%v}", args[0], versions, args[2])
-			c.getVersionForFile(args[0], versions, args[2])
+			from, err := parseTime(*since)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			to, err := parseTime(*until)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			//fmt.Printf("getVersions {%s} {%d} {%v}", *getVersions, versions, args[1])
+			c.getVersionForFile(*getVersions, versions, args[1], from, to)
 			fmt.Printf("Time for -get-versions with numVersions %d : %v\n", versions, time.Since(t0))
 		}
+	} else if *setReplication != "" {
+		args := os.Args[2:]
+		if len(args) < 2 {
+			fmt.Println("not enough args: set-replication {sdfsfilename} {num-replicas}")
+		} else {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Printf("num-replicas should be a number!")
+				return
+			}
+			c.setReplication(args[0], n)
+		}
+	} else if *fsck {
+		c.fsck(*repair)
+	} else if *rebalance {
+		c.rebalance(*dryRun)
+	} else if *setRetention != "" {
+		args := os.Args[2:]
+		if len(args) == 2 && args[1] == "default" {
+			c.setRetention(model.RPCSetRetentionArgs{
+				Filename: args[0],
+				Clear:    true,
+			})
+		} else if len(args) < 3 {
+			fmt.Println("not enough args: set-retention {sdfsfilename} {keep-versions} {max-age-seconds} | set-retention {sdfsfilename} default")
+		} else {
+			keep, err := strconv.Atoi(args[1])
+			if err != nil {
+				fmt.Printf("keep-versions should be a number!")
+				return
+			}
+			maxAge, err := strconv.Atoi(args[2])
+			if err != nil {
+				fmt.Printf("max-age-seconds should be a number!")
+				return
+			}
+			c.setRetention(model.RPCSetRetentionArgs{
+				Filename: args[0],
+				Policy: model.RetentionPolicy{
+					KeepVersions: keep,
+					MaxAge:       maxAge,
+				},
+			})
+		}
 	}
 
 }
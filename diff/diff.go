@@ -0,0 +1,299 @@
+// Package diff compare two versions of a file, as a unified diff of lines or as the byte ranges which differ
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"CS425/CS425-MP3/model"
+)
+
+const (
+	// lines of context around a change in a unified diff
+	contextLines = 3
+	// past this num of changed lines the changed region is given as one hunk
+	maxEdits = 2000
+	// equal runs of bytes shorter than this do not split a changed byte range
+	minEqualRun = 8
+)
+
+// op kind of a line in an edit script
+type op byte
+
+const (
+	opEqual  op = ' '
+	opDelete op = '-'
+	opInsert op = '+'
+)
+
+// edit one line of an edit script, a and b are its line numbers from 0 in the old and the new text
+type edit struct {
+	op   op
+	a, b int
+}
+
+// IsBinary whether content should be compared by bytes rather than lines
+func IsBinary(content []byte) bool {
+	return bytes.IndexByte(content, 0) != -1 || !utf8.Valid(content)
+}
+
+// splitLines lines of content, each with its "\n" except maybe the last
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Unified unified diff from content a named fromName to content b named toName, "" if they are equal
+func Unified(fromName, toName string, a, b []byte) string {
+	linesA := splitLines(a)
+	linesB := splitLines(b)
+
+	// compare lines by id, equal lines get the same id
+	ids := make(map[string]int)
+	toIDs := func(lines []string) []int {
+		seq := make([]int, len(lines))
+		for k, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			seq[k] = id
+		}
+		return seq
+	}
+	edits := editScript(toIDs(linesA), toIDs(linesB))
+
+	var out strings.Builder
+	for _, hunk := range hunks(edits) {
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		writeHunk(&out, hunk, linesA, linesB)
+	}
+	return out.String()
+}
+
+// editScript edits turning a into b, by the greedy algorithm of Myers on what is left after the common
+// prefix and suffix. Past maxEdits changes the rest is given as deleted and inserted.
+func editScript(a, b []int) []edit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := []edit{}
+	for k := 0; k < prefix; k++ {
+		edits = append(edits, edit{op: opEqual, a: k, b: k})
+	}
+	for _, e := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		e.a += prefix
+		e.b += prefix
+		edits = append(edits, e)
+	}
+	for k := suffix; k > 0; k-- {
+		edits = append(edits, edit{op: opEqual, a: len(a) - k, b: len(b) - k})
+	}
+	return edits
+}
+
+// myers shortest edit script turning a into b
+func myers(a, b []int) []edit {
+	n, m := len(a), len(b)
+	// trace[d][k+d] furthest x on diagonal k = x-y with d changes
+	trace := [][]int{}
+	found := false
+	for d := 0; d <= n+m && d <= maxEdits && !found; d++ {
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if d > 0 {
+				prev := trace[d-1]
+				if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+					x = prev[k+1+d-1]
+				} else {
+					x = prev[k-1+d-1] + 1
+				}
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+d] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, v)
+	}
+
+	edits := []edit{}
+	if !found {
+		for x := 0; x < n; x++ {
+			edits = append(edits, edit{op: opDelete, a: x, b: 0})
+		}
+		for y := 0; y < m; y++ {
+			edits = append(edits, edit{op: opInsert, a: n, b: y})
+		}
+		return edits
+	}
+
+	// walk back from (n, m), edits come out last first
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		prevX, prevY := 0, 0
+		if d > 0 {
+			prev := trace[d-1]
+			prevK := k - 1
+			if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+				prevK = k + 1
+			}
+			prevX = prev[prevK+d-1]
+			prevY = prevX - prevK
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{op: opEqual, a: x, b: y})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, edit{op: opInsert, a: x, b: y})
+		} else {
+			x--
+			edits = append(edits, edit{op: opDelete, a: x, b: y})
+		}
+	}
+	for l, r := 0, len(edits)-1; l < r; l, r = l+1, r-1 {
+		edits[l], edits[r] = edits[r], edits[l]
+	}
+	return edits
+}
+
+// hunks group the changes of edits with contextLines of equal lines around them
+func hunks(edits []edit) [][]edit {
+	groups := [][]edit{}
+	start, end := -1, -1
+	for k, e := range edits {
+		if e.op == opEqual {
+			continue
+		}
+		if start != -1 && k-contextLines > end {
+			groups = append(groups, edits[start:end])
+			start = -1
+		}
+		if start == -1 {
+			start = k - contextLines
+			if start < 0 {
+				start = 0
+			}
+		}
+		end = k + 1 + contextLines
+		if end > len(edits) {
+			end = len(edits)
+		}
+	}
+	if start != -1 {
+		groups = append(groups, edits[start:end])
+	}
+	return groups
+}
+
+func writeHunk(out *strings.Builder, hunk []edit, linesA, linesB []string) {
+	countA, countB := 0, 0
+	for _, e := range hunk {
+		if e.op != opInsert {
+			countA++
+		}
+		if e.op != opDelete {
+			countB++
+		}
+	}
+	// an empty side starts at the line before the hunk
+	startA, startB := hunk[0].a+1, hunk[0].b+1
+	if countA == 0 {
+		startA--
+	}
+	if countB == 0 {
+		startB--
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", startA, countA, startB, countB)
+
+	for _, e := range hunk {
+		var line string
+		if e.op == opInsert {
+			line = linesB[e.b]
+		} else {
+			line = linesA[e.a]
+		}
+		out.WriteByte(byte(e.op))
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// ByteRanges ranges of b which differ from a at the same offset, at most limit of them, and the num of
+// ranges in all. Bytes past the end of the shorter content are one changed range.
+func ByteRanges(a, b []byte, limit int) ([]model.ByteRange, int) {
+	all := []model.ByteRange{}
+	common := len(a)
+	if len(b) < common {
+		common = len(b)
+	}
+
+	start, equal := -1, 0
+	for k := 0; k < common; k++ {
+		if a[k] != b[k] {
+			if start == -1 {
+				start = k
+			}
+			equal = 0
+			continue
+		}
+		if start == -1 {
+			continue
+		}
+		equal++
+		if equal >= minEqualRun {
+			all = append(all, model.ByteRange{Offset: int64(start), Length: int64(k + 1 - equal - start)})
+			start = -1
+		}
+	}
+	if start != -1 {
+		all = append(all, model.ByteRange{Offset: int64(start), Length: int64(common - equal - start)})
+	}
+
+	if len(a) != len(b) {
+		longer := len(a)
+		if len(b) > longer {
+			longer = len(b)
+		}
+		if n := len(all); n > 0 && all[n-1].Offset+all[n-1].Length+minEqualRun > int64(common) {
+			all[n-1].Length = int64(longer) - all[n-1].Offset
+		} else {
+			all = append(all, model.ByteRange{Offset: int64(common), Length: int64(longer - common)})
+		}
+	}
+
+	if len(all) > limit {
+		return all[:limit], len(all)
+	}
+	return all, len(all)
+}
@@ -0,0 +1,236 @@
+// Package erasure split content into data and parity shards by Reed-Solomon coding, any data of which
+// rebuild the content
+package erasure
+
+import (
+	"fmt"
+)
+
+// MaxShards max num of data and parity shards, one per element of GF(2^8)
+const MaxShards = 256
+
+// exp and log tables of GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1, exp is doubled so that
+// the sum of two logs needs no modulo
+var (
+	expTable [510]byte
+	logTable [256]int
+)
+
+func init() {
+	x := 1
+	for k := 0; k < 255; k++ {
+		expTable[k] = byte(x)
+		expTable[k+255] = byte(x)
+		logTable[x] = k
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[logTable[a]+logTable[b]]
+}
+
+func inv(a byte) byte {
+	return expTable[255-logTable[a]]
+}
+
+// Check error if data and parity shards are not a valid coding
+func Check(data, parity int) error {
+	if data < 1 || parity < 1 {
+		return fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, got %d+%d", data, parity)
+	}
+	if data+parity > MaxShards {
+		return fmt.Errorf("erasure coding has at most %d shards, got %d+%d", MaxShards, data, parity)
+	}
+	return nil
+}
+
+// ShardSize bytes in each shard of size bytes of content split into data shards
+func ShardSize(size int64, data int) int64 {
+	return (size + int64(data) - 1) / int64(data)
+}
+
+// row coefficients of shard k over the data shards. Data shards are stored as they are, parity shard
+// data+r is row r of the Cauchy matrix 1/(x_r+y_c) with x_r = data+r and y_c = c, so that any data
+// rows are independent.
+func row(k, data int) []byte {
+	coefs := make([]byte, data)
+	if k < data {
+		coefs[k] = 1
+		return coefs
+	}
+	for c := 0; c < data; c++ {
+		coefs[c] = inv(byte(k) ^ byte(c))
+	}
+	return coefs
+}
+
+// combine sum of coefs[c] times shards[c], byte by byte
+func combine(coefs []byte, shards [][]byte, size int64) []byte {
+	out := make([]byte, size)
+	for c, coef := range coefs {
+		if coef == 0 {
+			continue
+		}
+		for b, v := range shards[c] {
+			out[b] ^= mul(coef, v)
+		}
+	}
+	return out
+}
+
+// Encode split content into data shards, zero padded to the same size, followed by parity shards
+func Encode(content []byte, data, parity int) ([][]byte, error) {
+	err := Check(data, parity)
+	if err != nil {
+		return nil, err
+	}
+
+	size := ShardSize(int64(len(content)), data)
+	shards := make([][]byte, data+parity)
+	for k := 0; k < data; k++ {
+		shards[k] = make([]byte, size)
+		start := int64(k) * size
+		if start < int64(len(content)) {
+			copy(shards[k], content[start:])
+		}
+	}
+	for k := data; k < data+parity; k++ {
+		shards[k] = combine(row(k, data), shards[:data], size)
+	}
+	return shards, nil
+}
+
+// Reconstruct fill in the nil shards from any data of the others, which should all have the same size
+func Reconstruct(shards [][]byte, data, parity int) error {
+	err := Check(data, parity)
+	if err != nil {
+		return err
+	}
+	if len(shards) != data+parity {
+		return fmt.Errorf("expected %d shards, got %d", data+parity, len(shards))
+	}
+
+	present := []int{}
+	size := int64(-1)
+	for k, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size == -1 {
+			size = int64(len(shard))
+		} else if int64(len(shard)) != size {
+			return fmt.Errorf("shard %d has %d bytes, expected %d", k, len(shard), size)
+		}
+		present = append(present, k)
+	}
+	if len(present) < data {
+		return fmt.Errorf("%d of %d shards left, %d needed", len(present), data+parity, data)
+	}
+	if len(present) == data+parity {
+		return nil
+	}
+
+	// the rows of data present shards form a matrix taking the data shards to them, its inverse
+	// takes them back
+	present = present[:data]
+	matrix := make([][]byte, data)
+	sources := make([][]byte, data)
+	for r, k := range present {
+		matrix[r] = row(k, data)
+		sources[r] = shards[k]
+	}
+	inverse, err := invert(matrix)
+	if err != nil {
+		return err
+	}
+
+	dataShards := make([][]byte, data)
+	for k := 0; k < data; k++ {
+		if shards[k] != nil {
+			dataShards[k] = shards[k]
+			continue
+		}
+		dataShards[k] = combine(inverse[k], sources, size)
+	}
+	for k := range shards {
+		if shards[k] != nil {
+			continue
+		}
+		if k < data {
+			shards[k] = dataShards[k]
+		} else {
+			shards[k] = combine(row(k, data), dataShards, size)
+		}
+	}
+	return nil
+}
+
+// invert inverse of a square matrix over GF(2^8) by Gauss-Jordan elimination
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	// work on [matrix | identity]
+	work := make([][]byte, n)
+	for r := range matrix {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, fmt.Errorf("singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := inv(work[c][c])
+		for k := range work[c] {
+			work[c][k] = mul(work[c][k], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for k := range work[r] {
+				work[r][k] ^= mul(factor, work[c][k])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
+
+// Join content of size bytes from shards, reconstructing missing data shards from the parity ones
+func Join(shards [][]byte, data, parity int, size int64) ([]byte, error) {
+	err := Reconstruct(shards, data, parity)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, size)
+	for k := 0; k < data && int64(len(content)) < size; k++ {
+		content = append(content, shards[k]...)
+	}
+	if int64(len(content)) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(content), size)
+	}
+	return content[:size], nil
+}
@@ -0,0 +1,224 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// BlockSize versions larger than this are split into blocks of this many bytes
+const BlockSize int64 = 64 << 20
+
+// VersionName name on disk of the replica fs, "filename_version" or "filename_version.block" for a
+// block of a version split into blocks
+func VersionName(fs model.FileStructure) string {
+	if fs.Blocks > 0 {
+		return fmt.Sprintf("%s_%d.%d", fs.Filename, fs.Version, fs.Block)
+	}
+	return fmt.Sprintf("%s_%d", fs.Filename, fs.Version)
+}
+
+// parseBlockName split a block file name "filename_version.block" on disk
+func parseBlockName(name string) (string, int, int, bool) {
+	ind := strings.LastIndex(name, ".")
+	if ind <= 0 {
+		return "", 0, 0, false
+	}
+	block, err := strconv.Atoi(name[ind+1:])
+	if err != nil || block < 0 {
+		return "", 0, 0, false
+	}
+	filename, version, ok := ParseVersionName(name[:ind])
+	return filename, version, block, ok
+}
+
+// isSplit whether fv is stored as blocks rather than whole replicas
+func isSplit(fv model.FileVersion) bool {
+	return len(fv.Blocks) > 0
+}
+
+// splitSizes sizes of the blocks of size bytes split into blocks of BlockSize
+func splitSizes(size int64) []int64 {
+	sizes := []int64{}
+	for offset := int64(0); offset < size; offset += BlockSize {
+		block := BlockSize
+		if size-offset < block {
+			block = size - offset
+		}
+		sizes = append(sizes, block)
+	}
+	return sizes
+}
+
+// blockFile replica of block of version fv of filename
+func blockFile(filename string, fv model.FileVersion, block int) model.FileStructure {
+	return model.FileStructure{
+		Version:   fv.Version,
+		Filename:  filename,
+		Hash:      fv.Hash,
+		Size:      fv.Blocks[block].Size,
+		Timestamp: fv.Timestamp,
+		Blocks:    len(fv.Blocks),
+		Block:     block,
+	}
+}
+
+// copyBlocks copy of blocks which shares no node list with it
+func copyBlocks(blocks []model.Block) []model.Block {
+	if blocks == nil {
+		return nil
+	}
+	copied := make([]model.Block, len(blocks))
+	for k, block := range blocks {
+		copied[k] = model.Block{Size: block.Size, Nodes: append([]string{}, block.Nodes...)}
+	}
+	return copied
+}
+
+// blockNodes every node holding a block of blocks, in the order they first appear
+func blockNodes(blocks []model.Block) []string {
+	nodes := []string{}
+	seen := make(map[string]bool)
+	for _, block := range blocks {
+		for _, id := range block.Nodes {
+			if !seen[id] {
+				seen[id] = true
+				nodes = append(nodes, id)
+			}
+		}
+	}
+	return nodes
+}
+
+// holdsBlock whether node id holds any block of fv
+func holdsBlock(fv model.FileVersion, id string) bool {
+	for _, block := range fv.Blocks {
+		for _, node := range block.Nodes {
+			if node == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropBlock record that node id lost its replica of block of fv, it leaves Nodes with its last block
+func (i *Index) dropBlock(fv *model.FileVersion, block int, id string) {
+	if block < 0 || block >= len(fv.Blocks) {
+		return
+	}
+	fv.Blocks[block].Nodes = i.without(fv.Blocks[block].Nodes, id)
+	if !holdsBlock(*fv, id) {
+		fv.Nodes = i.without(fv.Nodes, id)
+	}
+}
+
+// dropBlockNode record that node id lost every block of fv
+func (i *Index) dropBlockNode(fv *model.FileVersion, id string) {
+	for k := range fv.Blocks {
+		fv.Blocks[k].Nodes = i.without(fv.Blocks[k].Nodes, id)
+	}
+}
+
+// renameBlockNode record that the blocks of fv on oldID are on newID
+func (i *Index) renameBlockNode(fv *model.FileVersion, oldID, newID string) {
+	for _, block := range fv.Blocks {
+		if ind := i.findIndex(block.Nodes, oldID); ind != -1 {
+			block.Nodes[ind] = newID
+		}
+	}
+}
+
+// versionReplicas one replica of version fv of filename per node holding it, or per block and node
+// if it is split
+func versionReplicas(filename string, fv model.FileVersion) []model.Replica {
+	replicas := []model.Replica{}
+	if !isSplit(fv) {
+		for _, id := range fv.Nodes {
+			replicas = append(replicas, model.Replica{
+				Node: id,
+				File: model.FileStructure{
+					Version:   fv.Version,
+					Filename:  filename,
+					Hash:      fv.Hash,
+					Size:      fv.Size,
+					Timestamp: fv.Timestamp,
+				},
+			})
+		}
+		return replicas
+	}
+	for k, block := range fv.Blocks {
+		for _, id := range block.Nodes {
+			replicas = append(replicas, model.Replica{
+				Node: id,
+				File: blockFile(filename, fv, k),
+			})
+		}
+	}
+	return replicas
+}
+
+// addBlocks add a new version of filename split into blocks, each on replicas nodes. Return its version
+// and every node holding a block, the version is -1 if a block fits on no node.
+func (i *Index) addBlocks(filename string, hash [SIZE]byte, size int64, replicas int, meta model.FileMeta) (int, []string) {
+	// bytes planned per node, so that the blocks spread over the nodes
+	planned := make(map[string]int64)
+	blocks := []model.Block{}
+	for _, blockSize := range splitSizes(size) {
+		nodes := i.getNodesWithLeastBytes()
+		sort.SliceStable(nodes, func(a, b int) bool {
+			return i.numBytes[nodes[a]]+planned[nodes[a]] < i.numBytes[nodes[b]]+planned[nodes[b]]
+		})
+		picked := i.placeReplicas(nil, nodes, replicas, blockSize)
+		if len(picked) == 0 {
+			return -1, nil
+		}
+		for _, id := range picked {
+			planned[id] += blockSize
+		}
+		blocks = append(blocks, model.Block{Size: blockSize, Nodes: picked})
+	}
+
+	fs := model.FileStructure{
+		Version:   i.nextVersion(filename),
+		Filename:  filename,
+		Hash:      hash,
+		Size:      size,
+		Timestamp: time.Now(),
+	}
+	i.commit(model.IndexEntry{
+		Op:     model.OpAddFile,
+		File:   fs,
+		Meta:   &meta,
+		Blocks: blocks,
+	})
+	return fs.Version, blockNodes(blocks)
+}
+
+// checkBlocks report blocks of the split version fv which are lost or not on its nodes, and whether
+// their sizes do not add up to the version
+func (i *Index) checkBlocks(fv model.FileVersion, fs model.FileStructure, report func(format string, a ...interface{})) {
+	var size int64
+	for k, block := range fv.Blocks {
+		size += block.Size
+		if k < len(fv.Blocks)-1 && block.Size != fv.Blocks[0].Size {
+			report("%s_%d: block %d has %d bytes, the first has %d", fs.Filename, fv.Version, k, block.Size, fv.Blocks[0].Size)
+		}
+		if len(block.Nodes) == 0 {
+			report("%s_%d: block %d has no replica left", fs.Filename, fv.Version, k)
+		}
+		for _, id := range block.Nodes {
+			if i.findIndex(fv.Nodes, id) == -1 {
+				report("%s_%d: block %d is on %s, which does not hold the version", fs.Filename, fv.Version, k, id)
+			}
+		}
+	}
+	if size != fv.Size {
+		report("%s_%d: blocks hold %d bytes, the version has %d", fs.Filename, fv.Version, size, fv.Size)
+	}
+}
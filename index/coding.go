@@ -0,0 +1,201 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"CS425/CS425-MP3/erasure"
+	"CS425/CS425-MP3/model"
+)
+
+// isCoded whether fv is stored as erasure-coded shards rather than full replicas
+func isCoded(fv model.FileVersion) bool {
+	return fv.Coding.Data > 0
+}
+
+// storedSize bytes of fv each of its nodes stores
+func storedSize(fv model.FileVersion) int64 {
+	if !isCoded(fv) {
+		return fv.Size
+	}
+	return erasure.ShardSize(fv.Size, fv.Coding.Data)
+}
+
+// shardsLeft num of shards of fv which are still on a node
+func shardsLeft(fv model.FileVersion) int {
+	left := 0
+	for _, id := range fv.Shards {
+		if id != "" {
+			left++
+		}
+	}
+	return left
+}
+
+// shardOf shard of fv node id holds, -1 if none
+func shardOf(fv model.FileVersion, id string) int {
+	for k, node := range fv.Shards {
+		if node == id {
+			return k
+		}
+	}
+	return -1
+}
+
+// dropShard record that node id lost its shard of fv
+func dropShard(fv *model.FileVersion, id string) {
+	for k, node := range fv.Shards {
+		if node == id {
+			fv.Shards[k] = ""
+		}
+	}
+}
+
+// renameShard record that the shard of fv on oldID is on newID
+func renameShard(fv *model.FileVersion, oldID, newID string) {
+	for k, node := range fv.Shards {
+		if node == oldID {
+			fv.Shards[k] = newID
+		}
+	}
+}
+
+// layout nodes, coding and blocks to add fv with, as OpAddFile records them
+func layout(fv model.FileVersion) ([]string, *model.Coding, []model.Block) {
+	if isSplit(fv) {
+		return nil, nil, fv.Blocks
+	}
+	if !isCoded(fv) {
+		return fv.Nodes, nil, nil
+	}
+	coding := fv.Coding
+	return fv.Shards, &coding, nil
+}
+
+// codingFor coding of new versions of filename, set on it or on the closest directory above it
+func (i *Index) codingFor(filename string) model.Coding {
+	name := filename
+	for {
+		if coding, ok := i.index.Coding[name]; ok {
+			return coding
+		}
+		if name == "/" || name == "." {
+			return model.Coding{}
+		}
+		name = parentDir(name)
+	}
+}
+
+// CodingFor coding new versions of filename get, zero for full replicas
+func (i *Index) CodingFor(filename string) model.Coding {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.codingFor(filename)
+}
+
+// SetCoding store new versions of the files at or below name, a file or a directory, with coding.
+// A nil coding removes the setting. Versions already stored keep their layout.
+func (i *Index) SetCoding(name string, coding *model.Coding) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if coding == nil {
+		if _, ok := i.index.Coding[name]; !ok {
+			return fmt.Errorf("no coding set on %s", name)
+		}
+	} else {
+		err := erasure.Check(coding.Data, coding.Parity)
+		if err != nil {
+			return err
+		}
+	}
+
+	i.commit(model.IndexEntry{
+		Op:     model.OpSetCoding,
+		File:   model.FileStructure{Filename: name},
+		Coding: coding,
+	})
+	return nil
+}
+
+// Codings every coding set, by the file or directory it is set on
+func (i *Index) Codings() map[string]model.Coding {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	codings := make(map[string]model.Coding, len(i.index.Coding))
+	for name, coding := range i.index.Coding {
+		codings[name] = coding
+	}
+	return codings
+}
+
+// addShards add a new version of filename as shards of coding, one per node, return its version and
+// the node of each shard. The version is -1 if fewer nodes than shards have room.
+func (i *Index) addShards(filename string, hash [SIZE]byte, size int64, coding model.Coding, meta model.FileMeta) (int, []string) {
+	n := coding.Data + coding.Parity
+	nodes := i.placeReplicas(nil, i.getNodesWithLeastBytes(), n, erasure.ShardSize(size, coding.Data))
+	if len(nodes) < n {
+		return -1, nil
+	}
+
+	fs := model.FileStructure{
+		Version:   i.nextVersion(filename),
+		Filename:  filename,
+		Hash:      hash,
+		Size:      size,
+		Timestamp: time.Now(),
+	}
+	i.commit(model.IndexEntry{
+		Op:     model.OpAddFile,
+		File:   fs,
+		Meta:   &meta,
+		Coding: &coding,
+		Nodes:  nodes,
+	})
+	return fs.Version, nodes
+}
+
+// planShardRebuilds pulls rebuilding each lost shard of fv on a node holding no shard of it. Pulls
+// go to the nodes with the fewest bytes counting planned, which are added to. Nothing if too few
+// shards are left to decode.
+func (i *Index) planShardRebuilds(filename string, fv model.FileVersion, planned map[string]int64) []model.PullInstruction {
+	left := shardsLeft(fv)
+	if left < fv.Coding.Data || left == len(fv.Shards) {
+		return nil
+	}
+
+	fs := model.FileStructure{
+		Version:   fv.Version,
+		Filename:  filename,
+		Hash:      fv.Hash,
+		Size:      storedSize(fv),
+		Timestamp: fv.Timestamp,
+	}
+	nodes := i.getNodesWithLeastBytes()
+	sort.SliceStable(nodes, func(a, b int) bool {
+		return i.numBytes[nodes[a]]+planned[nodes[a]] < i.numBytes[nodes[b]]+planned[nodes[b]]
+	})
+	lost := []int{}
+	for k, id := range fv.Shards {
+		if id == "" {
+			lost = append(lost, k)
+		}
+	}
+
+	pulls := []model.PullInstruction{}
+	for k, node := range i.placeReplicas(fv.Nodes, nodes, len(lost), fs.Size) {
+		planned[node] += fs.Size
+		pulls = append(pulls, model.PullInstruction{
+			Filename: fmt.Sprintf("%s_%d", filename, fv.Version),
+			Node:     node,
+			File:     fs,
+			Shard:    lost[k],
+			Coding:   fv.Coding,
+			Rebuild:  append([]string{}, fv.Shards...),
+		})
+	}
+	return pulls
+}
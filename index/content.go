@@ -0,0 +1,297 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// contentRef a version of a file, one reference to its content
+type contentRef struct {
+	filename string
+	version  int
+}
+
+// buildContents rebuild the references to every content from the versions in the index and in the trash
+func (i *Index) buildContents() {
+	i.contents = make(map[[SIZE]byte]map[contentRef]bool)
+	for filename, versions := range i.index.Fileversions {
+		for _, fv := range versions {
+			i.addContentRef(fv.Hash, filename, fv.Version)
+		}
+	}
+	for filename, tomb := range i.index.Trash {
+		for _, fv := range tomb.Versions {
+			i.addContentRef(fv.Hash, filename, fv.Version)
+		}
+	}
+}
+
+func (i *Index) addContentRef(hash [SIZE]byte, filename string, version int) {
+	if i.contents[hash] == nil {
+		i.contents[hash] = make(map[contentRef]bool)
+	}
+	i.contents[hash][contentRef{filename: filename, version: version}] = true
+}
+
+func (i *Index) dropContentRef(hash [SIZE]byte, filename string, version int) {
+	delete(i.contents[hash], contentRef{filename: filename, version: version})
+	if len(i.contents[hash]) == 0 {
+		delete(i.contents, hash)
+	}
+}
+
+// storedVersion version of filename in the index, or else in the trash
+func (i *Index) storedVersion(filename string, version int) (model.FileVersion, bool) {
+	for _, fv := range i.index.Fileversions[filename] {
+		if fv.Version == version {
+			return fv, true
+		}
+	}
+	for _, fv := range i.index.Trash[filename].Versions {
+		if fv.Version == version {
+			return fv, true
+		}
+	}
+	return model.FileVersion{}, false
+}
+
+// refCount num of versions sharing content hash
+func (i *Index) refCount(hash [SIZE]byte) int {
+	return len(i.contents[hash])
+}
+
+// sortedRefs versions sharing content hash, by filename then version
+func (i *Index) sortedRefs(hash [SIZE]byte) []contentRef {
+	refs := []contentRef{}
+	for ref := range i.contents[hash] {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(a, b int) bool {
+		if refs[a].filename != refs[b].filename {
+			return refs[a].filename < refs[b].filename
+		}
+		return refs[a].version < refs[b].version
+	})
+	return refs
+}
+
+// storedReplicas one replica per node holding content hash, sorted by node. Shards of erasure-coded
+// versions and blocks of split versions do not hold the content.
+func (i *Index) storedReplicas(hash [SIZE]byte) []model.Replica {
+	// map from node to the first replica of the content on it
+	stored := make(map[string]model.Replica)
+	for _, ref := range i.sortedRefs(hash) {
+		fv, ok := i.storedVersion(ref.filename, ref.version)
+		if !ok || isCoded(fv) || isSplit(fv) {
+			continue
+		}
+		for _, id := range fv.Nodes {
+			if _, ok := stored[id]; ok {
+				continue
+			}
+			stored[id] = model.Replica{
+				Node: id,
+				File: model.FileStructure{
+					Version:   fv.Version,
+					Filename:  ref.filename,
+					Hash:      fv.Hash,
+					Size:      fv.Size,
+					Timestamp: fv.Timestamp,
+				},
+			}
+		}
+	}
+
+	replicas := []model.Replica{}
+	for _, replica := range stored {
+		replicas = append(replicas, replica)
+	}
+	sort.Slice(replicas, func(a, b int) bool {
+		return replicas[a].Node < replicas[b].Node
+	})
+	return replicas
+}
+
+// PlanDedup plan a new version of filename whose content hash is already stored. Return the version it
+// would get and the stored replicas to link it from, on at most replicas nodes, none if no node holds
+// the content. If the latest version already has that content it is returned with its own replicas.
+// A new version to be erasure-coded is not linked from full replicas. The index is not changed.
+func (i *Index) PlanDedup(filename string, hash [SIZE]byte, replicas int) (int, []model.Replica) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	n := replicas
+	if n <= 0 {
+		n = i.replication(filename)
+	}
+
+	if fs, ok := i.index.Filename[filename]; ok && fs.Hash == hash {
+		sources := []model.Replica{}
+		for _, id := range i.getLatestFileVersion(filename).Nodes {
+			sources = append(sources, model.Replica{Node: id, File: fs})
+		}
+		return fs.Version, sources
+	}
+	version := i.nextVersion(filename)
+	if i.codingFor(filename).Data > 0 {
+		return version, nil
+	}
+
+	stored := make(map[string]model.Replica)
+	nodes := []string{}
+	for _, replica := range i.storedReplicas(hash) {
+		stored[replica.Node] = replica
+		nodes = append(nodes, replica.Node)
+	}
+	// linking takes no space, only the spread over failure domains matters
+	sources := []model.Replica{}
+	for _, id := range i.placeReplicas(nil, nodes, n, 0) {
+		sources = append(sources, stored[id])
+	}
+	return version, sources
+}
+
+// AddDedupFile add version fs.Version of fs.Filename on nodes, which linked it from a planned stored
+// replica. Nothing changes if it is already the latest version, and it fails if another version was
+// added since it was planned.
+func (i *Index) AddDedupFile(fs model.FileStructure, replicas int, meta model.FileMeta, nodes []string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	err := i.checkFilePath(fs.Filename)
+	if err != nil {
+		return err
+	}
+
+	current, ok := i.index.Filename[fs.Filename]
+	if !ok || current.Version != fs.Version || current.Hash != fs.Hash {
+		if fs.Version != i.nextVersion(fs.Filename) {
+			return fmt.Errorf("%s changed since the put was planned", fs.Filename)
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("no node stores the content of %s", fs.Filename)
+		}
+		err = i.checkQuota(fs.Filename, fs.Hash, fs.Size, meta.Uploader)
+		if err != nil {
+			return err
+		}
+
+		fs.Timestamp = time.Now()
+		i.commit(model.IndexEntry{
+			Op:    model.OpAddFile,
+			File:  fs,
+			Meta:  &meta,
+			Nodes: append([]string{}, nodes...),
+		})
+	}
+
+	if replicas > 0 {
+		i.setReplication(fs.Filename, replicas)
+	}
+	return nil
+}
+
+// readable whether enough of the shards or of the copies of every block of fv are left to read it
+func readable(fv model.FileVersion) bool {
+	if isCoded(fv) {
+		return shardsLeft(fv) >= fv.Coding.Data
+	}
+	for _, block := range fv.Blocks {
+		if len(block.Nodes) == 0 {
+			return false
+		}
+	}
+	return len(fv.Nodes) > 0
+}
+
+// PlanLayoutDedup plan a new version of filename whose content hash is stored as the erasure-coded
+// shards or the blocks of a readable version. Return the version it would get and the replicas of each
+// shard or block to link it from, with the shard they hold, none if no such version stores the content.
+// The index is not changed.
+func (i *Index) PlanLayoutDedup(filename string, hash [SIZE]byte) (int, []model.Replica) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	version := i.nextVersion(filename)
+	for _, ref := range i.sortedRefs(hash) {
+		fv, ok := i.storedVersion(ref.filename, ref.version)
+		if !ok || (!isCoded(fv) && !isSplit(fv)) || !readable(fv) {
+			continue
+		}
+		replicas := versionReplicas(ref.filename, fv)
+		for k := range replicas {
+			replicas[k].Shard = shardOf(fv, replicas[k].Node)
+		}
+		return version, replicas
+	}
+	return version, nil
+}
+
+// AddLayoutDedupFile add version fs.Version of fs.Filename with the layout of the version of the linked
+// replicas, planned by PlanLayoutDedup, on the nodes which linked them. It fails if another version was
+// added since it was planned, or if too few shards or no copy of a block were linked to read it.
+func (i *Index) AddLayoutDedupFile(fs model.FileStructure, meta model.FileMeta, linked []model.Replica) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	err := i.checkFilePath(fs.Filename)
+	if err != nil {
+		return err
+	}
+	if fs.Version != i.nextVersion(fs.Filename) {
+		return fmt.Errorf("%s changed since the put was planned", fs.Filename)
+	}
+	if len(linked) == 0 {
+		return fmt.Errorf("no node stores the content of %s", fs.Filename)
+	}
+	fv, ok := i.storedVersion(linked[0].File.Filename, linked[0].File.Version)
+	if !ok || fv.Hash != fs.Hash {
+		return fmt.Errorf("no node stores the content of %s", fs.Filename)
+	}
+
+	fs.Size = fv.Size
+	fs.Timestamp = time.Now()
+	entry := model.IndexEntry{
+		Op:   model.OpAddFile,
+		File: fs,
+		Meta: &meta,
+	}
+	restored := model.FileVersion{Coding: fv.Coding}
+	if isCoded(fv) {
+		restored.Shards = make([]string, len(fv.Shards))
+		for _, replica := range linked {
+			if replica.Shard >= 0 && replica.Shard < len(fv.Shards) && fv.Shards[replica.Shard] == replica.Node {
+				restored.Shards[replica.Shard] = replica.Node
+			}
+		}
+		coding := fv.Coding
+		entry.Coding = &coding
+		entry.Nodes = restored.Shards
+	} else {
+		restored.Blocks = make([]model.Block, len(fv.Blocks))
+		for k, block := range fv.Blocks {
+			restored.Blocks[k] = model.Block{Size: block.Size, Nodes: []string{}}
+		}
+		for _, replica := range linked {
+			k := replica.File.Block
+			if replica.File.Blocks > 0 && k >= 0 && k < len(fv.Blocks) && i.findIndex(fv.Blocks[k].Nodes, replica.Node) != -1 {
+				restored.Blocks[k].Nodes = append(restored.Blocks[k].Nodes, replica.Node)
+			}
+		}
+		restored.Nodes = blockNodes(restored.Blocks)
+		entry.Blocks = restored.Blocks
+	}
+	if !readable(restored) {
+		return fmt.Errorf("too little of the content of %s was linked to read it", fs.Filename)
+	}
+	err = i.checkQuota(fs.Filename, fs.Hash, fs.Size, meta.Uploader)
+	if err != nil {
+		return err
+	}
+
+	i.commit(entry)
+	return nil
+}
@@ -0,0 +1,92 @@
+package index
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"CS425/CS425-MP3/model"
+)
+
+// default num of latest changes kept for followers
+const defaultMaxDeltas = 1000
+
+// SetMaxDeltas keep the latest n changes for followers to catch up from
+func (i *Index) SetMaxDeltas(n int) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if n <= 0 {
+		n = defaultMaxDeltas
+	}
+	i.maxDeltas = n
+	if len(i.deltas) > n {
+		i.deltas = append([]model.IndexEntry{}, i.deltas[len(i.deltas)-n:]...)
+	}
+}
+
+// remember keep entry for followers, dropping the oldest kept change when full
+func (i *Index) remember(entry model.IndexEntry) {
+	if len(i.deltas) >= i.maxDeltas {
+		i.deltas = i.deltas[len(i.deltas)-i.maxDeltas+1:]
+	}
+	i.deltas = append(i.deltas, entry)
+}
+
+// chainHash hash of the index after entry, from the hash before it in entry.Prev and the change
+func chainHash(entry model.IndexEntry) [SIZE]byte {
+	entry.Hash = [SIZE]byte{}
+	// the log encodes entries the same way
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Index: encode %v for its hash failed: %v", entry.Op, err)
+	}
+	return md5.Sum(data)
+}
+
+// EntriesSince changes after pos in order. ok is false if some of them are no longer kept, pos is
+// ahead of the index, or the change at pos is not the one here, as after a failover to a master
+// which did not get it. The follower then needs the whole index.
+func (i *Index) EntriesSince(pos model.IndexPosition) ([]model.IndexEntry, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if pos.Seq > i.index.Seq {
+		return nil, false
+	}
+	if pos.Seq == i.index.Seq {
+		return []model.IndexEntry{}, pos.Hash == i.index.Hash
+	}
+	if len(i.deltas) == 0 || i.deltas[0].Seq > pos.Seq+1 {
+		return nil, false
+	}
+	// deltas hold consecutive seqs ending at i.index.Seq
+	first := int(pos.Seq + 1 - i.deltas[0].Seq)
+	if i.deltas[first].Prev != pos.Hash {
+		return nil, false
+	}
+	return append([]model.IndexEntry{}, i.deltas[first:]...), true
+}
+
+// ApplyEntries apply changes sent by the master in order, changes already applied are skipped.
+// Return an error at the first gap or change which does not follow the local history, the changes
+// before it are applied.
+func (i *Index) ApplyEntries(entries []model.IndexEntry) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for _, entry := range entries {
+		if entry.Seq <= i.index.Seq {
+			continue
+		}
+		if entry.Seq != i.index.Seq+1 {
+			return fmt.Errorf("index: missing changes %d to %d", i.index.Seq+1, entry.Seq-1)
+		}
+		if entry.Prev != i.index.Hash {
+			return fmt.Errorf("index: change %d follows another history than change %d here", entry.Seq, i.index.Seq)
+		}
+		i.logAndApply(entry)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+
+	"CS425/CS425-MP3/model"
+)
+
+// isDraining whether node id is being decommissioned, which then gets no new replicas
+func (i *Index) isDraining(id string) bool {
+	return i.index.Draining[id]
+}
+
+// Drain stop placing new replicas on node id, PlanDrain gives the copies to make before it leaves
+func (i *Index) Drain(id string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, ok := i.numFiles[id]; !ok {
+		return fmt.Errorf("node %s not found", id)
+	}
+	if i.isDraining(id) {
+		return nil
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpDrain,
+		Node: id,
+	})
+	return nil
+}
+
+// Undrain place new replicas on node id again
+func (i *Index) Undrain(id string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if !i.isDraining(id) {
+		return
+	}
+	i.commit(model.IndexEntry{
+		Op:   model.OpUndrain,
+		Node: id,
+	})
+}
+
+// Draining nodes being decommissioned, sorted
+func (i *Index) Draining() []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	nodes := []string{}
+	for id := range i.index.Draining {
+		nodes = append(nodes, id)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// PlanDrain pulls copying every version or block on node id which other nodes do not hold often enough
+// for the replication of its file, and every shard on node id to a node holding no shard of its version.
+// Copies of deleted files in the trash which are not purged yet are kept the same way, they can still be
+// undeleted or restored from a snapshot. An error if a version would be lost as no other node can take
+// a copy. The index is not changed until AddReplicas.
+func (i *Index) PlanDrain(id string) ([]model.PullInstruction, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	// bytes planned per node, so that the pulls spread over the nodes
+	planned := make(map[string]int64)
+	pulls := []model.PullInstruction{}
+	for _, fs := range i.index.NodesToFile[id] {
+		fv, ok := i.findVersion(fs.Filename, fs.Version)
+		if !ok {
+			continue
+		}
+		plannedPulls, err := i.planReplicaDrain(id, fs, fv, i.replication(fs.Filename), planned)
+		if err != nil {
+			return nil, err
+		}
+		pulls = append(pulls, plannedPulls...)
+	}
+
+	filenames := []string{}
+	for filename := range i.index.Trash {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		tomb := i.index.Trash[filename]
+		target := tomb.Replication
+		if target <= 0 {
+			target = REPLICAS
+		}
+		for _, fv := range tomb.Versions {
+			for _, replica := range versionReplicas(filename, fv) {
+				if replica.Node != id {
+					continue
+				}
+				if isCoded(fv) {
+					replica.File.Size = storedSize(fv)
+				}
+				plannedPulls, err := i.planReplicaDrain(id, replica.File, fv, target, planned)
+				if err != nil {
+					return nil, err
+				}
+				pulls = append(pulls, plannedPulls...)
+			}
+		}
+	}
+	return pulls, nil
+}
+
+// planReplicaDrain pulls copying the replica fs of fv on node id to other nodes until target nodes other
+// than id hold it, the block of fs if fv is split or its shard if fv is erasure-coded
+func (i *Index) planReplicaDrain(id string, fs model.FileStructure, fv model.FileVersion, target int, planned map[string]int64) ([]model.PullInstruction, error) {
+	others := i.without(fv.Nodes, id)
+	if isCoded(fv) {
+		pull, err := i.planShardDrain(id, fs, fv, others, planned)
+		if err != nil || pull == nil {
+			return nil, err
+		}
+		return []model.PullInstruction{*pull}, nil
+	}
+	holders := fv.Nodes
+	if isSplit(fv) && fs.Block < len(fv.Blocks) {
+		holders = fv.Blocks[fs.Block].Nodes
+		others = i.without(holders, id)
+	}
+	missing := target - len(others)
+	if missing <= 0 {
+		return nil, nil
+	}
+
+	nodes := i.getNodesWithLeastBytes()
+	sort.SliceStable(nodes, func(a, b int) bool {
+		return i.numBytes[nodes[a]]+planned[nodes[a]] < i.numBytes[nodes[b]]+planned[nodes[b]]
+	})
+	picked := i.placeReplicas(others, nodes, missing, fs.Size)
+	if len(picked) == 0 && len(others) == 0 {
+		return nil, fmt.Errorf("no node other than %s can take a copy of version %d of %s", id, fs.Version, fs.Filename)
+	}
+	pulls := []model.PullInstruction{}
+	for _, node := range picked {
+		planned[node] += fs.Size
+		pulls = append(pulls, model.PullInstruction{
+			Filename: VersionName(fs),
+			Node:     node,
+			PullFrom: append([]string{}, holders...),
+			File:     fs,
+		})
+	}
+	return pulls, nil
+}
+
+// planShardDrain pull copying the shard of fv on node id elsewhere, nil if id holds none of its shards
+// or no node has room and the version can be decoded without it
+func (i *Index) planShardDrain(id string, fs model.FileStructure, fv model.FileVersion, others []string, planned map[string]int64) (*model.PullInstruction, error) {
+	shard := shardOf(fv, id)
+	if shard == -1 {
+		return nil, nil
+	}
+
+	nodes := i.getNodesWithLeastBytes()
+	sort.SliceStable(nodes, func(a, b int) bool {
+		return i.numBytes[nodes[a]]+planned[nodes[a]] < i.numBytes[nodes[b]]+planned[nodes[b]]
+	})
+	picked := i.placeReplicas(others, nodes, 1, fs.Size)
+	if len(picked) == 0 {
+		if shardsLeft(fv)-1 < fv.Coding.Data {
+			return nil, fmt.Errorf("no node other than %s can take shard %d of version %d of %s", id, shard, fs.Version, fs.Filename)
+		}
+		return nil, nil
+	}
+	planned[picked[0]] += fs.Size
+	return &model.PullInstruction{
+		Filename: fmt.Sprintf("%s_%d", fs.Filename, fs.Version),
+		Node:     picked[0],
+		PullFrom: []string{id},
+		File:     fs,
+		Shard:    shard,
+	}, nil
+}
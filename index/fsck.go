@@ -0,0 +1,434 @@
+package index
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"CS425/CS425-MP3/model"
+)
+
+// ParseVersionName split a replica file name "filename_version" on disk
+func ParseVersionName(name string) (string, int, bool) {
+	ind := strings.LastIndex(name, "_")
+	if ind <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(name[ind+1:])
+	if err != nil || version < 0 {
+		return "", 0, false
+	}
+	return name[:ind], version, true
+}
+
+// Fsck check that Filename, Fileversions, NodesToFile and FileToNodes agree with each other and
+// with disk, a map from node to the replica files on it. Nodes not in disk are not checked against
+// their disk. With repair the index is rebuilt from the replicas which are both indexed and on disk.
+// Return the problems found and the orphan files on disk which belong to no indexed version.
+func (i *Index) Fsck(disk map[string][]string, repair bool) ([]string, []model.Replica) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	problems := []string{}
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// metadata of every version any map knows about
+	meta := make(map[model.Replica]model.FileStructure)
+	// replicas claimed by Fileversions and by NodesToFile
+	inVersions := make(map[model.Replica]bool)
+	inNodes := make(map[model.Replica]bool)
+
+	for filename, versions := range i.index.Fileversions {
+		seen := make(map[int]bool)
+		latest := -1
+		for _, fv := range versions {
+			if seen[fv.Version] {
+				report("%s: version %d is listed twice in Fileversions", filename, fv.Version)
+			}
+			seen[fv.Version] = true
+			if fv.Version > latest {
+				latest = fv.Version
+			}
+
+			fs := model.FileStructure{
+				Version:   fv.Version,
+				Filename:  filename,
+				Hash:      fv.Hash,
+				Size:      fv.Size,
+				Timestamp: fv.Timestamp,
+				Blocks:    len(fv.Blocks),
+			}
+			meta[versionKey(fs)] = fs
+			if len(fv.Nodes) == 0 {
+				report("%s_%d: no replica left", filename, fv.Version)
+			}
+			for _, replica := range versionReplicas(filename, fv) {
+				if inVersions[i.replicaKey(replica.Node, replica.File)] {
+					report("%s: %s is listed twice in Fileversions", VersionName(replica.File), replica.Node)
+				}
+				inVersions[i.replicaKey(replica.Node, replica.File)] = true
+			}
+			if isCoded(fv) {
+				i.checkShards(fv, fs, report)
+			}
+			if isSplit(fv) {
+				i.checkBlocks(fv, fs, report)
+			}
+		}
+
+		fs, ok := i.index.Filename[filename]
+		if !ok {
+			report("%s: in Fileversions but not in Filename", filename)
+		} else if latest != -1 && fs.Version != latest {
+			report("%s: Filename has version %d, latest in Fileversions is %d", filename, fs.Version, latest)
+		} else if latest != -1 && meta[versionKey(fs)].Hash != fs.Hash {
+			report("%s: Filename hash differs from Fileversions for version %d", filename, fs.Version)
+		}
+	}
+	for filename := range i.index.Filename {
+		if len(i.index.Fileversions[filename]) == 0 {
+			report("%s: in Filename but has no versions", filename)
+		}
+	}
+
+	for id, files := range i.index.NodesToFile {
+		if _, ok := i.numFiles[id]; !ok && len(files) > 0 {
+			report("%s: holds %d files but is not in the system", id, len(files))
+		}
+		var size int64
+		for _, fs := range files {
+			size += fs.Size
+			key := i.replicaKey(id, fs)
+			if inNodes[key] {
+				report("%s: listed twice in NodesToFile of %s", VersionName(fs), id)
+			}
+			inNodes[key] = true
+			if _, ok := meta[versionKey(fs)]; !ok {
+				meta[versionKey(fs)] = fs
+			}
+			if !inVersions[key] {
+				report("%s: NodesToFile has it on %s, Fileversions does not", VersionName(fs), id)
+			}
+		}
+		if _, ok := i.numFiles[id]; ok && (i.numFiles[id] != len(files) || i.numBytes[id] != size) {
+			report("%s: counted %d files and %d bytes, holds %d files and %d bytes", id, i.numFiles[id], i.numBytes[id], len(files), size)
+		}
+	}
+	for id, count := range i.numFiles {
+		if _, ok := i.index.NodesToFile[id]; !ok && (count != 0 || i.numBytes[id] != 0) {
+			report("%s: counted %d files and %d bytes, holds none", id, count, i.numBytes[id])
+		}
+	}
+	for key := range inVersions {
+		if !inNodes[key] {
+			report("%s: Fileversions has it on %s, NodesToFile does not", keyName(key, meta), key.Node)
+		}
+		if _, ok := i.numFiles[key.Node]; !ok {
+			report("%s: Fileversions has it on %s which is not in the system", keyName(key, meta), key.Node)
+		}
+	}
+
+	// FileToNodes should be the nodes holding any version
+	holders := make(map[string]map[string]bool)
+	for _, claims := range []map[model.Replica]bool{inVersions, inNodes} {
+		for key := range claims {
+			if holders[key.File.Filename] == nil {
+				holders[key.File.Filename] = make(map[string]bool)
+			}
+			holders[key.File.Filename][key.Node] = true
+		}
+	}
+	for filename, nodes := range i.index.FileToNodes {
+		listed := make(map[string]bool)
+		for _, id := range nodes {
+			if listed[id] {
+				report("%s: %s is listed twice in FileToNodes", filename, id)
+			}
+			listed[id] = true
+			if !holders[filename][id] {
+				report("%s: FileToNodes has it on %s, which holds no version", filename, id)
+			}
+		}
+		for id := range holders[filename] {
+			if !listed[id] {
+				report("%s: %s holds a version but is not in FileToNodes", filename, id)
+			}
+		}
+	}
+	for filename := range holders {
+		if _, ok := i.index.FileToNodes[filename]; !ok {
+			report("%s: has replicas but is not in FileToNodes", filename)
+		}
+	}
+
+	// deleted replicas waiting for a purge
+	trashed := make(map[model.Replica]bool)
+	for filename, tomb := range i.index.Trash {
+		for _, fv := range tomb.Versions {
+			for _, replica := range versionReplicas(filename, fv) {
+				trashed[i.replicaKey(replica.Node, replica.File)] = true
+				if _, ok := i.numFiles[replica.Node]; !ok {
+					report("%s: the trash has it on %s which is not in the system", VersionName(replica.File), replica.Node)
+				}
+			}
+		}
+	}
+
+	// replicas which survive a repair
+	keep := make(map[model.Replica]bool)
+	for _, claims := range []map[model.Replica]bool{inVersions, inNodes} {
+		for key := range claims {
+			if _, ok := i.numFiles[key.Node]; ok {
+				keep[key] = true
+			}
+		}
+	}
+
+	orphans := []model.Replica{}
+	for id, names := range disk {
+		onDisk := make(map[model.Replica]bool)
+		for _, name := range names {
+			file := model.FileStructure{}
+			var ok bool
+			file.Filename, file.Version, ok = ParseVersionName(name)
+			if !ok {
+				// the num of blocks is not known here, any marks the name of a block
+				file.Filename, file.Version, file.Block, ok = parseBlockName(name)
+				file.Blocks = file.Block + 1
+			}
+			if !ok {
+				continue
+			}
+			key := i.replicaKey(id, file)
+			onDisk[key] = true
+			if inVersions[key] || inNodes[key] || trashed[key] {
+				continue
+			}
+			if tomb, ok := i.index.Trash[file.Filename]; ok && file.Version <= tomb.Version {
+				report("%s: %s is on disk but was deleted", id, name)
+				orphans = append(orphans, model.Replica{Node: id, File: file})
+				continue
+			}
+			if fs, ok := meta[versionKey(file)]; ok && (fs.Blocks > 0) == (file.Blocks > 0) {
+				report("%s: %s is on disk but not indexed", id, name)
+				keep[key] = true
+			} else {
+				report("%s: %s is on disk but no such version is indexed", id, name)
+				orphans = append(orphans, model.Replica{Node: id, File: file})
+			}
+		}
+		for key := range keep {
+			if key.Node == id && !onDisk[key] {
+				report("%s: %s is indexed but missing on disk", id, keyName(key, meta))
+				delete(keep, key)
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	if !repair || len(problems) == 0 {
+		return problems, orphans
+	}
+
+	replicas := []model.Replica{}
+	for key := range keep {
+		file := meta[versionKey(key.File)]
+		file.Block = key.File.Block
+		replicas = append(replicas, model.Replica{
+			Node: key.Node,
+			File: file,
+		})
+	}
+	sort.Slice(replicas, func(a, b int) bool {
+		if replicas[a].File.Filename != replicas[b].File.Filename {
+			return replicas[a].File.Filename < replicas[b].File.Filename
+		}
+		if replicas[a].File.Version != replicas[b].File.Version {
+			return replicas[a].File.Version < replicas[b].File.Version
+		}
+		if replicas[a].File.Block != replicas[b].File.Block {
+			return replicas[a].File.Block < replicas[b].File.Block
+		}
+		return replicas[a].Node < replicas[b].Node
+	})
+	i.commit(model.IndexEntry{
+		Op:       model.OpRepair,
+		Replicas: replicas,
+	})
+
+	// the entry holds every replica, keep it out of the log
+	if i.wal != nil {
+		err := i.wal.Snapshot(i.snapshot())
+		if err != nil {
+			log.Printf("Index: snapshot after repair failed: %v", err)
+		}
+	}
+	return problems, orphans
+}
+
+// applyRepair rebuild the maps so that exactly replicas are stored, versions without
+// replicas stay in Fileversions so their loss is still visible
+func (i *Index) applyRepair(replicas []model.Replica) {
+	nodesOf := make(map[model.Replica][]string)
+	for _, replica := range replicas {
+		key := i.replicaKey("", replica.File)
+		nodesOf[key] = append(nodesOf[key], replica.Node)
+		// the blocks of a version which is not indexed cannot be put back together
+		if !i.hasVersion(replica.File) && replica.File.Blocks == 0 {
+			i.index.Fileversions[replica.File.Filename] = append(i.index.Fileversions[replica.File.Filename], model.FileVersion{
+				Version:   replica.File.Version,
+				Hash:      replica.File.Hash,
+				Size:      replica.File.Size,
+				Timestamp: replica.File.Timestamp,
+			})
+		}
+	}
+
+	i.index.NodesToFile = make(map[string][]model.FileStructure)
+	i.index.FileToNodes = make(map[string][]string)
+	for id := range i.numFiles {
+		i.numFiles[id] = 0
+		i.numBytes[id] = 0
+	}
+
+	for filename, versions := range i.index.Fileversions {
+		rebuilt := []model.FileVersion{}
+		seen := make(map[int]bool)
+		latest := model.FileVersion{Version: -1}
+		for _, fv := range versions {
+			if seen[fv.Version] {
+				continue
+			}
+			seen[fv.Version] = true
+
+			fs := model.FileStructure{
+				Version:   fv.Version,
+				Filename:  filename,
+				Hash:      fv.Hash,
+				Size:      fv.Size,
+				Timestamp: fv.Timestamp,
+			}
+			fv.Nodes = append([]string{}, nodesOf[i.replicaKey("", fs)]...)
+			// a shard is kept where it was, a node which held no shard keeps only its file on disk
+			if isCoded(fv) {
+				fv.Shards = append([]string{}, fv.Shards...)
+				for k, id := range fv.Shards {
+					if i.findIndex(fv.Nodes, id) == -1 {
+						fv.Shards[k] = ""
+					}
+				}
+			}
+			stored := fs
+			stored.Size = storedSize(fv)
+			replicas := []model.Replica{}
+			for _, id := range fv.Nodes {
+				replicas = append(replicas, model.Replica{Node: id, File: stored})
+			}
+			if isSplit(fv) {
+				fv.Blocks = copyBlocks(fv.Blocks)
+				for k := range fv.Blocks {
+					fs.Block = k
+					fv.Blocks[k].Nodes = append([]string{}, nodesOf[i.replicaKey("", fs)]...)
+				}
+				fv.Nodes = blockNodes(fv.Blocks)
+				replicas = versionReplicas(filename, fv)
+			}
+			for _, replica := range replicas {
+				id := replica.Node
+				i.numFiles[id]++
+				i.numBytes[id] += replica.File.Size
+				i.index.NodesToFile[id] = append(i.index.NodesToFile[id], replica.File)
+				if i.findIndex(i.index.FileToNodes[filename], id) == -1 {
+					i.index.FileToNodes[filename] = append(i.index.FileToNodes[filename], id)
+				}
+			}
+			rebuilt = append(rebuilt, fv)
+			if fv.Version > latest.Version {
+				latest = fv
+			}
+		}
+
+		if len(rebuilt) == 0 {
+			delete(i.index.Fileversions, filename)
+			continue
+		}
+		i.index.Fileversions[filename] = rebuilt
+		i.index.Filename[filename] = model.FileStructure{
+			Version:   latest.Version,
+			Filename:  filename,
+			Hash:      latest.Hash,
+			Size:      latest.Size,
+			Timestamp: latest.Timestamp,
+		}
+	}
+
+	for filename := range i.index.Filename {
+		if _, ok := i.index.Fileversions[filename]; !ok {
+			delete(i.index.Filename, filename)
+			delete(i.index.Replication, filename)
+			delete(i.index.Retention, filename)
+		}
+	}
+	for filename, tags := range i.index.Tags {
+		for tag, version := range tags {
+			if !i.hasVersion(model.FileStructure{Filename: filename, Version: version}) {
+				i.applyUntag(filename, tag)
+			}
+		}
+	}
+	i.buildChildren()
+	i.buildContents()
+	i.buildCharges()
+}
+
+// versionKey key of meta, only filename and version matter
+func versionKey(fs model.FileStructure) model.Replica {
+	return model.Replica{
+		File: model.FileStructure{
+			Filename: fs.Filename,
+			Version:  fs.Version,
+		},
+	}
+}
+
+// keyName name on disk of the replica key stands for
+func keyName(key model.Replica, meta map[model.Replica]model.FileStructure) string {
+	file := key.File
+	file.Blocks = meta[versionKey(file)].Blocks
+	return VersionName(file)
+}
+
+func (i *Index) hasVersion(fs model.FileStructure) bool {
+	for _, fv := range i.index.Fileversions[fs.Filename] {
+		if fv.Version == fs.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// checkShards report shards of the erasure-coded version fv which are not on its nodes, and whether
+// too few are left to decode it
+func (i *Index) checkShards(fv model.FileVersion, fs model.FileStructure, report func(format string, a ...interface{})) {
+	if len(fv.Shards) != fv.Coding.Data+fv.Coding.Parity {
+		report("%s_%d: has %d shards, coding %d+%d needs %d", fs.Filename, fv.Version, len(fv.Shards), fv.Coding.Data, fv.Coding.Parity, fv.Coding.Data+fv.Coding.Parity)
+	}
+	for k, id := range fv.Shards {
+		if id == "" {
+			continue
+		}
+		if i.findIndex(fv.Nodes, id) == -1 {
+			report("%s_%d: shard %d is on %s, which does not hold the version", fs.Filename, fv.Version, k, id)
+		}
+		if shardOf(fv, id) != k {
+			report("%s_%d: %s holds more than one shard", fs.Filename, fv.Version, id)
+		}
+	}
+	if left := shardsLeft(fv); left < fv.Coding.Data {
+		report("%s_%d: %d of %d shards left, %d are needed to decode it", fs.Filename, fv.Version, left, len(fv.Shards), fv.Coding.Data)
+	}
+}
@@ -0,0 +1,57 @@
+package index
+
+import (
+	"fmt"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// VersionAt version of filename which was the latest at t, from the commit timestamps of its versions
+func (i *Index) VersionAt(filename string, t time.Time) (model.FileVersion, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if _, ok := i.index.Filename[filename]; !ok {
+		return model.FileVersion{}, fmt.Errorf("file %s not found", filename)
+	}
+
+	// newest first, so the first version committed at or before t is the one
+	versions := i.sortedVersions(filename)
+	for k, fv := range versions {
+		if fv.Timestamp.After(t) {
+			continue
+		}
+		// a pruned version between fv and the next one kept may have been the latest at t
+		if k > 0 && versions[k-1].Version != fv.Version+1 {
+			return model.FileVersion{}, fmt.Errorf("the version of %s latest at %s was pruned", filename, t.Format(time.RFC3339))
+		}
+		if tomb, ok := i.index.Trash[filename]; ok && fv.Version <= tomb.Version && !tomb.Deleted.After(t) {
+			return model.FileVersion{}, fmt.Errorf("%s was deleted at %s", filename, t.Format(time.RFC3339))
+		}
+		return fv, nil
+	}
+	return model.FileVersion{}, fmt.Errorf("no version of %s at %s", filename, t.Format(time.RFC3339))
+}
+
+// GetVersionsBetween latest numVersions versions of file committed in [since, until], newest first.
+// A zero since or until leaves that end of the range open.
+func (i *Index) GetVersionsBetween(filename string, since, until time.Time, numVersions int) []model.FileVersion {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	versions := []model.FileVersion{}
+	for _, fv := range i.sortedVersions(filename) {
+		if len(versions) >= numVersions {
+			break
+		}
+		if !since.IsZero() && fv.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && fv.Timestamp.After(until) {
+			continue
+		}
+		versions = append(versions, fv)
+	}
+	return versions
+}
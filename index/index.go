@@ -1,11 +1,15 @@
 package index
 
 import (
+	"CS425/CS425-MP3/erasure"
 	"CS425/CS425-MP3/model"
 	"crypto/md5"
 	"fmt"
+	"log"
 	"reflect"
 	"sort"
+	"sync"
+	"time"
 )
 
 // SIZE md5 size
@@ -14,49 +18,390 @@ const SIZE = model.SIZE
 // REPLICAS num of file repicas
 const REPLICAS = 4
 
-// Index Index struct
+// Index Index struct, safe for concurrent use
 type Index struct {
+	// guards every field below, read methods return copies so callers never see the maps change
+	lock  sync.RWMutex
 	index model.GlobalIndexFile
 	// map from node to num of files on the node
 	numFiles map[string]int
+	// map from node to num of bytes of the files on the node
+	numBytes map[string]int64
+	// latest disk usage reported by nodes, not logged
+	nodeInfo map[string]model.NodeInfo
+	// map from directory to the files and directories in it
+	children map[string]map[string]bool
+	// all filenames sorted, so a page of ListFiles starts with a binary search
+	names []string
+	// map from content hash to the versions sharing it, in the namespace or in the trash
+	contents map[[SIZE]byte]map[contentRef]bool
+	// map from content hash to the num of snapshots referencing it
+	pinned map[[SIZE]byte]int
+	// map from quota to what its identity uploaded under its prefix
+	charges map[quotaKey]*quotaCharge
+	// log of index changes, nil if the index is not persisted
+	wal *WAL
+	// latest changes in seq order, sent to followers instead of the whole index
+	deltas    []model.IndexEntry
+	maxDeltas int
 }
 
 // NewIndex creates a new index object
-func NewIndex() Index {
-	var i Index
-	i.index.Filename = make(map[string]model.FileStructure)
-	i.index.Fileversions = make(map[string][]model.FileVersion)
-	i.index.NodesToFile = make(map[string][]model.FileStructure)
-	i.index.FileToNodes = make(map[string][]string)
-	i.numFiles = make(map[string]int)
+func NewIndex() *Index {
+	i := &Index{maxDeltas: defaultMaxDeltas}
+	i.load(model.GlobalIndexFile{})
+	i.nodeInfo = make(map[string]model.NodeInfo)
 	return i
 }
 
 // LoadFromGlobalIndexFile crLoadFromGlobalIndexFile
-func LoadFromGlobalIndexFile(file model.GlobalIndexFile) Index {
-	var i Index
+func LoadFromGlobalIndexFile(file model.GlobalIndexFile) *Index {
+	i := NewIndex()
+	i.load(file)
+	return i
+}
+
+// LoadFromWAL rebuild the index from the snapshot and log in w, later changes are logged to w
+func LoadFromWAL(w *WAL) (*Index, error) {
+	i := NewIndex()
+	err := i.Replay(w)
+	return i, err
+}
+
+// load replace the maps with those of file, the caller holds the lock
+func (i *Index) load(file model.GlobalIndexFile) {
 	i.index = model.GlobalIndexFile{
 		Filename:     file.Filename,
 		Fileversions: file.Fileversions,
 		NodesToFile:  file.NodesToFile,
 		FileToNodes:  file.FileToNodes,
+		NodeZones:    file.NodeZones,
+		Replication:  file.Replication,
+		Retention:    file.Retention,
+		Coding:       file.Coding,
+		Dirs:         file.Dirs,
+		Trash:        file.Trash,
+		Snapshots:    file.Snapshots,
+		Tags:         file.Tags,
+		Quotas:       file.Quotas,
+		Draining:     file.Draining,
+		Seq:          file.Seq,
+		Hash:         file.Hash,
+	}
+	if i.index.Filename == nil {
+		i.index.Filename = make(map[string]model.FileStructure)
+	}
+	if i.index.Fileversions == nil {
+		i.index.Fileversions = make(map[string][]model.FileVersion)
+	}
+	if i.index.NodesToFile == nil {
+		i.index.NodesToFile = make(map[string][]model.FileStructure)
+	}
+	if i.index.FileToNodes == nil {
+		i.index.FileToNodes = make(map[string][]string)
+	}
+	if i.index.NodeZones == nil {
+		i.index.NodeZones = make(map[string]string)
+	}
+	if i.index.Replication == nil {
+		i.index.Replication = make(map[string]int)
+	}
+	if i.index.Retention == nil {
+		i.index.Retention = make(map[string]model.RetentionPolicy)
+	}
+	if i.index.Coding == nil {
+		i.index.Coding = make(map[string]model.Coding)
 	}
+	if i.index.Dirs == nil {
+		i.index.Dirs = make(map[string]bool)
+	}
+	if i.index.Trash == nil {
+		i.index.Trash = make(map[string]model.Tombstone)
+	}
+	if i.index.Snapshots == nil {
+		i.index.Snapshots = make(map[string]model.Snapshot)
+	}
+	if i.index.Tags == nil {
+		i.index.Tags = make(map[string]map[string]int)
+	}
+	if i.index.Draining == nil {
+		i.index.Draining = make(map[string]bool)
+	}
+	i.buildChildren()
+	i.buildContents()
+	i.buildPins()
+	i.buildCharges()
+
+	// nodes holding files are still in the system after a failover
 	i.numFiles = make(map[string]int)
-	return i
+	i.numBytes = make(map[string]int64)
+	for id, files := range i.index.NodesToFile {
+		i.numFiles[id] = len(files)
+		for _, fs := range files {
+			i.numBytes[id] += fs.Size
+		}
+	}
+}
+
+// Replay replace the index with the snapshot and log in w, later changes are logged to w
+func (i *Index) Replay(w *WAL) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.wal = w
+	snap, entries, err := w.load()
+	if err != nil {
+		return err
+	}
+
+	i.load(snap.Index)
+	i.deltas = nil
+	if snap.NumFiles != nil {
+		i.numFiles = snap.NumFiles
+	}
+	for _, entry := range entries {
+		i.apply(entry)
+		i.remember(entry)
+	}
+
+	// compact the replayed log, this also drops a torn tail
+	return w.Snapshot(i.snapshot())
+}
+
+// Reset replace the index with file pushed by the master, the log keeps being used
+func (i *Index) Reset(file model.GlobalIndexFile) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.load(file)
+	// kept changes may not lead up to file
+	i.deltas = nil
+	if i.wal == nil || i.wal.seq == i.index.Seq {
+		return nil
+	}
+	return i.wal.Snapshot(i.snapshot())
+}
+
+// SetWAL log later changes to w, the current state is snapshotted if w is behind
+func (i *Index) SetWAL(w *WAL) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.wal = w
+	if w == nil || w.seq == i.index.Seq {
+		return nil
+	}
+	return w.Snapshot(i.snapshot())
+}
+
+// Seq sequence number of the last change
+func (i *Index) Seq() int64 {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.index.Seq
+}
+
+// Position seq and hash of the last change
+func (i *Index) Position() model.IndexPosition {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return model.IndexPosition{Seq: i.index.Seq, Hash: i.index.Hash}
+}
+
+func (i *Index) snapshot() snapshot {
+	return snapshot{
+		Index:    i.index,
+		NumFiles: i.numFiles,
+	}
+}
+
+// commit log entry then apply it to the index
+func (i *Index) commit(entry model.IndexEntry) {
+	entry.Seq = i.index.Seq + 1
+	entry.Prev = i.index.Hash
+	entry.Hash = chainHash(entry)
+	i.logAndApply(entry)
+}
+
+// logAndApply log entry then apply it to the index, entry follows the last change
+func (i *Index) logAndApply(entry model.IndexEntry) {
+	if i.wal != nil {
+		err := i.wal.Append(entry)
+		if err != nil {
+			log.Printf("Index: append %v to log failed: %v", entry.Op, err)
+		}
+	}
+	i.apply(entry)
+	i.remember(entry)
+
+	if i.wal != nil && i.wal.needSnapshot() {
+		err := i.wal.Snapshot(i.snapshot())
+		if err != nil {
+			log.Printf("Index: snapshot failed: %v", err)
+		}
+	}
+}
+
+// apply change the maps as recorded in entry, replaying an entry gives the same result
+func (i *Index) apply(entry model.IndexEntry) {
+	switch entry.Op {
+	case model.OpAddNode:
+		i.numFiles[entry.Node] = 0
+	case model.OpRemoveNode:
+		i.applyRemoveNode(entry.Node, entry.Replicas)
+	case model.OpRenameNode:
+		i.applyRenameNode(entry.Node, entry.NewNode)
+	case model.OpSetZone:
+		i.index.NodeZones[entry.Node] = entry.Zone
+	case model.OpSetReplication:
+		i.index.Replication[entry.File.Filename] = entry.Replication
+	case model.OpAddReplicas:
+		for _, replica := range entry.Replicas {
+			i.addReplica(replica)
+		}
+	case model.OpDropReplicas:
+		for _, replica := range entry.Replicas {
+			i.dropReplica(replica)
+		}
+	case model.OpSetRetention:
+		if entry.Retention == nil {
+			delete(i.index.Retention, entry.File.Filename)
+		} else {
+			i.index.Retention[entry.File.Filename] = *entry.Retention
+		}
+	case model.OpRemoveVersion:
+		i.applyRemoveVersion(entry.File)
+	case model.OpRepair:
+		i.applyRepair(entry.Replicas)
+	case model.OpMoveReplica:
+		i.applyMoveReplica(entry.Node, entry.NewNode, entry.File)
+	case model.OpAddFile:
+		i.applyAddFile(entry.File, entry.Meta, entry.Nodes, entry.Coding, entry.Blocks)
+	case model.OpRemoveFile:
+		i.applyRemoveFile(entry.File.Filename, entry.File.Timestamp)
+	case model.OpUndelete:
+		i.applyUndelete(entry.File.Filename)
+	case model.OpPurge:
+		i.applyPurge(entry.Replicas)
+	case model.OpAddTrashReplicas:
+		i.applyAddTrashReplicas(entry.Replicas)
+	case model.OpSnapshot:
+		i.applySnapshot(entry.File.Filename, entry.File.Timestamp)
+	case model.OpDeleteSnapshot:
+		i.applyDeleteSnapshot(entry.File.Filename)
+	case model.OpTag:
+		i.applyTag(entry.File.Filename, entry.File.Version, entry.Tag)
+	case model.OpUntag:
+		i.applyUntag(entry.File.Filename, entry.Tag)
+	case model.OpMkdir:
+		i.makeDirs(entry.File.Filename)
+	case model.OpRmdir:
+		i.applyRmdir(entry.File.Filename)
+	case model.OpRenameFile:
+		i.applyRenameFile(entry.File.Filename, entry.NewFilename)
+	case model.OpDrain:
+		i.index.Draining[entry.Node] = true
+	case model.OpUndrain:
+		delete(i.index.Draining, entry.Node)
+	case model.OpSetCoding:
+		if entry.Coding == nil {
+			delete(i.index.Coding, entry.File.Filename)
+		} else {
+			i.index.Coding[entry.File.Filename] = *entry.Coding
+		}
+	case model.OpSetQuota:
+		if entry.Quota != nil {
+			i.applySetQuota(*entry.Quota)
+		}
+	default:
+		log.Printf("Index: unknown op %v in entry %d", entry.Op, entry.Seq)
+	}
+	i.index.Seq = entry.Seq
+	i.index.Hash = entry.Hash
 }
 
 // AddNewNode AddNewNode
 func (i *Index) AddNewNode(id string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// a node added twice keeps its files
+	if _, ok := i.numFiles[id]; ok {
+		return
+	}
 	// log.Printf("Index: Added new node %v", id)
-	i.numFiles[id] = 0
+	i.commit(model.IndexEntry{
+		Op:   model.OpAddNode,
+		Node: id,
+	})
+}
+
+// RenameNode node rejoined under a new ID, it keeps the files of its old ID
+func (i *Index) RenameNode(oldID, newID string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.commit(model.IndexEntry{
+		Op:      model.OpRenameNode,
+		Node:    oldID,
+		NewNode: newID,
+	})
+}
+
+// SetNodeZone record the failure domain of node
+func (i *Index) SetNodeZone(id string, zone string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if z, ok := i.index.NodeZones[id]; ok && z == zone {
+		return
+	}
+	i.commit(model.IndexEntry{
+		Op:   model.OpSetZone,
+		Node: id,
+		Zone: zone,
+	})
+}
+
+// HasNodeZone whether node has reported its failure domain
+func (i *Index) HasNodeZone(id string) bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	_, ok := i.index.NodeZones[id]
+	return ok
+}
+
+// SetNodeInfo record disk usage reported by node
+func (i *Index) SetNodeInfo(info model.NodeInfo) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.nodeInfo[info.ID] = info
+}
+
+// Nodes return nodes in the index
+func (i *Index) Nodes() []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	nodes := []string{}
+	for k := range i.numFiles {
+		nodes = append(nodes, k)
+	}
+	sort.Strings(nodes)
+	return nodes
 }
 
 // PrintIndex PrintIndex
 func (i *Index) PrintIndex() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
 	ret := ""
 	ret += "Nodes in system:\n"
 	for k := range i.numFiles {
-		ret += k + ", "
+		ret += fmt.Sprintf("%s(%s, %d files, %d bytes, %d bytes free), ", k, i.index.NodeZones[k], i.numFiles[k], i.numBytes[k], i.nodeInfo[k].FreeBytes)
 	}
 
 	ret += "\n\nNodes to files:\n"
@@ -73,11 +418,17 @@ func (i *Index) PrintIndex() string {
 
 // LsReplicasOfFile ls replicas of file
 func (i *Index) LsReplicasOfFile(filename string) []string {
-	return i.index.FileToNodes[filename]
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return append([]string{}, i.index.FileToNodes[filename]...)
 }
 
 // StoresOnNode return files stored on node
 func (i *Index) StoresOnNode(nodeID string) []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
 	files := []string{}
 	table := make(map[string]int)
 	for _, file := range i.index.NodesToFile[nodeID] {
@@ -104,69 +455,184 @@ func (i *Index) getLatestFileVersion(filename string) model.FileVersion {
 	return model.FileVersion{}
 }
 
-// RemoveNode RemoveNode
-func (i *Index) RemoveNode(id string) []model.PullInstruction {
-	instructions := []model.PullInstruction{}
-	delete(i.numFiles, id)
+// findVersion version of filename in the index
+func (i *Index) findVersion(filename string, version int) (model.FileVersion, bool) {
+	for _, fv := range i.index.Fileversions[filename] {
+		if fv.Version == version {
+			return fv, true
+		}
+	}
+	return model.FileVersion{}, false
+}
+
+// RemoveNode remove a failed node with its replicas, PlanReReplication gives the copies to restore
+func (i *Index) RemoveNode(id string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
 
-	// delete from global file index as well
-	nodes := i.getNodesWithLeastFiles()
+	i.commit(model.IndexEntry{
+		Op:   model.OpRemoveNode,
+		Node: id,
+	})
+}
+
+// applyRemoveNode drop node id, then add the replicas which logs of older versions planned with it
+func (i *Index) applyRemoveNode(id string, replicas []model.Replica) {
 	filesOnNode := i.index.NodesToFile[id]
+	delete(i.numFiles, id)
+	delete(i.numBytes, id)
+	delete(i.nodeInfo, id)
 	delete(i.index.NodesToFile, id)
+	delete(i.index.NodeZones, id)
+	delete(i.index.Draining, id)
 
 	for _, file := range filesOnNode {
-		ind := i.findIndex(i.index.FileToNodes[file.Filename], id)
-		for _, fv := range i.index.Fileversions[file.Filename] {
-			ind := i.findIndex(fv.Nodes, id)
-			if ind != -1 {
-				fv.Nodes = i.removeFromSlice(ind, fv.Nodes)
+		i.index.FileToNodes[file.Filename] = i.without(i.index.FileToNodes[file.Filename], id)
+		versions := i.index.Fileversions[file.Filename]
+		for k := range versions {
+			versions[k].Nodes = i.without(versions[k].Nodes, id)
+			dropShard(&versions[k], id)
+			i.dropBlockNode(&versions[k], id)
+		}
+	}
+
+	i.dropTrashNode(id)
+
+	for _, replica := range replicas {
+		i.addReplica(replica)
+	}
+}
+
+func (i *Index) applyRenameNode(oldID, newID string) {
+	i.numFiles[newID] = i.numFiles[oldID]
+	delete(i.numFiles, oldID)
+	i.numBytes[newID] = i.numBytes[oldID]
+	delete(i.numBytes, oldID)
+	if zone, ok := i.index.NodeZones[oldID]; ok {
+		i.index.NodeZones[newID] = zone
+		delete(i.index.NodeZones, oldID)
+	}
+	if i.index.Draining[oldID] {
+		i.index.Draining[newID] = true
+		delete(i.index.Draining, oldID)
+	}
+	filesOnNode := i.index.NodesToFile[oldID]
+	delete(i.index.NodesToFile, oldID)
+	if filesOnNode != nil {
+		i.index.NodesToFile[newID] = filesOnNode
+	}
+
+	for _, file := range filesOnNode {
+		nodes := i.index.FileToNodes[file.Filename]
+		if ind := i.findIndex(nodes, oldID); ind != -1 {
+			nodes[ind] = newID
+		}
+		for k, fv := range i.index.Fileversions[file.Filename] {
+			if ind := i.findIndex(fv.Nodes, oldID); ind != -1 {
+				fv.Nodes[ind] = newID
 			}
+			renameShard(&i.index.Fileversions[file.Filename][k], oldID, newID)
+			i.renameBlockNode(&i.index.Fileversions[file.Filename][k], oldID, newID)
 		}
+	}
+	i.renameTrashNode(oldID, newID)
+}
 
-		if ind != -1 {
-			i.index.FileToNodes[file.Filename] = i.removeFromSlice(ind, i.index.FileToNodes[file.Filename])
+// addReplica record that replica.Node holds replica.File, or shard replica.Shard of it if it is erasure-coded,
+// or block replica.File.Block of it if it is split
+func (i *Index) addReplica(replica model.Replica) {
+	filename := replica.File.Filename
+	if fv, ok := i.findVersion(filename, replica.File.Version); ok {
+		replica.File.Size = storedSize(fv)
+		if isSplit(fv) {
+			if replica.File.Block < 0 || replica.File.Block >= len(fv.Blocks) {
+				return
+			}
+			replica.File = blockFile(filename, fv, replica.File.Block)
+		}
+	}
+	i.numFiles[replica.Node]++
+	i.numBytes[replica.Node] += replica.File.Size
+	i.reserveSpace(replica.Node, replica.File.Size)
+	i.index.NodesToFile[replica.Node] = append(i.index.NodesToFile[replica.Node], replica.File)
+	if i.findIndex(i.index.FileToNodes[filename], replica.Node) == -1 {
+		i.index.FileToNodes[filename] = append(i.index.FileToNodes[filename], replica.Node)
+	}
+
+	versions := i.index.Fileversions[filename]
+	for k := range versions {
+		if versions[k].Version != replica.File.Version {
+			continue
+		}
+		if isSplit(versions[k]) {
+			block := &versions[k].Blocks[replica.File.Block]
+			if i.findIndex(block.Nodes, replica.Node) == -1 {
+				block.Nodes = append(block.Nodes, replica.Node)
+			}
 		}
-		for _, node := range nodes {
-			// send only the latest file version for replication
-			if i.index.Filename[file.Filename].Hash == file.Hash && !i.nodeHasFile(file.Filename, node) {
-				// send file and break
-				inst := model.PullInstruction{
-					Filename: fmt.Sprintf("%s_%d", file.Filename, file.Version),
-					Node:     node,
-					PullFrom: i.GetNodesWithFile(file.Filename), // some node which has filen
-				}
-				instructions = append(instructions, inst)
-
-				// update NodeToFile and FileToNodes
-				fs := model.FileStructure{
-					Version:  file.Version,
-					Filename: file.Filename,
-					Hash:     file.Hash,
-				}
-				i.index.NodesToFile[node] = append(i.index.NodesToFile[node], fs)
-
-				// update FileToNodes
-				i.index.FileToNodes[file.Filename] = append(i.index.FileToNodes[file.Filename], node)
-
-				//update Fileversions
-				latestFV := i.getLatestFileVersion(file.Filename)
-				latestFV.Nodes = append(latestFV.Nodes, node)
-
-				break
+		if i.findIndex(versions[k].Nodes, replica.Node) == -1 {
+			versions[k].Nodes = append(versions[k].Nodes, replica.Node)
+			if isCoded(versions[k]) && replica.Shard >= 0 && replica.Shard < len(versions[k].Shards) {
+				versions[k].Shards[replica.Shard] = replica.Node
 			}
 		}
 	}
+}
+
+// dropReplica record that replica.Node no longer holds replica.File, only the block it names if it is
+// a block of a split version
+func (i *Index) dropReplica(replica model.Replica) {
+	filename := replica.File.Filename
+	var newFiles []model.FileStructure
+	for _, fs := range i.index.NodesToFile[replica.Node] {
+		if fs.Filename == filename && fs.Version == replica.File.Version && (replica.File.Blocks == 0 || fs.Block == replica.File.Block) {
+			i.numFiles[replica.Node]--
+			i.numBytes[replica.Node] -= fs.Size
+			continue
+		}
+		newFiles = append(newFiles, fs)
+	}
+	i.index.NodesToFile[replica.Node] = newFiles
+
+	versions := i.index.Fileversions[filename]
+	for k := range versions {
+		if versions[k].Version != replica.File.Version {
+			continue
+		}
+		if replica.File.Blocks > 0 {
+			i.dropBlock(&versions[k], replica.File.Block, replica.Node)
+			continue
+		}
+		versions[k].Nodes = i.without(versions[k].Nodes, replica.Node)
+		dropShard(&versions[k], replica.Node)
+		i.dropBlockNode(&versions[k], replica.Node)
+	}
+	if !i.nodeHasFile(filename, replica.Node) {
+		i.index.FileToNodes[filename] = i.without(i.index.FileToNodes[filename], replica.Node)
+	}
+}
 
-	return instructions
+// applyMoveReplica copy fs from node from to node to, with the shard from held, and drop it from from
+func (i *Index) applyMoveReplica(from, to string, fs model.FileStructure) {
+	shard := -1
+	if fv, ok := i.findVersion(fs.Filename, fs.Version); ok {
+		shard = shardOf(fv, from)
+	}
+	i.addReplica(model.Replica{Node: to, File: fs, Shard: shard})
+	i.dropReplica(model.Replica{Node: from, File: fs})
 }
 
-func (i *Index) removeFromSlice(ind int, slice []string) []string {
-	// log.Println("removeFromSlice ", slice, ind)
-	if ind == len(slice) {
-		return slice[:ind]
+// without return a copy of list without elem
+func (i *Index) without(list []string, elem string) []string {
+	ret := make([]string, 0, len(list))
+	for _, e := range list {
+		if e != elem {
+			ret = append(ret, e)
+		}
 	}
-	return append(slice[:ind], slice[ind+1:]...)
+	return ret
 }
+
 func (i *Index) findIndex(list []string, elem string) int {
 	for ind, e := range list {
 		if e == elem {
@@ -176,39 +642,56 @@ func (i *Index) findIndex(list []string, elem string) int {
 	return -1
 }
 
-func (i *Index) getNodesWithLeastFiles() []string {
-	lenid := make(map[int][]string)
-	var lens []int
-	for k, v := range i.numFiles {
-		_, ok := lenid[v]
-		if !ok {
-			lenid[v] = make([]string, 0)
-		}
-		lenid[v] = append(lenid[v], k)
-		if len(lens) > 0 && lens[len(lens)-1] != v {
-			lens = append(lens, v)
-		} else if len(lens) == 0 {
-			lens = append(lens, v)
-		}
+// AddFile AddFile on replicas nodes, 0 replicas keeps the current setting.
+// version is -1 with an error if filename is a directory or no node has room for size bytes
+func (i *Index) AddFile(filename string, hash [SIZE]byte, size int64, replicas int, meta model.FileMeta) (int, []string, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	err := i.checkFilePath(filename)
+	if err != nil {
+		return -1, nil, err
 	}
-	// log.Println("getNodesWithLeastFiles lens:", lens)
-	sort.Ints(lens)
-	var Sortedids []string
-	for _, val := range lens {
-		Sortedids = append(Sortedids, lenid[val]...)
+
+	n := replicas
+	if n <= 0 {
+		n = i.replication(filename)
 	}
-	return Sortedids
-}
 
-// AddFile AddFile
-func (i *Index) AddFile(filename string, hash [SIZE]byte) (int, []string) {
-	_, ok := i.index.Filename[filename]
-	if !ok {
+	err = i.checkQuota(filename, hash, size, meta.Uploader)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	var version int
+	var nodes []string
+	fs, ok := i.index.Filename[filename]
+	coding := i.codingFor(filename)
+	if coding.Data > 0 && (!ok || fs.Hash != hash) {
+		version, nodes = i.addShards(filename, hash, size, coding, meta)
+		if version == -1 {
+			return version, nodes, fmt.Errorf("%s needs %d nodes with room for a shard of %d bytes", filename, coding.Data+coding.Parity, erasure.ShardSize(size, coding.Data))
+		}
+	} else if size > BlockSize && (!ok || fs.Hash != hash) {
+		version, nodes = i.addBlocks(filename, hash, size, n, meta)
+		if version == -1 {
+			return version, nodes, fmt.Errorf("no node has room for a block of %s (%d bytes)", filename, BlockSize)
+		}
+	} else if !ok {
 		// log.Println("Adding new file: ", filename)
-		return i.addFile(filename, hash)
+		version, nodes = i.addFile(filename, hash, size, n, meta)
+	} else {
+		// log.Println("Updating file: ", filename)
+		version, nodes = i.updateFile(filename, hash, size, n, meta)
+	}
+
+	if version == -1 {
+		return version, nodes, fmt.Errorf("no node has room for %s (%d bytes)", filename, size)
+	}
+	if replicas > 0 {
+		i.setReplication(filename, replicas)
 	}
-	// log.Println("Updating file: ", filename)
-	return i.updateFile(filename, hash)
+	return version, nodes, nil
 }
 
 func (i *Index) nodeHasFile(filename, id string) bool {
@@ -221,115 +704,171 @@ func (i *Index) nodeHasFile(filename, id string) bool {
 }
 
 // AddFile add file for first time
-func (i *Index) addFile(filename string, hash [SIZE]byte) (int, []string) {
-	nodes := i.getNodesWithLeastFiles()
-	replicas := REPLICAS
+func (i *Index) addFile(filename string, hash [SIZE]byte, size int64, replicas int, meta model.FileMeta) (int, []string) {
+	nodes := i.getNodesWithLeastBytes()
 
 	// log.Println("Nodes with least files: ", nodes)
-	nodesWithFile := make([]string, 0)
-
-	fs := model.FileStructure{
-		Version:  0,
-		Filename: filename,
-		Hash:     hash,
-	}
-	i.index.Filename[filename] = fs
-	fv := model.FileVersion{
-		Version: i.index.Filename[filename].Version,
-		Hash:    hash,
+	nodesWithFile := i.placeReplicas(nil, nodes, replicas, size)
+	if len(nodesWithFile) == 0 {
+		return -1, nodesWithFile
 	}
 
-	for _, id := range nodes {
-		if i.nodeHasFile(filename, id) {
-			continue
-		}
-		if replicas <= 0 {
-			break
-		}
-		replicas--
-		i.numFiles[id]++
-
-		// Get old file version or create new and append nodes
-		nodesWithFile = append(nodesWithFile, id)
-		for _, f := range i.index.Fileversions[filename] {
-			if f.Version == i.index.Filename[filename].Version {
-				fv = f
-			}
-		}
-		fv.Nodes = append(fv.Nodes, id)
-		i.index.NodesToFile[id] = append(i.index.NodesToFile[id], fs)
-		i.index.FileToNodes[filename] = append(i.index.FileToNodes[filename], id)
+	fs := model.FileStructure{
+		Version:   i.nextVersion(filename),
+		Filename:  filename,
+		Hash:      hash,
+		Size:      size,
+		Timestamp: time.Now(),
 	}
-	fv.Nodes = nodesWithFile
-	i.index.Fileversions[filename] = append(i.index.Fileversions[filename], fv)
-
-	return i.index.Filename[filename].Version, nodesWithFile
+	i.commit(model.IndexEntry{
+		Op:    model.OpAddFile,
+		File:  fs,
+		Meta:  &meta,
+		Nodes: nodesWithFile,
+	})
+	return fs.Version, nodesWithFile
 }
 
 // UpdateFile update file
-func (i *Index) updateFile(filename string, hash [SIZE]byte) (int, []string) {
+func (i *Index) updateFile(filename string, hash [SIZE]byte, size int64, replicas int, meta model.FileMeta) (int, []string) {
 	if reflect.DeepEqual(i.index.Filename[filename].Hash, hash) {
-		return i.index.Filename[filename].Version, i.index.FileToNodes[filename]
+		return i.index.Filename[filename].Version, append([]string{}, i.index.FileToNodes[filename]...)
+	}
+
+	// keep the new version on the current replicas unless other nodes add failure domains
+	nodes := append([]string{}, i.index.FileToNodes[filename]...)
+	for _, id := range i.getNodesWithLeastBytes() {
+		if i.findIndex(nodes, id) == -1 {
+			nodes = append(nodes, id)
+		}
+	}
+	nodesWithFile := i.placeReplicas(nil, nodes, replicas, size)
+	if len(nodesWithFile) == 0 {
+		return -1, nodesWithFile
 	}
 
-	nodes := i.index.FileToNodes[filename]
 	fs := model.FileStructure{
-		Version:  i.index.Filename[filename].Version + 1,
-		Filename: filename,
-		Hash:     hash,
+		Version:   i.nextVersion(filename),
+		Filename:  filename,
+		Hash:      hash,
+		Size:      size,
+		Timestamp: time.Now(),
 	}
-	i.index.Filename[filename] = fs
+	i.commit(model.IndexEntry{
+		Op:    model.OpAddFile,
+		File:  fs,
+		Meta:  &meta,
+		Nodes: nodesWithFile,
+	})
+	return fs.Version, nodesWithFile
+}
 
+// applyAddFile add version fs on nodes, or as shards of coding with nodes holding each shard in order, or
+// as blocks on their own nodes
+func (i *Index) applyAddFile(fs model.FileStructure, meta *model.FileMeta, nodes []string, coding *model.Coding, blocks []model.Block) {
+	if _, ok := i.index.Filename[fs.Filename]; !ok {
+		i.makeDirs(parentDir(fs.Filename))
+		i.addChild(fs.Filename)
+		i.addName(fs.Filename)
+	}
+	i.index.Filename[fs.Filename] = fs
 	fv := model.FileVersion{
-		Version: i.index.Filename[filename].Version,
-		Hash:    hash,
+		Version:   fs.Version,
+		Nodes:     append([]string{}, nodes...),
+		Hash:      fs.Hash,
+		Size:      fs.Size,
+		Timestamp: fs.Timestamp,
 	}
-	nodesWithFile := make([]string, 0)
-	for _, id := range nodes {
-		i.numFiles[id]++
-
-		for _, f := range i.index.Fileversions[filename] {
-			if f.Version == i.index.Filename[filename].Version {
-				fv = f
-			}
-		}
-		fv.Nodes = append(fv.Nodes, id)
+	if meta != nil {
+		fv.Meta = *meta
+	}
+	if coding != nil && coding.Data > 0 {
+		fv.Coding = *coding
+		fv.Shards = append([]string{}, nodes...)
+		fv.Nodes = i.without(nodes, "")
+	}
+	if len(blocks) > 0 {
+		fv.Blocks = copyBlocks(blocks)
+		fv.Nodes = blockNodes(blocks)
+	}
+	i.index.Fileversions[fs.Filename] = append(i.index.Fileversions[fs.Filename], fv)
+	i.addContentRef(fs.Hash, fs.Filename, fs.Version)
+	i.chargeVersion(fs.Filename, fv, 1)
 
-		i.index.NodesToFile[id] = append(i.index.NodesToFile[id], fs)
-		nodesWithFile = append(nodesWithFile, id)
-		if !i.nodeHasFile(filename, id) {
-			i.index.FileToNodes[filename] = append(i.index.FileToNodes[filename], id)
+	// nodes store a shard of an erasure-coded version, or each block of a split one they hold
+	stored := fs
+	stored.Size = storedSize(fv)
+	replicas := []model.Replica{}
+	for _, id := range fv.Nodes {
+		replicas = append(replicas, model.Replica{Node: id, File: stored})
+	}
+	if isSplit(fv) {
+		replicas = versionReplicas(fs.Filename, fv)
+	}
+	for _, replica := range replicas {
+		id := replica.Node
+		i.numFiles[id]++
+		i.numBytes[id] += replica.File.Size
+		i.reserveSpace(id, replica.File.Size)
+		i.index.NodesToFile[id] = append(i.index.NodesToFile[id], replica.File)
+		if i.findIndex(i.index.FileToNodes[fs.Filename], id) == -1 {
+			i.index.FileToNodes[fs.Filename] = append(i.index.FileToNodes[fs.Filename], id)
 		}
 	}
-	fv.Nodes = nodesWithFile
-	i.index.Fileversions[filename] = append(i.index.Fileversions[filename], fv)
-	return i.index.Filename[filename].Version, nodesWithFile
 }
 
-// RemoveFile add file to GlobalIndexFile
+// RemoveFile move all versions of file to the trash, return the nodes holding them
 func (i *Index) RemoveFile(filename string) []string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	nodes := append([]string{}, i.index.FileToNodes[filename]...)
+	if _, ok := i.index.Filename[filename]; !ok {
+		return nodes
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpRemoveFile,
+		File: model.FileStructure{Filename: filename, Timestamp: time.Now()},
+	})
+	return nodes
+}
+
+func (i *Index) applyRemoveFile(filename string, deleted time.Time) {
+	for _, fv := range i.index.Fileversions[filename] {
+		i.dropContentRef(fv.Hash, filename, fv.Version)
+		i.chargeVersion(filename, fv, -1)
+	}
+	i.toTrash(filename, deleted)
 	nodes := i.index.FileToNodes[filename]
 	for _, id := range nodes {
-		i.numFiles[id]--
-		delete(i.index.Fileversions, filename)
 		var newFiles []model.FileStructure
 		for _, fs := range i.index.NodesToFile[id] {
 			if fs.Filename != filename {
 				newFiles = append(newFiles, fs)
+			} else {
+				i.numFiles[id]--
+				i.numBytes[id] -= fs.Size
 			}
 		}
 		i.index.NodesToFile[id] = newFiles
 	}
+	delete(i.index.Fileversions, filename)
 	delete(i.index.FileToNodes, filename)
 	delete(i.index.Filename, filename)
-	return nodes
+	delete(i.index.Replication, filename)
+	delete(i.index.Retention, filename)
+	delete(i.index.Tags, filename)
+	i.removeChild(filename)
+	i.removeName(filename)
 }
 
+// GetVersions latest numVersions versions of file, newest first
 func (i *Index) GetVersions(filename string, numVersions int) []model.FileVersion {
-	versions := i.index.Fileversions[filename]
-	sort.Slice(versions, func(i, j int) bool {
-		return versions[i].Version > versions[j].Version
-	})
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	versions := i.sortedVersions(filename)
 	// log.Println(versions)
 	if numVersions > len(versions) {
 		return versions
@@ -337,38 +876,171 @@ func (i *Index) GetVersions(filename string, numVersions int) []model.FileVersio
 	return versions[:numVersions]
 }
 
+// sortedVersions copy of the versions of file, newest first
+func (i *Index) sortedVersions(filename string) []model.FileVersion {
+	versions := []model.FileVersion{}
+	for _, fv := range i.index.Fileversions[filename] {
+		fv = copyVersion(fv)
+		versions = append(versions, fv)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions
+}
+
+// copyVersion copy of fv which shares no node list with it
+func copyVersion(fv model.FileVersion) model.FileVersion {
+	fv.Nodes = append([]string{}, fv.Nodes...)
+	if fv.Shards != nil {
+		fv.Shards = append([]string{}, fv.Shards...)
+	}
+	fv.Blocks = copyBlocks(fv.Blocks)
+	return fv
+}
+
 // GetNodesWithFile get nodes
 func (i *Index) GetNodesWithFile(filename string) []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
 	v, ok := i.index.FileToNodes[filename]
 	if !ok {
 		return nil
 	}
-	return v
+	return append([]string{}, v...)
 }
 
 // GetFilesOnNode get files
 func (i *Index) GetFilesOnNode(id string) []model.FileStructure {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
 	v, ok := i.index.NodesToFile[id]
 	if !ok {
 		return nil
 	}
-	return v
+	return append([]model.FileStructure{}, v...)
 }
 
+// GetFile latest version of file and the nodes holding it
 func (i *Index) GetFile(filename string) (int, []string) {
-	versions := i.index.Fileversions[filename]
-	sort.Slice(versions, func(i, j int) bool {
-		return versions[i].Version > versions[j].Version
-	})
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	versions := i.sortedVersions(filename)
 	if len(versions) == 0 {
 		return -1, nil
 	}
 	return versions[0].Version, versions[0].Nodes
 }
 
-// GetGlobalIndexFile return GlobalIndexFile
+// Stat metadata of version of file, the latest version if version is -1
+func (i *Index) Stat(filename string, version int) (model.FileStat, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if _, ok := i.index.Filename[filename]; !ok {
+		return model.FileStat{}, fmt.Errorf("file %s not found", filename)
+	}
+	if version == -1 {
+		version = i.getLatestVersion(filename)
+	}
+	for _, fv := range i.index.Fileversions[filename] {
+		if fv.Version != version {
+			continue
+		}
+		return model.FileStat{
+			Filename:  filename,
+			Version:   fv.Version,
+			Hash:      fv.Hash,
+			Size:      fv.Size,
+			Timestamp: fv.Timestamp,
+			Meta:      fv.Meta,
+			Nodes:     append([]string{}, fv.Nodes...),
+			Refs:      i.refCount(fv.Hash),
+			Tags:      i.tagsOf(filename, fv.Version),
+			Coding:    fv.Coding,
+			Shards:    append([]string(nil), fv.Shards...),
+			Blocks:    copyBlocks(fv.Blocks),
+		}, nil
+	}
+	return model.FileStat{}, fmt.Errorf("version %d of %s not found", version, filename)
+}
+
+// GetGlobalIndexFile return a copy of GlobalIndexFile, later changes do not show up in it
 func (i *Index) GetGlobalIndexFile() model.GlobalIndexFile {
-	return i.index
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.copyIndex()
+}
+
+// copyIndex deep copy of the maps, safe to read and encode without the lock
+func (i *Index) copyIndex() model.GlobalIndexFile {
+	file := model.GlobalIndexFile{
+		Filename:     make(map[string]model.FileStructure, len(i.index.Filename)),
+		Fileversions: make(map[string][]model.FileVersion, len(i.index.Fileversions)),
+		NodesToFile:  make(map[string][]model.FileStructure, len(i.index.NodesToFile)),
+		FileToNodes:  make(map[string][]string, len(i.index.FileToNodes)),
+		NodeZones:    make(map[string]string, len(i.index.NodeZones)),
+		Replication:  make(map[string]int, len(i.index.Replication)),
+		Retention:    make(map[string]model.RetentionPolicy, len(i.index.Retention)),
+		Coding:       make(map[string]model.Coding, len(i.index.Coding)),
+		Dirs:         make(map[string]bool, len(i.index.Dirs)),
+		Trash:        make(map[string]model.Tombstone, len(i.index.Trash)),
+		Snapshots:    make(map[string]model.Snapshot, len(i.index.Snapshots)),
+		Tags:         make(map[string]map[string]int, len(i.index.Tags)),
+		Quotas:       append([]model.Quota{}, i.index.Quotas...),
+		Draining:     make(map[string]bool, len(i.index.Draining)),
+		Seq:          i.index.Seq,
+		Hash:         i.index.Hash,
+	}
+	for k, v := range i.index.Filename {
+		file.Filename[k] = v
+	}
+	for k, v := range i.index.Fileversions {
+		versions := make([]model.FileVersion, 0, len(v))
+		for _, fv := range v {
+			fv = copyVersion(fv)
+			versions = append(versions, fv)
+		}
+		file.Fileversions[k] = versions
+	}
+	for k, v := range i.index.NodesToFile {
+		file.NodesToFile[k] = append([]model.FileStructure{}, v...)
+	}
+	for k, v := range i.index.FileToNodes {
+		file.FileToNodes[k] = append([]string{}, v...)
+	}
+	for k, v := range i.index.NodeZones {
+		file.NodeZones[k] = v
+	}
+	for k, v := range i.index.Replication {
+		file.Replication[k] = v
+	}
+	for k, v := range i.index.Retention {
+		file.Retention[k] = v
+	}
+	for k, v := range i.index.Coding {
+		file.Coding[k] = v
+	}
+	for k, v := range i.index.Dirs {
+		file.Dirs[k] = v
+	}
+	for k, v := range i.index.Trash {
+		file.Trash[k] = copyTombstone(v)
+	}
+	for k, v := range i.index.Snapshots {
+		file.Snapshots[k] = copySnapshot(v)
+	}
+	for k, v := range i.index.Tags {
+		file.Tags[k] = copyTags(v)
+	}
+	for k, v := range i.index.Draining {
+		file.Draining[k] = v
+	}
+	return file
 }
 
 func main() {
@@ -380,11 +1052,11 @@ func main() {
 	i.AddNewNode("id5")
 	i.AddNewNode("id6")
 
-	i.AddFile("f1", md5.Sum([]byte("f1")))
-	i.AddFile("f2", md5.Sum([]byte("f2")))
-	i.AddFile("f2", md5.Sum([]byte("f2a")))
-	i.AddFile("f3", md5.Sum([]byte("f3")))
-	i.AddFile("f3", md5.Sum([]byte("f3a")))
+	i.AddFile("f1", md5.Sum([]byte("f1")), int64(len("f1")), 0, model.FileMeta{})
+	i.AddFile("f2", md5.Sum([]byte("f2")), int64(len("f2")), 0, model.FileMeta{})
+	i.AddFile("f2", md5.Sum([]byte("f2a")), int64(len("f2a")), 0, model.FileMeta{})
+	i.AddFile("f3", md5.Sum([]byte("f3")), int64(len("f3")), 0, model.FileMeta{})
+	i.AddFile("f3", md5.Sum([]byte("f3a")), int64(len("f3a")), 0, model.FileMeta{})
 
 	println("Files on id1")
 	fmt.Println(i.GetFilesOnNode("id1"))
@@ -409,8 +1081,8 @@ func main() {
 	fmt.Println("----- Removing id1 -----")
 	println("Files on id1")
 	fmt.Println(i.GetFilesOnNode("id1"))
-	inst := i.RemoveNode("id1")
-	fmt.Println("inst: ", inst)
+	i.RemoveNode("id1")
+	fmt.Println("pulls: ", i.PlanReReplication(model.RetentionPolicy{}, time.Now()))
 	println("Files on id1")
 	fmt.Println(i.GetFilesOnNode("id1"))
 	println("Nodes with f1")
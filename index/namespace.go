@@ -0,0 +1,278 @@
+package index
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"CS425/CS425-MP3/model"
+)
+
+// CleanPath absolute form of an SDFS path, "a//b/" and "/a/b" name the same file
+func CleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// parentDir directory holding name
+func parentDir(name string) string {
+	return path.Dir(CleanPath(name))
+}
+
+// buildChildren rebuild the directory listings and the sorted filenames from Filename and Dirs
+func (i *Index) buildChildren() {
+	i.children = make(map[string]map[string]bool)
+	i.names = []string{}
+	for dir := range i.index.Dirs {
+		i.addChild(dir)
+	}
+	for filename := range i.index.Filename {
+		i.addChild(filename)
+		i.names = append(i.names, filename)
+	}
+	sort.Strings(i.names)
+}
+
+// addName insert filename in the sorted filenames
+func (i *Index) addName(filename string) {
+	k := sort.SearchStrings(i.names, filename)
+	if k < len(i.names) && i.names[k] == filename {
+		return
+	}
+	i.names = append(i.names, "")
+	copy(i.names[k+1:], i.names[k:])
+	i.names[k] = filename
+}
+
+func (i *Index) removeName(filename string) {
+	k := sort.SearchStrings(i.names, filename)
+	if k < len(i.names) && i.names[k] == filename {
+		i.names = append(i.names[:k], i.names[k+1:]...)
+	}
+}
+
+// addChild list name in its parent directory
+func (i *Index) addChild(name string) {
+	if name == "/" {
+		return
+	}
+	parent := parentDir(name)
+	if i.children[parent] == nil {
+		i.children[parent] = make(map[string]bool)
+	}
+	i.children[parent][name] = true
+}
+
+func (i *Index) removeChild(name string) {
+	parent := parentDir(name)
+	delete(i.children[parent], name)
+	if len(i.children[parent]) == 0 {
+		delete(i.children, parent)
+	}
+}
+
+func (i *Index) isDir(name string) bool {
+	return name == "/" || i.index.Dirs[name]
+}
+
+// checkFilePath error if filename is a directory or is under a file
+func (i *Index) checkFilePath(filename string) error {
+	if i.isDir(filename) {
+		return fmt.Errorf("%s is a directory", filename)
+	}
+	return i.checkParents(filename)
+}
+
+// checkParents error if some parent directory of name is a file
+func (i *Index) checkParents(name string) error {
+	for dir := parentDir(name); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := i.index.Filename[dir]; ok {
+			return fmt.Errorf("%s is a file", dir)
+		}
+	}
+	return nil
+}
+
+// makeDirs record dir and its missing parents
+func (i *Index) makeDirs(dir string) {
+	for ; !i.isDir(dir); dir = path.Dir(dir) {
+		i.index.Dirs[dir] = true
+		i.addChild(dir)
+	}
+}
+
+// Mkdir make dir and its missing parents, nothing is done if it exists
+func (i *Index) Mkdir(dir string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	dir = CleanPath(dir)
+	if i.isDir(dir) {
+		return nil
+	}
+	if _, ok := i.index.Filename[dir]; ok {
+		return fmt.Errorf("%s is a file", dir)
+	}
+	err := i.checkParents(dir)
+	if err != nil {
+		return err
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpMkdir,
+		File: model.FileStructure{Filename: dir},
+	})
+	return nil
+}
+
+// Rmdir remove dir, it should be empty
+func (i *Index) Rmdir(dir string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	dir = CleanPath(dir)
+	if dir == "/" {
+		return fmt.Errorf("cannot remove /")
+	}
+	if !i.isDir(dir) {
+		return fmt.Errorf("directory %s not found", dir)
+	}
+	if len(i.children[dir]) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpRmdir,
+		File: model.FileStructure{Filename: dir},
+	})
+	return nil
+}
+
+func (i *Index) applyRmdir(dir string) {
+	delete(i.index.Dirs, dir)
+	delete(i.children, dir)
+	i.removeChild(dir)
+}
+
+// List files and directories in dir sorted by name, with recursive the subdirectories are listed
+// after their entry. A file lists itself.
+func (i *Index) List(dir string, recursive bool) ([]model.DirEntry, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	name := CleanPath(dir)
+	if fs, ok := i.index.Filename[name]; ok {
+		return []model.DirEntry{{
+			Name:    name,
+			Version: fs.Version,
+			Size:    fs.Size,
+		}}, nil
+	}
+	if !i.isDir(name) {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+
+	entries := []model.DirEntry{}
+	i.listDir(name, recursive, &entries)
+	return entries, nil
+}
+
+func (i *Index) listDir(dir string, recursive bool, entries *[]model.DirEntry) {
+	names := []string{}
+	for name := range i.children[dir] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if i.isDir(name) {
+			*entries = append(*entries, model.DirEntry{
+				Name:  name,
+				IsDir: true,
+			})
+			if recursive {
+				i.listDir(name, recursive, entries)
+			}
+			continue
+		}
+		fs := i.index.Filename[name]
+		*entries = append(*entries, model.DirEntry{
+			Name:    name,
+			Version: fs.Version,
+			Size:    fs.Size,
+		})
+	}
+}
+
+// default and max num of files in a page of ListFiles
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// matchFile whether filename matches pattern, a glob, or a prefix if it has no glob characters
+func matchFile(pattern, filename string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, err := path.Match(pattern, filename)
+		return err == nil && ok
+	}
+	return strings.HasPrefix(filename, pattern)
+}
+
+// ListFiles files matching pattern sorted by name, at most limit of them after the name after.
+// Return the after of the next page, "" if this is the last page.
+func (i *Index) ListFiles(pattern string, after string, limit int) ([]model.FileInfo, string) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	if pattern != "" && !strings.HasPrefix(pattern, "/") {
+		pattern = "/" + pattern
+	}
+
+	// names sharing the literal prefix of pattern are contiguous, start at the first of them after after
+	prefix := pattern
+	if k := strings.IndexAny(prefix, "*?[\\"); k >= 0 {
+		prefix = prefix[:k]
+	}
+	start := after
+	if prefix > start {
+		start = prefix
+	}
+	names := []string{}
+	next := ""
+	for k := sort.SearchStrings(i.names, start); k < len(i.names); k++ {
+		filename := i.names[k]
+		if !strings.HasPrefix(filename, prefix) {
+			break
+		}
+		if filename <= after || !matchFile(pattern, filename) {
+			continue
+		}
+		if len(names) == limit {
+			next = names[limit-1]
+			break
+		}
+		names = append(names, filename)
+	}
+
+	files := []model.FileInfo{}
+	for _, filename := range names {
+		latest := i.getLatestFileVersion(filename)
+		files = append(files, model.FileInfo{
+			Filename: filename,
+			Version:  latest.Version,
+			Size:     latest.Size,
+			Replicas: len(latest.Nodes),
+		})
+	}
+	return files, next
+}
@@ -0,0 +1,75 @@
+package index
+
+import "sort"
+
+// zoneOf return failure domain of node, nodes which did not report one share the empty domain
+func (i *Index) zoneOf(id string) string {
+	return i.index.NodeZones[id]
+}
+
+// hasRoom whether node has size bytes free, nodes which did not report disk usage are assumed to
+func (i *Index) hasRoom(id string, size int64) bool {
+	info, ok := i.nodeInfo[id]
+	if !ok {
+		return true
+	}
+	return info.FreeBytes >= size
+}
+
+// reserveSpace count size bytes placed on node against its free space until it reports again
+func (i *Index) reserveSpace(id string, size int64) {
+	info, ok := i.nodeInfo[id]
+	if !ok {
+		return
+	}
+	info.FreeBytes -= size
+	info.UsedBytes += size
+	i.nodeInfo[id] = info
+}
+
+// getNodesWithLeastBytes return nodes sorted by bytes stored, then by num of files
+func (i *Index) getNodesWithLeastBytes() []string {
+	nodes := []string{}
+	for id := range i.numFiles {
+		nodes = append(nodes, id)
+	}
+	sort.Slice(nodes, func(a, b int) bool {
+		if i.numBytes[nodes[a]] != i.numBytes[nodes[b]] {
+			return i.numBytes[nodes[a]] < i.numBytes[nodes[b]]
+		}
+		if i.numFiles[nodes[a]] != i.numFiles[nodes[b]] {
+			return i.numFiles[nodes[a]] < i.numFiles[nodes[b]]
+		}
+		return nodes[a] < nodes[b]
+	})
+	return nodes
+}
+
+// placeReplicas pick n nodes with room for size bytes from candidates for a file already on holders.
+// Each pick goes to the failure domain with the fewest copies so far, ties go to
+// the earliest candidate, so candidates should be sorted by preference. Draining nodes are never picked.
+func (i *Index) placeReplicas(holders []string, candidates []string, n int, size int64) []string {
+	copies := make(map[string]int)
+	for _, id := range holders {
+		copies[i.zoneOf(id)]++
+	}
+
+	picked := []string{}
+	for len(picked) < n {
+		best := ""
+		for _, id := range candidates {
+			if i.findIndex(holders, id) != -1 || i.findIndex(picked, id) != -1 || !i.hasRoom(id, size) || i.isDraining(id) {
+				continue
+			}
+			if best == "" || copies[i.zoneOf(id)] < copies[i.zoneOf(best)] {
+				best = id
+			}
+		}
+		if best == "" {
+			break
+		}
+		picked = append(picked, best)
+		copies[i.zoneOf(best)]++
+	}
+	return picked
+}
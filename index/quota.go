@@ -0,0 +1,189 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"CS425/CS425-MP3/model"
+)
+
+// underPrefix whether filename is in directory prefix or below, "" is the whole namespace
+func underPrefix(prefix, filename string) bool {
+	return prefix == "" || prefix == "/" || filename == prefix || strings.HasPrefix(filename, prefix+"/")
+}
+
+// quotaKey identity and prefix of a quota
+type quotaKey struct {
+	identity string
+	prefix   string
+}
+
+// quotaCharge versions a quota is charged for
+type quotaCharge struct {
+	bytes int64
+	// map from file to num of its versions charged
+	versions map[string]int
+}
+
+// charged whether version fv of filename counts toward q, by its path and its uploader
+func charged(q model.Quota, filename string, fv model.FileVersion) bool {
+	return underPrefix(q.Prefix, filename) && (q.Identity == "" || fv.Meta.Uploader == q.Identity)
+}
+
+// buildCharge rebuild what q is charged from the versions in the index
+func (i *Index) buildCharge(q model.Quota) {
+	charge := &quotaCharge{versions: make(map[string]int)}
+	for filename, versions := range i.index.Fileversions {
+		for _, fv := range versions {
+			if charged(q, filename, fv) {
+				charge.bytes += fv.Size
+				charge.versions[filename]++
+			}
+		}
+	}
+	i.charges[quotaKey{identity: q.Identity, prefix: q.Prefix}] = charge
+}
+
+// buildCharges rebuild what every quota is charged
+func (i *Index) buildCharges() {
+	i.charges = make(map[quotaKey]*quotaCharge)
+	for _, q := range i.index.Quotas {
+		i.buildCharge(q)
+	}
+}
+
+// chargeVersion add version fv of filename to the quotas it counts toward, or remove it if sign is -1
+func (i *Index) chargeVersion(filename string, fv model.FileVersion, sign int) {
+	for _, q := range i.index.Quotas {
+		if !charged(q, filename, fv) {
+			continue
+		}
+		charge := i.charges[quotaKey{identity: q.Identity, prefix: q.Prefix}]
+		charge.bytes += int64(sign) * fv.Size
+		charge.versions[filename] += sign
+		if charge.versions[filename] <= 0 {
+			delete(charge.versions, filename)
+		}
+	}
+}
+
+func (i *Index) quotaUsage(q model.Quota) model.QuotaUsage {
+	charge := i.charges[quotaKey{identity: q.Identity, prefix: q.Prefix}]
+	return model.QuotaUsage{
+		Quota: q,
+		Bytes: charge.bytes,
+		Files: len(charge.versions),
+	}
+}
+
+// CheckQuota error if a new version of filename with size bytes uploaded by uploader would go over a
+// quota. Putting the content of the latest version again adds nothing.
+func (i *Index) CheckQuota(filename string, hash [SIZE]byte, size int64, uploader string) error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.checkQuota(filename, hash, size, uploader)
+}
+
+func (i *Index) checkQuota(filename string, hash [SIZE]byte, size int64, uploader string) error {
+	if fs, ok := i.index.Filename[filename]; ok && fs.Hash == hash {
+		return nil
+	}
+
+	version := model.FileVersion{Meta: model.FileMeta{Uploader: uploader}}
+	for _, q := range i.index.Quotas {
+		if !charged(q, filename, version) {
+			continue
+		}
+		usage := i.quotaUsage(q)
+		bytes, files := usage.Bytes+size, usage.Files
+		if i.charges[quotaKey{identity: q.Identity, prefix: q.Prefix}].versions[filename] == 0 {
+			files++
+		}
+		if q.MaxBytes > 0 && bytes > q.MaxBytes {
+			return fmt.Errorf("put of %s (%d bytes) is over the quota of %s: %d of %d bytes used", filename, size, quotaName(q), usage.Bytes, q.MaxBytes)
+		}
+		if q.MaxFiles > 0 && files > q.MaxFiles {
+			return fmt.Errorf("put of %s is over the quota of %s: %d of %d files used", filename, quotaName(q), usage.Files, q.MaxFiles)
+		}
+	}
+	return nil
+}
+
+// quotaName identity and prefix of q for messages
+func quotaName(q model.Quota) string {
+	identity, prefix := q.Identity, q.Prefix
+	if identity == "" {
+		identity = "anyone"
+	}
+	if prefix == "" {
+		prefix = "/"
+	}
+	return fmt.Sprintf("%s under %s", identity, prefix)
+}
+
+// SetQuota set the limits of the quota for q.Identity and q.Prefix, no limits remove it
+func (i *Index) SetQuota(q model.Quota) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if q.MaxBytes < 0 || q.MaxFiles < 0 {
+		return fmt.Errorf("quota of %s should not be negative, got %+v", quotaName(q), q)
+	}
+	if q.Prefix == "/" {
+		q.Prefix = ""
+	}
+	if q.MaxBytes == 0 && q.MaxFiles == 0 && i.findQuota(q) == -1 {
+		return fmt.Errorf("no quota of %s", quotaName(q))
+	}
+
+	i.commit(model.IndexEntry{
+		Op:    model.OpSetQuota,
+		Quota: &q,
+	})
+	return nil
+}
+
+// findQuota index of the quota with the identity and prefix of q in Quotas, -1 if none
+func (i *Index) findQuota(q model.Quota) int {
+	for k, quota := range i.index.Quotas {
+		if quota.Identity == q.Identity && quota.Prefix == q.Prefix {
+			return k
+		}
+	}
+	return -1
+}
+
+func (i *Index) applySetQuota(q model.Quota) {
+	k := i.findQuota(q)
+	if k != -1 {
+		i.index.Quotas = append(i.index.Quotas[:k:k], i.index.Quotas[k+1:]...)
+	}
+	if q.MaxBytes == 0 && q.MaxFiles == 0 {
+		delete(i.charges, quotaKey{identity: q.Identity, prefix: q.Prefix})
+		return
+	}
+	if k == -1 {
+		i.buildCharge(q)
+	}
+	i.index.Quotas = append(i.index.Quotas, q)
+	sort.Slice(i.index.Quotas, func(a, b int) bool {
+		if i.index.Quotas[a].Identity != i.index.Quotas[b].Identity {
+			return i.index.Quotas[a].Identity < i.index.Quotas[b].Identity
+		}
+		return i.index.Quotas[a].Prefix < i.index.Quotas[b].Prefix
+	})
+}
+
+// Quotas every quota with its usage
+func (i *Index) Quotas() []model.QuotaUsage {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	usages := []model.QuotaUsage{}
+	for _, q := range i.index.Quotas {
+		usages = append(usages, i.quotaUsage(q))
+	}
+	return usages
+}
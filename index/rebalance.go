@@ -0,0 +1,179 @@
+package index
+
+import (
+	"sort"
+
+	"CS425/CS425-MP3/model"
+)
+
+// PlanRebalance plan at most max moves of replicas from the most loaded nodes to the least loaded.
+// A move never leaves a version on fewer failure domains. The index is not changed.
+func (i *Index) PlanRebalance(max int) []model.Move {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	moves := []model.Move{}
+	// simulated bytes on each node after the planned moves
+	load := make(map[string]int64)
+	for id := range i.numFiles {
+		load[id] = i.numBytes[id]
+	}
+	// map from (node, filename, version) to whether the node holds it after the planned moves
+	holds := make(map[model.Replica]bool)
+	for id, files := range i.index.NodesToFile {
+		for _, fs := range files {
+			holds[i.replicaKey(id, fs)] = true
+		}
+	}
+
+	for len(moves) < max {
+		nodes := []string{}
+		for id := range load {
+			nodes = append(nodes, id)
+		}
+		if len(nodes) < 2 {
+			break
+		}
+		sort.Slice(nodes, func(a, b int) bool {
+			if load[nodes[a]] != load[nodes[b]] {
+				return load[nodes[a]] > load[nodes[b]]
+			}
+			return nodes[a] < nodes[b]
+		})
+
+		move, ok := i.pickMove(nodes, load, holds)
+		if !ok {
+			break
+		}
+		moves = append(moves, move)
+		load[move.From] -= move.File.Size
+		load[move.To] += move.File.Size
+		holds[i.replicaKey(move.From, move.File)] = false
+		holds[i.replicaKey(move.To, move.File)] = true
+	}
+	return moves
+}
+
+// pickMove pick the largest replica which moved from a loaded node to a light one narrows the gap
+// between them, nodes are sorted from the most loaded
+func (i *Index) pickMove(nodes []string, load map[string]int64, holds map[model.Replica]bool) (model.Move, bool) {
+	for _, from := range nodes {
+		for k := len(nodes) - 1; k >= 0 && load[nodes[k]] < load[from]; k-- {
+			to := nodes[k]
+			if i.isDraining(to) {
+				continue
+			}
+			gap := load[from] - load[to]
+
+			best := model.Move{}
+			found := false
+			for _, fs := range i.index.NodesToFile[from] {
+				if !holds[i.replicaKey(from, fs)] || holds[i.replicaKey(to, fs)] {
+					continue
+				}
+				// a move of half the gap or more would just swap the two nodes
+				if fs.Size*2 > gap || !i.hasRoom(to, fs.Size) {
+					continue
+				}
+				if !i.keepsSpread(i.versionHolders(fs, holds), from, to) {
+					continue
+				}
+				if !found || fs.Size > best.File.Size {
+					best = model.Move{File: fs, From: from, To: to}
+					found = true
+				}
+			}
+			if found {
+				return best, true
+			}
+		}
+	}
+	return model.Move{}, false
+}
+
+// replicaKey key of holds, only node, filename, version and block matter
+func (i *Index) replicaKey(id string, fs model.FileStructure) model.Replica {
+	return model.Replica{
+		Node: id,
+		File: model.FileStructure{
+			Filename: fs.Filename,
+			Version:  fs.Version,
+			Block:    fs.Block,
+		},
+	}
+}
+
+// versionHolders nodes holding version fs, or the block of it fs is, after the planned moves
+func (i *Index) versionHolders(fs model.FileStructure, holds map[model.Replica]bool) []string {
+	nodes := []string{}
+	for id := range i.numFiles {
+		if holds[i.replicaKey(id, fs)] {
+			nodes = append(nodes, id)
+		}
+	}
+	return nodes
+}
+
+// keepsSpread whether moving a copy from one holder to another node keeps it on as many failure domains
+func (i *Index) keepsSpread(holders []string, from, to string) bool {
+	before := make(map[string]bool)
+	after := make(map[string]bool)
+	for _, id := range holders {
+		before[i.zoneOf(id)] = true
+		if id != from {
+			after[i.zoneOf(id)] = true
+		}
+	}
+	after[i.zoneOf(to)] = true
+	return len(after) >= len(before)
+}
+
+// MoveReplica record a move whose copy succeeded, false if the index changed since it was planned
+func (i *Index) MoveReplica(move model.Move) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if !i.nodeHasVersion(move.From, move.File) || i.nodeHasVersion(move.To, move.File) {
+		return false
+	}
+	if _, ok := i.numFiles[move.To]; !ok {
+		return false
+	}
+
+	i.commit(model.IndexEntry{
+		Op:      model.OpMoveReplica,
+		Node:    move.From,
+		NewNode: move.To,
+		File:    move.File,
+	})
+	return true
+}
+
+func (i *Index) nodeHasVersion(id string, file model.FileStructure) bool {
+	for _, fs := range i.index.NodesToFile[id] {
+		if fs.Filename == file.Filename && fs.Version == file.Version && fs.Block == file.Block {
+			return true
+		}
+	}
+	return false
+}
+
+// HoldsReplica whether the index records node id as a holder of version file, in the namespace or in the trash
+func (i *Index) HoldsReplica(id string, file model.FileStructure) bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if i.nodeHasVersion(id, file) {
+		return true
+	}
+	fv, ok := i.trashVersion(file.Filename, file.Version)
+	if !ok {
+		return false
+	}
+	for _, replica := range versionReplicas(file.Filename, fv) {
+		if replica.Node == id && replica.File.Block == file.Block {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package index
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+
+	"CS425/CS425-MP3/model"
+)
+
+// PlanRename check that src can be renamed to dst, a directory dst means src is moved into it.
+// Return the new name and the replicas of every version of src, to link under the new name.
+// The index is not changed until RenameFile.
+func (i *Index) PlanRename(src, dst string) (string, []model.Replica, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	dst, err := i.checkRename(src, dst)
+	if err != nil {
+		return "", nil, err
+	}
+	return dst, i.replicasOf(src), nil
+}
+
+// RenameFile rename all versions of src to dst. replicas are the ones PlanRename returned,
+// an error is returned if they changed since, or dst was taken.
+func (i *Index) RenameFile(src, dst string, replicas []model.Replica) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	to, err := i.checkRename(src, dst)
+	if err != nil {
+		return err
+	}
+	if to != dst {
+		return fmt.Errorf("%s became a directory", dst)
+	}
+	if !reflect.DeepEqual(i.replicasOf(src), replicas) {
+		return fmt.Errorf("replicas of %s changed during the rename", src)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:          model.OpRenameFile,
+		File:        model.FileStructure{Filename: src},
+		NewFilename: dst,
+	})
+	return nil
+}
+
+// checkRename return the new name of src
+func (i *Index) checkRename(src, dst string) (string, error) {
+	if _, ok := i.index.Filename[src]; !ok {
+		return "", fmt.Errorf("file %s not found", src)
+	}
+	if i.isDir(dst) {
+		dst = path.Join(dst, path.Base(src))
+	}
+	if dst == src {
+		return "", fmt.Errorf("%s and %s are the same file", src, dst)
+	}
+	if _, ok := i.index.Filename[dst]; ok {
+		return "", fmt.Errorf("file %s exists", dst)
+	}
+	// the versions of dst in the trash have the same names on disk
+	if len(i.index.Trash[dst].Versions) > 0 {
+		return "", fmt.Errorf("%s is in the trash", dst)
+	}
+	err := i.checkFilePath(dst)
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// replicasOf replicas of every version of filename, sorted by node then version
+func (i *Index) replicasOf(filename string) []model.Replica {
+	replicas := []model.Replica{}
+	for _, id := range i.index.FileToNodes[filename] {
+		for _, fs := range i.index.NodesToFile[id] {
+			if fs.Filename == filename {
+				replicas = append(replicas, model.Replica{
+					Node: id,
+					File: fs,
+				})
+			}
+		}
+	}
+	sort.Slice(replicas, func(a, b int) bool {
+		if replicas[a].Node != replicas[b].Node {
+			return replicas[a].Node < replicas[b].Node
+		}
+		if replicas[a].File.Version != replicas[b].File.Version {
+			return replicas[a].File.Version < replicas[b].File.Version
+		}
+		return replicas[a].File.Block < replicas[b].File.Block
+	})
+	return replicas
+}
+
+func (i *Index) applyRenameFile(src, dst string) {
+	fs, ok := i.index.Filename[src]
+	if !ok {
+		return
+	}
+	fs.Filename = dst
+	i.index.Filename[dst] = fs
+	delete(i.index.Filename, src)
+
+	for _, fv := range i.index.Fileversions[src] {
+		i.dropContentRef(fv.Hash, src, fv.Version)
+		i.addContentRef(fv.Hash, dst, fv.Version)
+		i.chargeVersion(src, fv, -1)
+		i.chargeVersion(dst, fv, 1)
+	}
+	i.index.Fileversions[dst] = i.index.Fileversions[src]
+	delete(i.index.Fileversions, src)
+
+	for _, id := range i.index.FileToNodes[src] {
+		files := i.index.NodesToFile[id]
+		for k := range files {
+			if files[k].Filename == src {
+				files[k].Filename = dst
+			}
+		}
+	}
+	i.index.FileToNodes[dst] = i.index.FileToNodes[src]
+	delete(i.index.FileToNodes, src)
+
+	if n, ok := i.index.Replication[src]; ok {
+		i.index.Replication[dst] = n
+		delete(i.index.Replication, src)
+	}
+	if policy, ok := i.index.Retention[src]; ok {
+		i.index.Retention[dst] = policy
+		delete(i.index.Retention, src)
+	}
+	if tags, ok := i.index.Tags[src]; ok {
+		i.index.Tags[dst] = tags
+		delete(i.index.Tags, src)
+	}
+
+	i.removeChild(src)
+	i.removeName(src)
+	i.makeDirs(parentDir(dst))
+	i.addChild(dst)
+	i.addName(dst)
+}
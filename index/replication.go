@@ -0,0 +1,387 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// Replication num of replicas file should have
+func (i *Index) Replication(filename string) int {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.replication(filename)
+}
+
+func (i *Index) replication(filename string) int {
+	n, ok := i.index.Replication[filename]
+	if !ok || n <= 0 {
+		return REPLICAS
+	}
+	return n
+}
+
+// SetReplication set num of replicas of file, PlanReplication gives the copies to add or drop
+func (i *Index) SetReplication(filename string, n int) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.setReplication(filename, n)
+}
+
+func (i *Index) setReplication(filename string, n int) error {
+	if _, ok := i.index.Filename[filename]; !ok {
+		return fmt.Errorf("file %s not found", filename)
+	}
+	if n < 1 {
+		return fmt.Errorf("replication of %s should be at least 1, got %d", filename, n)
+	}
+	if i.index.Replication[filename] == n {
+		return nil
+	}
+
+	i.commit(model.IndexEntry{
+		Op:          model.OpSetReplication,
+		File:        model.FileStructure{Filename: filename},
+		Replication: n,
+	})
+	return nil
+}
+
+// PlanReplication nodes which should pull the latest version of file, and nodes which should drop
+// the file, to match its replication. For a version split into blocks every block is matched, the
+// nodes of the copies to drop of any block are returned. Nothing for an erasure-coded version, whose
+// shards are all needed. The index is not changed until AddReplicas and DropReplicas.
+func (i *Index) PlanReplication(filename string) ([]model.PullInstruction, []string) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	latest := i.getLatestFileVersion(filename)
+	holders := append([]string{}, latest.Nodes...)
+	target := i.replication(filename)
+
+	pulls := []model.PullInstruction{}
+	drops := []string{}
+	if len(holders) == 0 || isCoded(latest) {
+		return pulls, drops
+	}
+	if isSplit(latest) {
+		return i.planBlockReplication(filename, latest, target)
+	}
+
+	if len(holders) < target {
+		fs := i.index.Filename[filename]
+		for _, node := range i.placeReplicas(holders, i.getNodesWithLeastBytes(), target-len(holders), fs.Size) {
+			pulls = append(pulls, model.PullInstruction{
+				Filename: fmt.Sprintf("%s_%d", filename, fs.Version),
+				Node:     node,
+				PullFrom: append([]string{}, holders...),
+				File:     fs,
+			})
+		}
+	} else if len(holders) > target {
+		drops = i.pickDrops(holders, len(holders)-target)
+	}
+	return pulls, drops
+}
+
+// planBlockReplication pulls copying every block of the split version fv of filename which has fewer
+// than target copies, and the nodes of the copies to drop of every block which has more
+func (i *Index) planBlockReplication(filename string, fv model.FileVersion, target int) ([]model.PullInstruction, []string) {
+	// bytes planned per node, so that the pulls spread over the nodes
+	planned := make(map[string]int64)
+	pulls := []model.PullInstruction{}
+	drops := []string{}
+	for k, block := range fv.Blocks {
+		if len(block.Nodes) > target {
+			for _, id := range i.pickDrops(block.Nodes, len(block.Nodes)-target) {
+				if i.findIndex(drops, id) == -1 {
+					drops = append(drops, id)
+				}
+			}
+			continue
+		}
+		// a block without copies is lost, fsck reports it
+		if len(block.Nodes) == 0 || len(block.Nodes) == target {
+			continue
+		}
+		fs := blockFile(filename, fv, k)
+		nodes := i.getNodesWithLeastBytes()
+		sort.SliceStable(nodes, func(a, b int) bool {
+			return i.numBytes[nodes[a]]+planned[nodes[a]] < i.numBytes[nodes[b]]+planned[nodes[b]]
+		})
+		for _, node := range i.placeReplicas(block.Nodes, nodes, target-len(block.Nodes), fs.Size) {
+			planned[node] += fs.Size
+			pulls = append(pulls, model.PullInstruction{
+				Filename: VersionName(fs),
+				Node:     node,
+				PullFrom: append([]string{}, block.Nodes...),
+				File:     fs,
+			})
+		}
+	}
+	return pulls, drops
+}
+
+// AddReplicas record the pulls which succeeded, of versions in the index or of deleted ones in the
+// trash. Pulls to nodes which left the system, already hold the version or the block pulled, or of
+// versions no longer stored are skipped, as are rebuilds of shards which are no longer lost.
+func (i *Index) AddReplicas(pulls []model.PullInstruction) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	replicas := []model.Replica{}
+	trashed := []model.Replica{}
+	for _, pull := range pulls {
+		if _, ok := i.numFiles[pull.Node]; !ok {
+			continue
+		}
+		replica := model.Replica{
+			Node:  pull.Node,
+			File:  pull.File,
+			Shard: pull.Shard,
+		}
+		if fv, ok := i.findVersion(pull.File.Filename, pull.File.Version); ok {
+			if i.pullNeeded(fv, pull) {
+				replicas = append(replicas, replica)
+			}
+		} else if fv, ok := i.trashVersion(pull.File.Filename, pull.File.Version); ok {
+			if i.pullNeeded(fv, pull) {
+				trashed = append(trashed, replica)
+			}
+		}
+	}
+	if len(replicas) > 0 {
+		i.commit(model.IndexEntry{
+			Op:       model.OpAddReplicas,
+			Replicas: replicas,
+		})
+	}
+	if len(trashed) > 0 {
+		i.commit(model.IndexEntry{
+			Op:       model.OpAddTrashReplicas,
+			Replicas: trashed,
+		})
+	}
+}
+
+// pullNeeded whether pull copies fv, or the block or shard of it it names, to a node without it
+func (i *Index) pullNeeded(fv model.FileVersion, pull model.PullInstruction) bool {
+	if fv.Hash != pull.File.Hash {
+		return false
+	}
+	if isSplit(fv) {
+		if pull.File.Block < 0 || pull.File.Block >= len(fv.Blocks) || i.findIndex(fv.Blocks[pull.File.Block].Nodes, pull.Node) != -1 {
+			return false
+		}
+	} else if i.findIndex(fv.Nodes, pull.Node) != -1 {
+		return false
+	}
+	if isCoded(fv) && (pull.Shard < 0 || pull.Shard >= len(fv.Shards) || (len(pull.Rebuild) > 0 && fv.Shards[pull.Shard] != "")) {
+		return false
+	}
+	return true
+}
+
+// DropReplicas remove file from nodes, return the versions and blocks to delete from disk.
+// The last copy of an older version is kept, as are shards of erasure-coded versions, and a block of a
+// split version is only dropped while it keeps the replication of the file.
+func (i *Index) DropReplicas(filename string, nodes []string) []model.Replica {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	target := i.replication(filename)
+	// map from version to num of copies left, of each of its blocks if it is split
+	copies := make(map[int]int)
+	blockCopies := make(map[int][]int)
+	for _, fv := range i.index.Fileversions[filename] {
+		copies[fv.Version] = len(fv.Nodes)
+		if isCoded(fv) {
+			copies[fv.Version] = 0
+		}
+		for _, block := range fv.Blocks {
+			blockCopies[fv.Version] = append(blockCopies[fv.Version], len(block.Nodes))
+		}
+	}
+
+	replicas := []model.Replica{}
+	for _, node := range nodes {
+		for _, fs := range i.index.NodesToFile[node] {
+			if fs.Filename != filename {
+				continue
+			}
+			if fs.Blocks == 0 && copies[fs.Version] <= 1 {
+				continue
+			}
+			if fs.Blocks > 0 {
+				counts := blockCopies[fs.Version]
+				if fs.Block >= len(counts) || counts[fs.Block] <= target {
+					continue
+				}
+				counts[fs.Block]--
+			} else {
+				copies[fs.Version]--
+			}
+			replicas = append(replicas, model.Replica{
+				Node: node,
+				File: fs,
+			})
+		}
+	}
+	if len(replicas) == 0 {
+		return replicas
+	}
+
+	i.commit(model.IndexEntry{
+		Op:       model.OpDropReplicas,
+		Replicas: replicas,
+	})
+	return replicas
+}
+
+// pickDrops pick n of holders to drop, from the failure domains with the most copies, most loaded first
+func (i *Index) pickDrops(holders []string, n int) []string {
+	copies := make(map[string]int)
+	for _, id := range holders {
+		copies[i.zoneOf(id)]++
+	}
+
+	nodes := append([]string{}, holders...)
+	sort.Slice(nodes, func(a, b int) bool {
+		return i.numBytes[nodes[a]] > i.numBytes[nodes[b]]
+	})
+
+	dropped := []string{}
+	for len(dropped) < n {
+		worst := ""
+		for _, id := range nodes {
+			if i.findIndex(dropped, id) != -1 {
+				continue
+			}
+			if worst == "" || copies[i.zoneOf(id)] > copies[i.zoneOf(worst)] {
+				worst = id
+			}
+		}
+		if worst == "" {
+			break
+		}
+		dropped = append(dropped, worst)
+		copies[i.zoneOf(worst)]--
+	}
+	return dropped
+}
+
+// PlanReReplication pulls restoring every version of every file which def or its own policy keeps at
+// now to the replication of the file, every block of versions split into blocks, and rebuilding the
+// lost shards of erasure-coded versions. The versions which can lose the fewest more nodes go first.
+// The index is not changed until AddReplicas.
+func (i *Index) PlanReReplication(def model.RetentionPolicy, now time.Time) []model.PullInstruction {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	type deficit struct {
+		fs      model.FileStructure
+		holders []string
+		missing int
+		spare   int // nodes the version can lose and still be read
+		coded   *model.FileVersion
+	}
+	deficits := []deficit{}
+	for filename := range i.index.Filename {
+		target := i.replication(filename)
+		policy := i.retention(filename, def)
+		for rank, fv := range i.sortedVersions(filename) {
+			if isCoded(fv) {
+				left := shardsLeft(fv)
+				// too few shards to decode is lost, fsck reports it
+				if left < fv.Coding.Data || left == len(fv.Shards) || !i.retained(filename, policy, rank, fv, now) {
+					continue
+				}
+				coded := fv
+				deficits = append(deficits, deficit{
+					fs:      model.FileStructure{Version: fv.Version, Filename: filename},
+					missing: len(fv.Shards) - left,
+					spare:   left - fv.Coding.Data,
+					coded:   &coded,
+				})
+				continue
+			}
+			if isSplit(fv) {
+				if !i.retained(filename, policy, rank, fv, now) {
+					continue
+				}
+				for k, block := range fv.Blocks {
+					// a block without copies is lost, fsck reports it
+					if len(block.Nodes) == 0 || len(block.Nodes) >= target {
+						continue
+					}
+					deficits = append(deficits, deficit{
+						fs:      blockFile(filename, fv, k),
+						holders: block.Nodes,
+						missing: target - len(block.Nodes),
+						spare:   len(block.Nodes) - 1,
+					})
+				}
+				continue
+			}
+			// a version without copies is lost, fsck reports it
+			if len(fv.Nodes) == 0 || len(fv.Nodes) >= target || !i.retained(filename, policy, rank, fv, now) {
+				continue
+			}
+			deficits = append(deficits, deficit{
+				fs: model.FileStructure{
+					Version:   fv.Version,
+					Filename:  filename,
+					Hash:      fv.Hash,
+					Size:      fv.Size,
+					Timestamp: fv.Timestamp,
+				},
+				holders: fv.Nodes,
+				missing: target - len(fv.Nodes),
+				spare:   len(fv.Nodes) - 1,
+			})
+		}
+	}
+	sort.Slice(deficits, func(a, b int) bool {
+		if deficits[a].spare != deficits[b].spare {
+			return deficits[a].spare < deficits[b].spare
+		}
+		if deficits[a].missing != deficits[b].missing {
+			return deficits[a].missing > deficits[b].missing
+		}
+		if deficits[a].fs.Filename != deficits[b].fs.Filename {
+			return deficits[a].fs.Filename < deficits[b].fs.Filename
+		}
+		if deficits[a].fs.Version != deficits[b].fs.Version {
+			return deficits[a].fs.Version > deficits[b].fs.Version
+		}
+		return deficits[a].fs.Block < deficits[b].fs.Block
+	})
+
+	// bytes planned per node, so that the pulls spread over the nodes
+	planned := make(map[string]int64)
+	pulls := []model.PullInstruction{}
+	for _, d := range deficits {
+		if d.coded != nil {
+			pulls = append(pulls, i.planShardRebuilds(d.fs.Filename, *d.coded, planned)...)
+			continue
+		}
+		nodes := i.getNodesWithLeastBytes()
+		sort.SliceStable(nodes, func(a, b int) bool {
+			return i.numBytes[nodes[a]]+planned[nodes[a]] < i.numBytes[nodes[b]]+planned[nodes[b]]
+		})
+		for _, node := range i.placeReplicas(d.holders, nodes, d.missing, d.fs.Size) {
+			planned[node] += d.fs.Size
+			pulls = append(pulls, model.PullInstruction{
+				Filename: VersionName(d.fs),
+				Node:     node,
+				PullFrom: append([]string{}, d.holders...),
+				File:     d.fs,
+			})
+		}
+	}
+	return pulls
+}
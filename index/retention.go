@@ -0,0 +1,126 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// expired whether a version rank versions behind the latest and committed age ago is outside policy
+func expired(policy model.RetentionPolicy, rank int, age time.Duration) bool {
+	if policy.KeepVersions <= 0 && policy.MaxAge <= 0 {
+		return false
+	}
+	if policy.KeepVersions > 0 && rank < policy.KeepVersions {
+		return false
+	}
+	if policy.MaxAge > 0 && age < time.Duration(policy.MaxAge)*time.Second {
+		return false
+	}
+	return true
+}
+
+// retained whether version fv of filename, rank versions behind the latest, is kept at now by policy.
+// The latest version and versions in a snapshot or with a tag are always kept.
+func (i *Index) retained(filename string, policy model.RetentionPolicy, rank int, fv model.FileVersion, now time.Time) bool {
+	return rank == 0 || !expired(policy, rank, now.Sub(fv.Timestamp)) || i.isPinned(fv.Hash) || i.isTagged(filename, fv.Version)
+}
+
+// Retention retention policy of file, def if it has no override
+func (i *Index) Retention(filename string, def model.RetentionPolicy) model.RetentionPolicy {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.retention(filename, def)
+}
+
+func (i *Index) retention(filename string, def model.RetentionPolicy) model.RetentionPolicy {
+	policy, ok := i.index.Retention[filename]
+	if !ok {
+		return def
+	}
+	return policy
+}
+
+// SetRetention override the cluster-wide retention policy for file, nil drops the override
+func (i *Index) SetRetention(filename string, policy *model.RetentionPolicy) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, ok := i.index.Filename[filename]; !ok {
+		return fmt.Errorf("file %s not found", filename)
+	}
+	if policy != nil && (policy.KeepVersions < 0 || policy.MaxAge < 0) {
+		return fmt.Errorf("retention of %s should not be negative, got %+v", filename, *policy)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:        model.OpSetRetention,
+		File:      model.FileStructure{Filename: filename},
+		Retention: policy,
+	})
+	return nil
+}
+
+// PruneVersions remove versions expired at now from the index, def applies to files without
+// an override. Versions in a snapshot or with a tag are kept. Return the replicas to delete from disk,
+// one per block for versions split into blocks.
+func (i *Index) PruneVersions(def model.RetentionPolicy, now time.Time) []model.Replica {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	replicas := []model.Replica{}
+	for filename := range i.index.Filename {
+		policy := i.retention(filename, def)
+
+		versions := append([]model.FileVersion{}, i.index.Fileversions[filename]...)
+		sort.Slice(versions, func(a, b int) bool {
+			return versions[a].Version > versions[b].Version
+		})
+
+		// rank 0 is the latest version, which is always kept
+		for rank, fv := range versions {
+			if i.retained(filename, policy, rank, fv, now) {
+				continue
+			}
+			fs := model.FileStructure{
+				Version:  fv.Version,
+				Filename: filename,
+				Hash:     fv.Hash,
+				Size:     fv.Size,
+			}
+			replicas = append(replicas, versionReplicas(filename, fv)...)
+			i.commit(model.IndexEntry{
+				Op:   model.OpRemoveVersion,
+				File: fs,
+			})
+		}
+	}
+	return replicas
+}
+
+func (i *Index) applyRemoveVersion(fs model.FileStructure) {
+	if i.index.Filename[fs.Filename].Version == fs.Version {
+		return
+	}
+
+	versions := i.index.Fileversions[fs.Filename]
+	for k, fv := range versions {
+		if fv.Version != fs.Version {
+			continue
+		}
+		for _, node := range fv.Nodes {
+			i.dropReplica(model.Replica{
+				Node: node,
+				File: fs,
+			})
+		}
+		i.index.Fileversions[fs.Filename] = append(versions[:k:k], versions[k+1:]...)
+		i.dropContentRef(fv.Hash, fs.Filename, fv.Version)
+		i.chargeVersion(fs.Filename, fv, -1)
+		i.dropVersionTags(fs.Filename, fv.Version)
+		return
+	}
+}
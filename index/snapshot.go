@@ -0,0 +1,188 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// buildPins rebuild the num of snapshots referencing every content
+func (i *Index) buildPins() {
+	i.pinned = make(map[[SIZE]byte]int)
+	for _, snap := range i.index.Snapshots {
+		for _, fv := range snap.Files {
+			i.pinned[fv.Hash]++
+		}
+	}
+}
+
+// isPinned whether a snapshot references content hash, which then must stay on disk
+func (i *Index) isPinned(hash [SIZE]byte) bool {
+	return i.pinned[hash] > 0
+}
+
+// CreateSnapshot record the latest version of every file as snapshot name
+func (i *Index) CreateSnapshot(name string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("snapshot name should not be empty")
+	}
+	if _, ok := i.index.Snapshots[name]; ok {
+		return fmt.Errorf("snapshot %s exists", name)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpSnapshot,
+		File: model.FileStructure{Filename: name, Timestamp: time.Now()},
+	})
+	return nil
+}
+
+func (i *Index) applySnapshot(name string, created time.Time) {
+	snap := model.Snapshot{
+		Name:    name,
+		Created: created,
+		Files:   make(map[string]model.FileVersion, len(i.index.Filename)),
+		Dirs:    []string{},
+	}
+	for filename := range i.index.Filename {
+		fv := i.getLatestFileVersion(filename)
+		fv.Nodes = nil
+		fv.Shards = nil
+		fv.Blocks = nil
+		snap.Files[filename] = fv
+		i.pinned[fv.Hash]++
+	}
+	for dir := range i.index.Dirs {
+		snap.Dirs = append(snap.Dirs, dir)
+	}
+	sort.Strings(snap.Dirs)
+	i.index.Snapshots[name] = snap
+}
+
+// DeleteSnapshot delete snapshot name, the versions only it kept can be pruned again
+func (i *Index) DeleteSnapshot(name string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, ok := i.index.Snapshots[name]; !ok {
+		return fmt.Errorf("snapshot %s not found", name)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpDeleteSnapshot,
+		File: model.FileStructure{Filename: name},
+	})
+	return nil
+}
+
+func (i *Index) applyDeleteSnapshot(name string) {
+	for _, fv := range i.index.Snapshots[name].Files {
+		i.pinned[fv.Hash]--
+		if i.pinned[fv.Hash] <= 0 {
+			delete(i.pinned, fv.Hash)
+		}
+	}
+	delete(i.index.Snapshots, name)
+}
+
+// Snapshots summary of every snapshot, oldest first
+func (i *Index) Snapshots() []model.SnapshotInfo {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	infos := []model.SnapshotInfo{}
+	for _, snap := range i.index.Snapshots {
+		info := model.SnapshotInfo{
+			Name:    snap.Name,
+			Created: snap.Created,
+			Files:   len(snap.Files),
+		}
+		for _, fv := range snap.Files {
+			info.Bytes += fv.Size
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(a, b int) bool {
+		if !infos[a].Created.Equal(infos[b].Created) {
+			return infos[a].Created.Before(infos[b].Created)
+		}
+		return infos[a].Name < infos[b].Name
+	})
+	return infos
+}
+
+// GetSnapshot copy of snapshot name
+func (i *Index) GetSnapshot(name string) (model.Snapshot, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	snap, ok := i.index.Snapshots[name]
+	if !ok {
+		return model.Snapshot{}, fmt.Errorf("snapshot %s not found", name)
+	}
+	return copySnapshot(snap), nil
+}
+
+func copySnapshot(snap model.Snapshot) model.Snapshot {
+	files := make(map[string]model.FileVersion, len(snap.Files))
+	for k, v := range snap.Files {
+		files[k] = v
+	}
+	snap.Files = files
+	snap.Dirs = append([]string{}, snap.Dirs...)
+	return snap
+}
+
+// DiffSnapshots files which differ from snapshot from to snapshot to, or to the current namespace if to is ""
+func (i *Index) DiffSnapshots(from, to string) (model.SnapshotDiff, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	older, ok := i.index.Snapshots[from]
+	if !ok {
+		return model.SnapshotDiff{}, fmt.Errorf("snapshot %s not found", from)
+	}
+	// map from filename to its content in the newer namespace
+	newer := make(map[string][SIZE]byte)
+	if to == "" {
+		for filename, fs := range i.index.Filename {
+			newer[filename] = fs.Hash
+		}
+	} else {
+		snap, ok := i.index.Snapshots[to]
+		if !ok {
+			return model.SnapshotDiff{}, fmt.Errorf("snapshot %s not found", to)
+		}
+		for filename, fv := range snap.Files {
+			newer[filename] = fv.Hash
+		}
+	}
+
+	diff := model.SnapshotDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+	for filename, fv := range older.Files {
+		hash, ok := newer[filename]
+		if !ok {
+			diff.Removed = append(diff.Removed, filename)
+		} else if hash != fv.Hash {
+			diff.Changed = append(diff.Changed, filename)
+		}
+	}
+	for filename := range newer {
+		if _, ok := older.Files[filename]; !ok {
+			diff.Added = append(diff.Added, filename)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff, nil
+}
@@ -0,0 +1,143 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"CS425/CS425-MP3/model"
+)
+
+// SplitTag split a name "filename@tag", false if it has no tag
+func SplitTag(name string) (string, string, bool) {
+	ind := strings.LastIndex(name, "@")
+	if ind <= 0 || ind == len(name)-1 {
+		return "", "", false
+	}
+	return name[:ind], name[ind+1:], true
+}
+
+func checkTag(tag string) error {
+	if tag == "" || strings.ContainsAny(tag, "@/ ") {
+		return fmt.Errorf("tag %q should not be empty or have '@', '/' or spaces", tag)
+	}
+	return nil
+}
+
+// Tag name version of filename tag, the latest version if version is -1. A tag names one version,
+// tagging another version moves it.
+func (i *Index) Tag(filename string, version int, tag string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	err := checkTag(tag)
+	if err != nil {
+		return err
+	}
+	if _, ok := i.index.Filename[filename]; !ok {
+		return fmt.Errorf("file %s not found", filename)
+	}
+	if version == -1 {
+		version = i.getLatestVersion(filename)
+	}
+	if !i.hasVersion(model.FileStructure{Filename: filename, Version: version}) {
+		return fmt.Errorf("version %d of %s not found", version, filename)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpTag,
+		File: model.FileStructure{Filename: filename, Version: version},
+		Tag:  tag,
+	})
+	return nil
+}
+
+func (i *Index) applyTag(filename string, version int, tag string) {
+	if i.index.Tags[filename] == nil {
+		i.index.Tags[filename] = make(map[string]int)
+	}
+	i.index.Tags[filename][tag] = version
+}
+
+// Untag remove tag of filename
+func (i *Index) Untag(filename string, tag string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, ok := i.index.Tags[filename][tag]; !ok {
+		return fmt.Errorf("%s has no tag %s", filename, tag)
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpUntag,
+		File: model.FileStructure{Filename: filename},
+		Tag:  tag,
+	})
+	return nil
+}
+
+func (i *Index) applyUntag(filename string, tag string) {
+	delete(i.index.Tags[filename], tag)
+	if len(i.index.Tags[filename]) == 0 {
+		delete(i.index.Tags, filename)
+	}
+}
+
+// dropVersionTags remove the tags of a version which left the index
+func (i *Index) dropVersionTags(filename string, version int) {
+	for tag, v := range i.index.Tags[filename] {
+		if v == version {
+			i.applyUntag(filename, tag)
+		}
+	}
+}
+
+// isTagged whether a tag names version of filename, which then is never pruned
+func (i *Index) isTagged(filename string, version int) bool {
+	for _, v := range i.index.Tags[filename] {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// tagsOf tags naming version of filename, sorted
+func (i *Index) tagsOf(filename string, version int) []string {
+	tags := []string{}
+	for tag, v := range i.index.Tags[filename] {
+		if v == version {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Tags map from tag to version of every tag of filename
+func (i *Index) Tags(filename string) map[string]int {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return copyTags(i.index.Tags[filename])
+}
+
+func copyTags(tags map[string]int) map[string]int {
+	copied := make(map[string]int, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+// ResolveTag version of filename named tag
+func (i *Index) ResolveTag(filename string, tag string) (int, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	version, ok := i.index.Tags[filename][tag]
+	if !ok {
+		return -1, fmt.Errorf("%s has no tag %s", filename, tag)
+	}
+	return version, nil
+}
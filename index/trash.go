@@ -0,0 +1,317 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"CS425/CS425-MP3/model"
+)
+
+// nextVersion version a new version of filename gets, after every version it had before a delete
+func (i *Index) nextVersion(filename string) int {
+	version := 0
+	if fs, ok := i.index.Filename[filename]; ok {
+		version = fs.Version + 1
+	}
+	if tomb, ok := i.index.Trash[filename]; ok && tomb.Version >= version {
+		version = tomb.Version + 1
+	}
+	return version
+}
+
+// toTrash leave a tombstone with the versions of filename which still have replicas
+func (i *Index) toTrash(filename string, deleted time.Time) {
+	fs, ok := i.index.Filename[filename]
+	if !ok {
+		return
+	}
+
+	// versions left from an earlier delete of the same name stay undeletable
+	tomb := i.index.Trash[filename]
+	versions := append([]model.FileVersion{}, tomb.Versions...)
+	for _, fv := range i.index.Fileversions[filename] {
+		if len(fv.Nodes) == 0 {
+			continue
+		}
+		fv = copyVersion(fv)
+		versions = append(versions, fv)
+		// the content is still on disk
+		i.addContentRef(fv.Hash, filename, fv.Version)
+	}
+
+	tomb = model.Tombstone{
+		Filename:    filename,
+		Deleted:     deleted,
+		Version:     fs.Version,
+		Versions:    versions,
+		Replication: i.index.Replication[filename],
+	}
+	if policy, ok := i.index.Retention[filename]; ok {
+		tomb.Retention = &policy
+	}
+	if tags, ok := i.index.Tags[filename]; ok {
+		tomb.Tags = copyTags(tags)
+	}
+	i.index.Trash[filename] = tomb
+}
+
+// Trash deleted files which can still be undeleted, sorted by name
+func (i *Index) Trash() []model.Tombstone {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	trash := []model.Tombstone{}
+	for _, tomb := range i.index.Trash {
+		if len(tomb.Versions) == 0 {
+			continue
+		}
+		trash = append(trash, copyTombstone(tomb))
+	}
+	sort.Slice(trash, func(a, b int) bool {
+		return trash[a].Filename < trash[b].Filename
+	})
+	return trash
+}
+
+func copyTombstone(tomb model.Tombstone) model.Tombstone {
+	versions := make([]model.FileVersion, 0, len(tomb.Versions))
+	for _, fv := range tomb.Versions {
+		fv = copyVersion(fv)
+		versions = append(versions, fv)
+	}
+	tomb.Versions = versions
+	if tomb.Tags != nil {
+		tomb.Tags = copyTags(tomb.Tags)
+	}
+	if tomb.Retention != nil {
+		policy := *tomb.Retention
+		tomb.Retention = &policy
+	}
+	return tomb
+}
+
+// Undelete restore filename from the trash with the versions which still have replicas
+func (i *Index) Undelete(filename string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	tomb, ok := i.index.Trash[filename]
+	if !ok || len(tomb.Versions) == 0 {
+		return fmt.Errorf("%s is not in the trash", filename)
+	}
+	if _, ok := i.index.Filename[filename]; ok {
+		return fmt.Errorf("file %s exists", filename)
+	}
+	err := i.checkFilePath(filename)
+	if err != nil {
+		return err
+	}
+
+	i.commit(model.IndexEntry{
+		Op:   model.OpUndelete,
+		File: model.FileStructure{Filename: filename},
+	})
+	return nil
+}
+
+func (i *Index) applyUndelete(filename string) {
+	tomb, ok := i.index.Trash[filename]
+	if !ok {
+		return
+	}
+
+	versions := append([]model.FileVersion{}, tomb.Versions...)
+	sort.Slice(versions, func(a, b int) bool {
+		return versions[a].Version < versions[b].Version
+	})
+	for _, fv := range versions {
+		meta := fv.Meta
+		nodes, coding, blocks := layout(fv)
+		i.applyAddFile(model.FileStructure{
+			Version:   fv.Version,
+			Filename:  filename,
+			Hash:      fv.Hash,
+			Size:      fv.Size,
+			Timestamp: fv.Timestamp,
+		}, &meta, nodes, coding, blocks)
+	}
+	if tomb.Replication > 0 {
+		i.index.Replication[filename] = tomb.Replication
+	}
+	if tomb.Retention != nil {
+		i.index.Retention[filename] = *tomb.Retention
+	}
+	for tag, version := range tomb.Tags {
+		if i.hasVersion(model.FileStructure{Filename: filename, Version: version}) {
+			i.applyTag(filename, version, tag)
+		}
+	}
+
+	// a lost latest version may still have stale replicas
+	if i.index.Filename[filename].Version < tomb.Version {
+		tomb.Versions = nil
+		i.index.Trash[filename] = tomb
+	} else {
+		delete(i.index.Trash, filename)
+	}
+}
+
+// PlanPurge replicas of the files deleted at least retention before now, but not of versions in a
+// snapshot, one per block for versions split into blocks. The index is not changed.
+func (i *Index) PlanPurge(retention time.Duration, now time.Time) []model.Replica {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	replicas := []model.Replica{}
+	for filename, tomb := range i.index.Trash {
+		if now.Sub(tomb.Deleted) < retention {
+			continue
+		}
+		for _, fv := range tomb.Versions {
+			if i.isPinned(fv.Hash) {
+				continue
+			}
+			replicas = append(replicas, versionReplicas(filename, fv)...)
+		}
+	}
+	sort.Slice(replicas, func(a, b int) bool {
+		if replicas[a].File.Filename != replicas[b].File.Filename {
+			return replicas[a].File.Filename < replicas[b].File.Filename
+		}
+		if replicas[a].File.Version != replicas[b].File.Version {
+			return replicas[a].File.Version < replicas[b].File.Version
+		}
+		if replicas[a].File.Block != replicas[b].File.Block {
+			return replicas[a].File.Block < replicas[b].File.Block
+		}
+		return replicas[a].Node < replicas[b].Node
+	})
+	return replicas
+}
+
+// Purge drop replicas deleted from their nodes from the trash, they can no longer be undeleted.
+// The tombstones stay so that a replica whose delete failed is never taken back.
+func (i *Index) Purge(replicas []model.Replica) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if len(replicas) == 0 {
+		return
+	}
+	i.commit(model.IndexEntry{
+		Op:       model.OpPurge,
+		Replicas: replicas,
+	})
+}
+
+func (i *Index) applyPurge(replicas []model.Replica) {
+	for _, replica := range replicas {
+		tomb, ok := i.index.Trash[replica.File.Filename]
+		if !ok {
+			continue
+		}
+		for k := range tomb.Versions {
+			if tomb.Versions[k].Version != replica.File.Version {
+				continue
+			}
+			if replica.File.Blocks > 0 {
+				i.dropBlock(&tomb.Versions[k], replica.File.Block, replica.Node)
+				continue
+			}
+			tomb.Versions[k].Nodes = i.without(tomb.Versions[k].Nodes, replica.Node)
+			dropShard(&tomb.Versions[k], replica.Node)
+		}
+		i.setTomb(i.withReplicas(tomb))
+	}
+}
+
+// trashVersion version of deleted filename in the trash
+func (i *Index) trashVersion(filename string, version int) (model.FileVersion, bool) {
+	for _, fv := range i.index.Trash[filename].Versions {
+		if fv.Version == version {
+			return fv, true
+		}
+	}
+	return model.FileVersion{}, false
+}
+
+func (i *Index) applyAddTrashReplicas(replicas []model.Replica) {
+	for _, replica := range replicas {
+		tomb, ok := i.index.Trash[replica.File.Filename]
+		if !ok {
+			continue
+		}
+		for k := range tomb.Versions {
+			fv := &tomb.Versions[k]
+			if fv.Version != replica.File.Version {
+				continue
+			}
+			if isSplit(*fv) {
+				if replica.File.Block < 0 || replica.File.Block >= len(fv.Blocks) {
+					continue
+				}
+				block := &fv.Blocks[replica.File.Block]
+				if i.findIndex(block.Nodes, replica.Node) == -1 {
+					block.Nodes = append(block.Nodes, replica.Node)
+				}
+			}
+			if i.findIndex(fv.Nodes, replica.Node) == -1 {
+				fv.Nodes = append(fv.Nodes, replica.Node)
+				if isCoded(*fv) && replica.Shard >= 0 && replica.Shard < len(fv.Shards) {
+					fv.Shards[replica.Shard] = replica.Node
+				}
+			}
+		}
+	}
+}
+
+// dropTrashNode forget the deleted replicas on a node which left the system
+func (i *Index) dropTrashNode(id string) {
+	for _, tomb := range i.index.Trash {
+		if len(tomb.Versions) == 0 {
+			continue
+		}
+		for k := range tomb.Versions {
+			tomb.Versions[k].Nodes = i.without(tomb.Versions[k].Nodes, id)
+			dropShard(&tomb.Versions[k], id)
+			i.dropBlockNode(&tomb.Versions[k], id)
+		}
+		i.setTomb(i.withReplicas(tomb))
+	}
+}
+
+func (i *Index) renameTrashNode(oldID, newID string) {
+	for _, tomb := range i.index.Trash {
+		for k, fv := range tomb.Versions {
+			if ind := i.findIndex(fv.Nodes, oldID); ind != -1 {
+				fv.Nodes[ind] = newID
+			}
+			renameShard(&tomb.Versions[k], oldID, newID)
+			i.renameBlockNode(&tomb.Versions[k], oldID, newID)
+		}
+	}
+}
+
+// setTomb store tomb, once none of its versions is left only its name and latest version are kept,
+// new versions still come after it and stale replicas are still known as deleted
+func (i *Index) setTomb(tomb model.Tombstone) {
+	if len(tomb.Versions) == 0 {
+		tomb = model.Tombstone{Filename: tomb.Filename, Version: tomb.Version}
+	}
+	i.index.Trash[tomb.Filename] = tomb
+}
+
+// withReplicas tomb with only the versions which still have replicas, nil if none
+func (i *Index) withReplicas(tomb model.Tombstone) model.Tombstone {
+	var kept []model.FileVersion
+	for _, fv := range tomb.Versions {
+		if len(fv.Nodes) > 0 {
+			kept = append(kept, fv)
+		} else {
+			i.dropContentRef(fv.Hash, tomb.Filename, fv.Version)
+		}
+	}
+	tomb.Versions = kept
+	return tomb
+}
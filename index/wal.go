@@ -0,0 +1,156 @@
+package index
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"CS425/CS425-MP3/model"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "wal.log"
+	// default num of log entries between snapshots
+	defaultSnapshotInterval = 100
+)
+
+// snapshot compacted state of the index written to disk
+type snapshot struct {
+	Index model.GlobalIndexFile
+	// map from node to num of files on the node
+	NumFiles map[string]int
+}
+
+// WAL write-ahead log of index changes plus periodic snapshots
+type WAL struct {
+	dir      string
+	interval int
+	file     *os.File
+	// num of entries appended since last snapshot
+	entries int
+	// seq of last snapshot
+	seq int64
+}
+
+// OpenWAL open or create the log under dir
+func OpenWAL(dir string, interval int) (*WAL, error) {
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WAL{
+		dir:      dir,
+		interval: interval,
+		file:     f,
+	}, nil
+}
+
+// Append write entry to the log and flush it to disk
+func (w *WAL) Append(entry model.IndexEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	_, err = w.file.Write(buf)
+	if err != nil {
+		return err
+	}
+	w.entries++
+	return w.file.Sync()
+}
+
+func (w *WAL) needSnapshot() bool {
+	return w.entries >= w.interval
+}
+
+// Snapshot write snap to disk and truncate the log
+func (w *WAL) Snapshot(snap snapshot) error {
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(w.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// rename is atomic, a crash leaves either the old or the new snapshot
+	err = os.Rename(tmp, filepath.Join(w.dir, snapshotFile))
+	if err != nil {
+		return err
+	}
+
+	// entries up to snap.Index.Seq are in the snapshot now
+	err = w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	w.entries = 0
+	w.seq = snap.Index.Seq
+	return nil
+}
+
+// load read the last snapshot and the entries logged after it
+func (w *WAL) load() (snapshot, []model.IndexEntry, error) {
+	snap := snapshot{}
+	buf, err := ioutil.ReadFile(filepath.Join(w.dir, snapshotFile))
+	if err == nil {
+		err = json.Unmarshal(buf, &snap)
+		if err != nil {
+			return snap, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return snap, nil, err
+	}
+
+	_, err = w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return snap, nil, err
+	}
+
+	entries := []model.IndexEntry{}
+	dec := json.NewDecoder(w.file)
+	for {
+		var entry model.IndexEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// torn write at the tail, the rest of the log is lost
+			log.Printf("WAL: stop replay after %d entries: %v", len(entries), err)
+			break
+		}
+		if entry.Seq <= snap.Index.Seq {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	w.seq = snap.Index.Seq
+	return snap, entries, nil
+}
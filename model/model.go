@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 // SIZE md5 size
 const SIZE = 16
 
@@ -13,18 +15,198 @@ type RPCFile struct {
 type RPCAddFileArgs struct {
 	Filename string
 	MD5      [SIZE]byte
+	Size     int64
+	Replicas int // num of replicas, 0 keeps the current or default setting
+	Meta     FileMeta
+}
+
+// RPCStatArgs args
+type RPCStatArgs struct {
+	Filename string
+	Version  int // -1 for the latest version
+}
+
+// FileStat metadata of one version of a file
+type FileStat struct {
+	Filename  string
+	Version   int
+	Hash      [SIZE]byte
+	Size      int64
+	Timestamp time.Time
+	Meta      FileMeta
+	Nodes     []string
+	Refs      int      // num of versions sharing the content, stored once per node
+	Tags      []string // tags naming the version
+	Coding    Coding
+	Shards    []string // node holding each shard of an erasure-coded version, "" if lost
+	Blocks    []Block  // blocks of a version split into blocks
+}
+
+// RPCTagArgs args
+type RPCTagArgs struct {
+	Filename string
+	Version  int // -1 for the latest version, not used to untag
+	Tag      string
+}
+
+// RPCSetReplicationArgs args
+type RPCSetReplicationArgs struct {
+	Filename string
+	Replicas int
+}
+
+// RPCSetCodingArgs args
+type RPCSetCodingArgs struct {
+	Name   string // file, or directory whose files below it use Coding
+	Coding Coding
+	Clear  bool // drop the setting, new versions are stored as set above Name or as full replicas
+}
+
+// RPCRebuildShardArgs args
+type RPCRebuildShardArgs struct {
+	Filename string // replica file name of the version, "filename_version"
+	Coding   Coding
+	Shard    int      // shard to rebuild
+	Shards   []string // node holding each shard, "" if lost
+}
+
+// RPCSetRetentionArgs args
+type RPCSetRetentionArgs struct {
+	Filename string
+	Policy   RetentionPolicy
+	Clear    bool // drop the override, the cluster-wide policy applies again
+}
+
+// RPCRebalanceArgs args
+type RPCRebalanceArgs struct {
+	DryRun bool // only plan the moves
+}
+
+// RPCFsckArgs args
+type RPCFsckArgs struct {
+	Repair bool // rebuild the index from the replicas found and delete orphan files
+}
+
+// RPCFsckReply reply
+type RPCFsckReply struct {
+	Problems []string
+	Repaired bool
+}
+
+// RPCPullIndexEntriesReply reply, Index is set instead of Entries if the changes are no longer kept
+type RPCPullIndexEntriesReply struct {
+	Entries []IndexEntry
+	Index   *GlobalIndexFile
+}
+
+// RPCMoveFileArgs args
+type RPCMoveFileArgs struct {
+	Src string
+	Dst string // new path, or a directory to move Src into
+}
+
+// RPCLinkFileArgs args
+type RPCLinkFileArgs struct {
+	From string
+	To   string
+}
+
+// RPCListDirArgs args
+type RPCListDirArgs struct {
+	Dir       string
+	Recursive bool // list the subdirectories too
+}
+
+// DirEntry file or directory in a listing
+type DirEntry struct {
+	Name    string // full path
+	IsDir   bool
+	Version int // latest version of a file
+	Size    int64
+}
+
+// RPCListAllArgs args
+type RPCListAllArgs struct {
+	Pattern string // glob, or prefix if it has no glob characters, "" for all files
+	After   string // list files after this name, "" for the first page
+	Limit   int    // max num of files in the page
+}
+
+// RPCListAllReply reply
+type RPCListAllReply struct {
+	Files []FileInfo
+	Next  string // After of the next page, "" if this is the last page
+}
+
+// FileInfo latest version of a file in a listing
+type FileInfo struct {
+	Filename string
+	Version  int
+	Size     int64
+	Replicas int // num of nodes holding the latest version
+}
+
+// RPCDiffSnapshotsArgs args
+type RPCDiffSnapshotsArgs struct {
+	From string
+	To   string // "" for the current namespace
+}
+
+// RPCRestoreSnapshotArgs args
+type RPCRestoreSnapshotArgs struct {
+	Snapshot string
+	Filename string // "" to restore the whole namespace, files added since are moved to the trash
 }
 
 // RPCFilenameWithReplica reply
 type RPCFilenameWithReplica struct {
 	Filename    string
 	ReplicaList []string
+	Stored      bool   // a put whose content ReplicaList already holds, nothing to push
+	Coding      Coding // set if the version is erasure-coded, ReplicaList then holds the node of each shard, "" if lost
+	Size        int64
+	Blocks      []Block // set if the version is split into blocks, each is pushed to and pulled from its own nodes
 }
 
 // RPCGetLatestVersionsArgs args
 type RPCGetLatestVersionsArgs struct {
 	Filename string
 	Versions int
+	Since    time.Time // zero for no lower bound on the commit time
+	Until    time.Time // zero for no upper bound on the commit time
+}
+
+// RPCDiffArgs args, versions are -1 for the latest
+type RPCDiffArgs struct {
+	Filename string
+	From     int
+	To       int
+}
+
+// ByteRange Length bytes from Offset
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// RPCDiffReply reply, a unified diff of text versions or the changed byte ranges of binary ones
+type RPCDiffReply struct {
+	Filename    string
+	From        int
+	To          int
+	Node        string // node which compared the versions
+	Binary      bool
+	Diff        string
+	FromSize    int64
+	ToSize      int64
+	Ranges      []ByteRange
+	TotalRanges int // num of changed ranges, Ranges may hold only the first of them
+}
+
+// RPCGetFileAsOfArgs args
+type RPCGetFileAsOfArgs struct {
+	Filename string
+	AsOf     time.Time
 }
 
 // RPCGetLatestVersionsReply reply
@@ -32,6 +214,11 @@ type RPCGetLatestVersionsReply struct {
 	Filename    string
 	Version     int
 	ReplicaList []string
+	Timestamp   time.Time
+	Replication int    // num of replicas the version should have
+	Coding      Coding // set if the version is erasure-coded, ReplicaList then holds the node of each shard, "" if lost
+	Size        int64
+	Blocks      []Block // set if the version is split into blocks
 }
 
 // RPCResult Result for rpc
@@ -50,12 +237,72 @@ type RPCPullFileFromArgs struct {
 
 // NodeConfig Structure of node config
 type NodeConfig struct {
-	IP              string `json:"ip"`
-	Port            int    `json:"port"`
-	LogPath         string `json:"log_path"`
-	FilePath        string `json:"file_path"`
-	SleepTime       int    `json:"sleep_time"`        // Millisecond
-	PullFileTimeout int    `json:"pull_file_timeout"` // Millisecond
+	IP                string `json:"ip"`
+	Port              int    `json:"port"`
+	LogPath           string `json:"log_path"`
+	FilePath          string `json:"file_path"`
+	SleepTime         int    `json:"sleep_time"`         // Millisecond
+	PullFileTimeout   int    `json:"pull_file_timeout"`  // Millisecond
+	SnapshotInterval  int    `json:"snapshot_interval"`  // num of log entries between index snapshots
+	Zone              string `json:"zone"`               // failure domain (rack, host, zone) of the node
+	KeepVersions      int    `json:"keep_versions"`      // cluster-wide retention, 0 for no limit
+	VersionMaxAge     int    `json:"version_max_age"`    // Second, cluster-wide retention, 0 for no limit
+	GCInterval        int    `json:"gc_interval"`        // Millisecond
+	RebalanceInterval int    `json:"rebalance_interval"` // Millisecond
+	RebalanceMoves    int    `json:"rebalance_moves"`    // max num of replicas moved per rebalance round
+	DeltaLogSize      int    `json:"delta_log_size"`     // num of index changes kept for followers to catch up
+	TrashRetention    int    `json:"trash_retention"`    // Second, how long deleted files can be undeleted
+	RejoinTimeout     int    `json:"rejoin_timeout"`     // Millisecond, how long nodes of the index have to rejoin after a restart
+}
+
+// Quota limits on what Identity uploaded under Prefix. Each version kept counts toward its uploader,
+// with the files having one, a limit of 0 is no limit.
+type Quota struct {
+	Identity string // uploader identity, user@host, "" for any
+	Prefix   string // directory, "" for the whole namespace
+	MaxBytes int64
+	MaxFiles int
+}
+
+// QuotaUsage a quota and what is used of it
+type QuotaUsage struct {
+	Quota
+	Bytes int64
+	Files int
+}
+
+// states of a decommission
+const (
+	DecommissionDraining = "draining"
+	DecommissionLeaving  = "leaving"
+	DecommissionDone     = "done"
+	DecommissionFailed   = "failed"
+)
+
+// DecommissionStatus progress of draining a node before it leaves the group
+type DecommissionStatus struct {
+	Node    string
+	State   string
+	Started time.Time
+	Copies  int // replicas planned to be copied to other nodes so far
+	Copied  int
+	Failed  int // pulls which failed and were planned again
+	Error   string
+}
+
+// RetentionPolicy which versions of a file to keep, the latest version is always kept.
+// A version is kept if it is within any limit which is set.
+type RetentionPolicy struct {
+	KeepVersions int // keep the last KeepVersions versions, 0 for no limit
+	MaxAge       int // Second, keep versions newer than MaxAge, 0 for no limit
+}
+
+// NodeInfo info a node reports about itself to the master
+type NodeInfo struct {
+	ID        string
+	Zone      string
+	UsedBytes int64 // disk space used on the file system of FilePath
+	FreeBytes int64 // disk space left on the file system of FilePath
 }
 
 // GlobalIndexFile contain maps which will give node->file and file->node mappings
@@ -64,17 +311,51 @@ type NodeConfig struct {
 // 	Nodes map[string][]string
 // }
 
+// Coding Reed-Solomon layout of a version, Data data shards and Parity parity shards on as many nodes,
+// any Data of which rebuild the content. The zero Coding stores full replicas.
+type Coding struct {
+	Data   int
+	Parity int
+}
+
+// FileMeta who put a version and what it holds, set at put time
+type FileMeta struct {
+	Uploader    string // identity of the uploading client, user@host
+	ContentType string
+	Attributes  map[string]string // user key/value attributes
+}
+
 type FileVersion struct {
 	// nodes with that version
-	Version int
-	Nodes   []string
-	Hash    [SIZE]byte
+	Version   int
+	Nodes     []string
+	Hash      [SIZE]byte
+	Size      int64
+	Timestamp time.Time // when the version was committed
+	Meta      FileMeta
+	Coding    Coding
+	// node holding each shard of an erasure-coded version, "" if lost. Nodes holds these and may hold
+	// copies of shards which moved away until they are dropped
+	Shards []string
+	// blocks of a version split into blocks in order, nil if it is stored whole. Nodes then holds every
+	// node with a replica of any block
+	Blocks []Block
+}
+
+// Block a piece of a version split into blocks, every block but the last has the size of the first
+type Block struct {
+	Size  int64
+	Nodes []string // nodes with a replica of the block
 }
 
 type FileStructure struct {
-	Version  int
-	Filename string
-	Hash     [SIZE]byte
+	Version   int
+	Filename  string
+	Hash      [SIZE]byte
+	Size      int64
+	Timestamp time.Time
+	Blocks    int // num of blocks the version is split into, 0 if it is stored whole
+	Block     int // block of the version a replica holds, if it is split
 }
 
 type GlobalIndexFile struct {
@@ -86,10 +367,177 @@ type GlobalIndexFile struct {
 	NodesToFile map[string][]FileStructure
 	// map from filename to list of nodes with the file
 	FileToNodes map[string][]string
+	// map from node ID to its failure domain
+	NodeZones map[string]string
+	// map from filename to its num of replicas if not the default
+	Replication map[string]int
+	// map from filename to its retention policy if not the cluster-wide one
+	Retention map[string]RetentionPolicy
+	// map from file or directory to the erasure coding of new versions of the files at or below it
+	Coding map[string]Coding
+	// directories other than the root, made by mkdir or by adding a file under them
+	Dirs map[string]bool
+	// map from deleted filename to its tombstone
+	Trash map[string]Tombstone
+	// map from name to snapshot of the namespace
+	Snapshots map[string]Snapshot
+	// map from filename to its tags, each naming one of its versions
+	Tags map[string]map[string]int
+	// quotas sorted by identity and prefix
+	Quotas []Quota
+	// nodes being decommissioned, no new replicas are placed on them
+	Draining map[string]bool
+	// sequence number of the last change applied
+	Seq int64
+	// hash of the changes up to Seq, which tells indexes with the same Seq but another history apart
+	Hash [SIZE]byte
+}
+
+// IndexPosition last change applied to an index
+type IndexPosition struct {
+	Seq  int64
+	Hash [SIZE]byte
+}
+
+// Tombstone a deleted file. Its versions stay on their nodes until purged, the tombstone itself
+// is kept after that so that stale replicas of the deleted versions are never taken back.
+type Tombstone struct {
+	Filename    string
+	Deleted     time.Time
+	Version     int           // latest version when deleted, new versions of Filename come after it
+	Versions    []FileVersion // versions which can still be undeleted, none once purged
+	Replication int           // 0 if the file had the default num of replicas
+	Retention   *RetentionPolicy
+	Tags        map[string]int
+}
+
+// Snapshot the namespace at a point in time. The content of its versions is kept by retention,
+// garbage collection and trash purges until the snapshot is deleted.
+type Snapshot struct {
+	Name    string
+	Created time.Time
+	Files   map[string]FileVersion // latest version of every file, without its nodes
+	Dirs    []string
+}
+
+// SnapshotInfo summary of a snapshot in a listing
+type SnapshotInfo struct {
+	Name    string
+	Created time.Time
+	Files   int
+	Bytes   int64
+}
+
+// SnapshotDiff files which differ between two snapshots, sorted
+type SnapshotDiff struct {
+	Added   []string // only in the newer one
+	Removed []string // only in the older one
+	Changed []string // in both with different content
+}
+
+// Move copy File from node From to node To, then drop it from From
+type Move struct {
+	File FileStructure
+	From string
+	To   string
 }
 
 type PullInstruction struct {
 	Filename string
 	Node     string
 	PullFrom []string // IDs with file
+	File     FileStructure
+	Shard    int      // shard pulled, for an erasure-coded version
+	Coding   Coding   // set to rebuild a lost shard of an erasure-coded version instead of copying it
+	Rebuild  []string // node holding each shard when the shard is rebuilt, "" if lost
+}
+
+// IndexOp kind of change to the index
+type IndexOp string
+
+const (
+	// OpAddNode node joined
+	OpAddNode IndexOp = "add-node"
+	// OpRemoveNode node failed with its replicas, older logs carry the re-replicated files in Replicas
+	OpRemoveNode IndexOp = "remove-node"
+	// OpRenameNode node rejoined with a new ID
+	OpRenameNode IndexOp = "rename-node"
+	// OpDrain Node is being decommissioned, no new replicas are placed on it
+	OpDrain IndexOp = "drain"
+	// OpUndrain Node takes new replicas again
+	OpUndrain IndexOp = "undrain"
+	// OpSetZone Node reported its failure domain Zone
+	OpSetZone IndexOp = "set-zone"
+	// OpSetReplication File should have Replication replicas
+	OpSetReplication IndexOp = "set-replication"
+	// OpAddReplicas Replicas copied to their nodes
+	OpAddReplicas IndexOp = "add-replicas"
+	// OpDropReplicas Replicas removed from their nodes
+	OpDropReplicas IndexOp = "drop-replicas"
+	// OpSetRetention File uses Retention, or the cluster-wide policy if nil
+	OpSetRetention IndexOp = "set-retention"
+	// OpRemoveVersion version File.Version of File removed from the index
+	OpRemoveVersion IndexOp = "remove-version"
+	// OpMoveReplica File copied from Node to NewNode and dropped from Node
+	OpMoveReplica IndexOp = "move-replica"
+	// OpRepair maps rebuilt by fsck so that exactly Replicas are stored
+	OpRepair IndexOp = "repair"
+	// OpAddFile new version of File with Meta stored on Nodes
+	OpAddFile IndexOp = "add-file"
+	// OpRemoveFile all versions of File moved to the trash at File.Timestamp
+	OpRemoveFile IndexOp = "remove-file"
+	// OpUndelete File.Filename restored from the trash
+	OpUndelete IndexOp = "undelete"
+	// OpPurge Replicas of deleted files removed from their nodes
+	OpPurge IndexOp = "purge"
+	// OpAddTrashReplicas Replicas of deleted files copied to their nodes
+	OpAddTrashReplicas IndexOp = "add-trash-replicas"
+	// OpSnapshot snapshot File.Filename of the namespace taken at File.Timestamp
+	OpSnapshot IndexOp = "snapshot"
+	// OpDeleteSnapshot snapshot File.Filename deleted
+	OpDeleteSnapshot IndexOp = "delete-snapshot"
+	// OpTag version File.Version of File.Filename tagged Tag, which leaves any other version
+	OpTag IndexOp = "tag"
+	// OpUntag Tag of File.Filename removed
+	OpUntag IndexOp = "untag"
+	// OpMkdir directory File.Filename and its parents made
+	OpMkdir IndexOp = "mkdir"
+	// OpRmdir empty directory File.Filename removed
+	OpRmdir IndexOp = "rmdir"
+	// OpRenameFile all versions of File.Filename renamed to NewFilename
+	OpRenameFile IndexOp = "rename-file"
+	// OpSetQuota Quota set for its identity and prefix, a Quota without limits removed
+	OpSetQuota IndexOp = "set-quota"
+	// OpSetCoding new versions of the files at or below File.Filename stored with Coding, the setting
+	// removed if nil
+	OpSetCoding IndexOp = "set-coding"
+)
+
+// Replica a file version placed on a node
+type Replica struct {
+	Node  string
+	File  FileStructure
+	Shard int // shard the node holds, for an erasure-coded version
+}
+
+// IndexEntry one change to the GlobalIndexFile, as written to the log
+type IndexEntry struct {
+	Seq         int64
+	Prev        [SIZE]byte // Hash of the index the change applies to
+	Hash        [SIZE]byte // Hash of the index after the change
+	Op          IndexOp
+	Node        string
+	NewNode     string
+	Zone        string
+	Replication int
+	Retention   *RetentionPolicy
+	File        FileStructure
+	NewFilename string
+	Meta        *FileMeta
+	Tag         string
+	Quota       *Quota
+	Coding      *Coding // for OpAddFile, Nodes then hold the shards in order
+	Blocks      []Block // for OpAddFile of a version split into blocks
+	Nodes       []string
+	Replicas    []Replica
 }
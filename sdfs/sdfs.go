@@ -14,24 +14,67 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	failureDetector "CS425/CS425-MP2/server"
+	"CS425/CS425-MP3/diff"
+	"CS425/CS425-MP3/erasure"
 	SDFSIndex "CS425/CS425-MP3/index"
 	"CS425/CS425-MP3/model"
 )
 
+const (
+	// default interval of garbage collection of expired versions, Millisecond
+	defaultGCInterval = 60000
+	// default interval of rebalance rounds, Millisecond
+	defaultRebalanceInterval = 30000
+	// default max num of replicas moved per rebalance round
+	defaultRebalanceMoves = 10
+	// default time deleted files stay in the trash, Second
+	defaultTrashRetention = 86400
+	// default time nodes of a replayed or pulled index have to rejoin before they are removed, Millisecond
+	defaultRejoinTimeout = 30000
+	// max num of changed byte ranges sent back for a diff of binary versions
+	maxDiffRanges = 1000
+	// first wait before re-replication retries failed pulls, Millisecond, doubled up to maxReReplicateBackoff
+	reReplicateBackoff    = 1000
+	maxReReplicateBackoff = 60000
+	// rounds of copying a draining node tries before the decommission fails
+	maxDrainRounds = 10
+	// messageLeave type of the failure detector message which makes a node leave the group
+	messageLeave = 4
+)
+
 // SDFS SDFS class
 type SDFS struct {
-	config          model.NodeConfig
+	config model.NodeConfig
+	// guards sortedMemList and master
+	memLock         sync.RWMutex
 	sortedMemList   []string // ["id-ts", ...]
+	clientsLock     sync.Mutex
 	nodesRPCClients map[string]*rpc.Client
 	failureDetector *failureDetector.Server
 	master          string
 	id              string
 	filePath        string
-	index           SDFSIndex.Index
+	index           *SDFSIndex.Index
+	wal             *SDFSIndex.WAL
+	followersLock   sync.Mutex
+	// map from follower to the position of the last index change it applied
+	followerPositions map[string]model.IndexPosition
+	// guards reReplicating and reReplicateAgain
+	reReplicateLock sync.Mutex
+	reReplicating   bool
+	// failures or joins happened during a re-replication, which plans again
+	reReplicateAgain bool
+	// guards decommissions
+	decommissionsLock sync.Mutex
+	// map from node to the progress of its decommission, kept after it ends
+	decommissions map[string]model.DecommissionStatus
 }
 
 // NewSDFS init a SDFS
@@ -52,27 +95,40 @@ func (s *SDFS) init(sdfsConfig []byte, failureDetectorConfig []byte) {
 	s.id = s.failureDetector.GetID()
 	s.master = s.id
 	s.nodesRPCClients = map[string]*rpc.Client{}
+	s.index = SDFSIndex.NewIndex()
+	s.index.SetMaxDeltas(s.config.DeltaLogSize)
+	s.followerPositions = map[string]model.IndexPosition{}
+	s.decommissions = map[string]model.DecommissionStatus{}
+
+	wal, err := SDFSIndex.OpenWAL(s.filePath+".index", s.config.SnapshotInterval)
+	if err != nil {
+		log.Printf("init: open index log failed: %v", err)
+	}
+	s.wal = wal
 }
 
+// reElect the caller holds memLock
 func (s *SDFS) reElect() error {
 	s.master = s.sortedMemList[0]
 	return nil
 }
 
 func (s *SDFS) initIndex() error {
+	s.memLock.Lock()
 	s.sortedMemList = s.failureDetector.GetMemberList()
+	s.memLock.Unlock()
+	s.loadIndex()
 	if s.isMaster() {
-		if len(s.sortedMemList) > 1 {
-			err := s.pullIndex(s.sortedMemList[1])
+		if memList := s.getMemberList(); len(memList) > 1 {
+			err := s.pullIndex(memList[1])
 			if err != nil {
 				return err
 			}
 		} else {
-			s.index = SDFSIndex.NewIndex()
-			s.index.AddNewNode(s.id)
+			s.addNode(s.id)
 		}
 	} else {
-		err := s.pullIndex(s.master)
+		err := s.pullIndex(s.getMaster())
 		if err != nil {
 			return err
 		}
@@ -80,44 +136,117 @@ func (s *SDFS) initIndex() error {
 	return nil
 }
 
+// loadIndex replay the index persisted on disk, before asking peers for theirs
+func (s *SDFS) loadIndex() {
+	if s.wal == nil {
+		return
+	}
+
+	err := s.index.Replay(s.wal)
+	if err != nil {
+		log.Printf("loadIndex: replay index log failed: %v", err)
+	}
+	log.Printf("loadIndex: replayed index up to seq %d", s.index.Seq())
+}
+
 func (s *SDFS) getLogPath() string {
 	return s.config.LogPath
 }
 
+// pullIndex catch up with the index of nodeID from the local position, the whole index is pulled if needed
 func (s *SDFS) pullIndex(nodeID string) error {
 	client, err := s.getRPCClient(nodeID)
 	if err != nil {
 		return err
 	}
 
-	globalIndex := &model.GlobalIndexFile{}
-	err = client.Call("SDFS.RPCPullIndex", &nodeID, &globalIndex)
+	pos := s.index.Position()
+	reply := model.RPCPullIndexEntriesReply{}
+	err = client.Call("SDFS.RPCPullIndexEntries", &pos, &reply)
 	if err != nil {
 		return err
 	}
 
-	s.index = SDFSIndex.LoadFromGlobalIndexFile(*globalIndex)
-	return nil
+	if reply.Index == nil {
+		return s.index.ApplyEntries(reply.Entries)
+	}
+
+	if s.isMaster() && reply.Index.Seq < pos.Seq {
+		log.Printf("pullIndex: index of %v is behind the local one, keep local", nodeID)
+		return nil
+	}
+
+	return s.index.Reset(*reply.Index)
 }
 
+// pushIndex send nodeID the index changes it has not applied, the whole index if they are no longer kept
+// or its history differs from the local one
 func (s *SDFS) pushIndex(nodeID string) error {
 	client, err := s.getRPCClient(nodeID)
 	if err != nil {
 		return err
 	}
 
+	pos, ok := s.getFollowerPosition(nodeID)
+	if !ok {
+		// an empty push asks the follower how far it is
+		err = client.Call("SDFS.RPCPushIndexEntries", &[]model.IndexEntry{}, &pos)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a follower which found a gap replies with the position to resend from, retry once
+	for retry := 0; retry < 2 && pos != s.index.Position(); retry++ {
+		entries, ok := s.index.EntriesSince(pos)
+		if !ok {
+			return s.pushFullIndex(client, nodeID)
+		}
+		err = client.Call("SDFS.RPCPushIndexEntries", &entries, &pos)
+		if err != nil {
+			s.forgetFollower(nodeID)
+			return err
+		}
+	}
+	s.setFollowerPosition(nodeID, pos)
+	return nil
+}
+
+// pushFullIndex send the whole index to a follower too far behind for changes
+func (s *SDFS) pushFullIndex(client *rpc.Client, nodeID string) error {
 	globalIndex := s.index.GetGlobalIndexFile()
 	var ok bool
-	err = client.Call("SDFS.RPCPushIndex", &globalIndex, &ok)
+	err := client.Call("SDFS.RPCPushIndex", &globalIndex, &ok)
 	if err != nil {
+		s.forgetFollower(nodeID)
 		return err
 	}
+	s.setFollowerPosition(nodeID, model.IndexPosition{Seq: globalIndex.Seq, Hash: globalIndex.Hash})
 	return nil
 }
 
+func (s *SDFS) getFollowerPosition(nodeID string) (model.IndexPosition, bool) {
+	s.followersLock.Lock()
+	defer s.followersLock.Unlock()
+	pos, ok := s.followerPositions[nodeID]
+	return pos, ok
+}
+
+func (s *SDFS) setFollowerPosition(nodeID string, pos model.IndexPosition) {
+	s.followersLock.Lock()
+	defer s.followersLock.Unlock()
+	s.followerPositions[nodeID] = pos
+}
+
+func (s *SDFS) forgetFollower(nodeID string) {
+	s.followersLock.Lock()
+	defer s.followersLock.Unlock()
+	delete(s.followerPositions, nodeID)
+}
+
 func (s *SDFS) pushIndexToAll() []string {
 	failList := []string{}
-	for _, node := range s.sortedMemList {
+	for _, node := range s.getMemberList() {
 		if node != s.id {
 			err := s.pushIndex(node)
 			if err != nil {
@@ -146,19 +275,39 @@ func (s *SDFS) getIPFromID(nodeID string) string {
 }
 
 func (s *SDFS) isMaster() bool {
-	return s.id == s.master
+	return s.id == s.getMaster()
+}
+
+func (s *SDFS) getMaster() string {
+	s.memLock.RLock()
+	defer s.memLock.RUnlock()
+	return s.master
 }
 
 func (s *SDFS) getRPCClient(nodeID string) (*rpc.Client, error) {
-	client := &rpc.Client{}
-	ok := false
-	if client, ok = s.nodesRPCClients[nodeID]; !ok {
+	s.clientsLock.Lock()
+	client, ok := s.nodesRPCClients[nodeID]
+	s.clientsLock.Unlock()
+	if !ok {
 		return nil, fmt.Errorf("no rpc client for node: %v", nodeID)
 	}
+	if client == nil {
+		// dial failed when the node joined, its rpc server may be up now
+		s.addRPCClientForNode(nodeID)
+		s.clientsLock.Lock()
+		client = s.nodesRPCClients[nodeID]
+		s.clientsLock.Unlock()
+		if client == nil {
+			return nil, fmt.Errorf("no rpc client for node: %v", nodeID)
+		}
+	}
 	return client, nil
 }
 
 func (s *SDFS) updateMemberList() ([]string, []string) {
+	s.memLock.Lock()
+	defer s.memLock.Unlock()
+
 	oldMemList := s.sortedMemList
 	newMemList := s.failureDetector.GetMemberList()
 	// log.Printf("updateMemberList: %v", newMemList)
@@ -246,38 +395,343 @@ func (s *SDFS) addRPCClientForNode(nodeID string) []string {
 		fmt.Printf("updateMemberList: rpc.DialHTTP failed")
 		failNodes = append(failNodes, nodeID)
 	}
+	s.clientsLock.Lock()
 	s.nodesRPCClients[nodeID] = client
+	s.clientsLock.Unlock()
 	return failNodes
 }
 
 func (s *SDFS) deleteRPCClientForNode(nodeID string) error {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
 	delete(s.nodesRPCClients, nodeID)
 	return nil
 }
 
 func (s *SDFS) updateNewNodes(newNodes []string) {
 	for _, node := range newNodes {
-		s.index.AddNewNode(node)
+		s.addNode(node)
+	}
+	// files short of nodes can get their missing copies now
+	if len(newNodes) > 0 {
+		s.reReplicate()
+	}
+}
+
+// addNode add node to index, a node rejoining with a new ID keeps the files of its old ID
+func (s *SDFS) addNode(nodeID string) {
+	for _, oldID := range s.index.Nodes() {
+		if oldID != nodeID && s.getIPFromID(oldID) == s.getIPFromID(nodeID) && !s.isMember(oldID) {
+			log.Printf("addNode: %v rejoined as %v", oldID, nodeID)
+			s.index.RenameNode(oldID, nodeID)
+			return
+		}
+	}
+	s.index.AddNewNode(nodeID)
+}
+
+// updateNodeInfo ask members for their failure domain and disk usage
+func (s *SDFS) updateNodeInfo() {
+	for _, node := range s.getMemberList() {
+		info, err := s.getNodeInfo(node)
+		if err != nil {
+			log.Printf("updateNodeInfo: get info of %v failed: %v", node, err)
+			continue
+		}
+		s.index.SetNodeZone(node, info.Zone)
+		s.index.SetNodeInfo(info)
+	}
+}
+
+func (s *SDFS) getNodeInfo(nodeID string) (model.NodeInfo, error) {
+	if nodeID == s.id {
+		return s.nodeInfo(), nil
+	}
+
+	client, err := s.getRPCClient(nodeID)
+	if err != nil {
+		return model.NodeInfo{}, err
+	}
+
+	var info model.NodeInfo
+	err = client.Call("SDFS.RPCNodeInfo", &nodeID, &info)
+	if err != nil {
+		return model.NodeInfo{}, err
 	}
+	return info, nil
 }
 
-func (s *SDFS) updateFailNodes(failNodes []string) []string {
+func (s *SDFS) nodeInfo() model.NodeInfo {
+	info := model.NodeInfo{
+		ID:   s.id,
+		Zone: s.config.Zone,
+	}
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(s.filePath, &stat)
+	if err != nil {
+		log.Printf("nodeInfo: statfs %v failed: %v", s.filePath, err)
+		return info
+	}
+	info.UsedBytes = int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize)
+	info.FreeBytes = int64(stat.Bavail) * int64(stat.Bsize)
+	return info
+}
+
+func (s *SDFS) isMember(nodeID string) bool {
+	for _, node := range s.getMemberList() {
+		if node == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SDFS) hasMemberWithIP(ip string) bool {
+	for _, node := range s.getMemberList() {
+		if s.getIPFromID(node) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SDFS) rejoinTimeout() time.Duration {
+	timeout := s.config.RejoinTimeout
+	if timeout <= 0 {
+		timeout = defaultRejoinTimeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// removeDepartedNodes once membership settled after a restart, remove the nodes of the replayed or pulled
+// index which did not rejoin, their failures were never seen. What they held is re-replicated.
+func (s *SDFS) removeDepartedNodes() {
+	time.Sleep(s.rejoinTimeout())
+	if !s.isMaster() {
+		return
+	}
+
+	departed := []string{}
+	for _, id := range s.index.Nodes() {
+		if !s.isMember(id) && !s.hasMemberWithIP(s.getIPFromID(id)) {
+			departed = append(departed, id)
+		}
+	}
+	if len(departed) > 0 {
+		log.Printf("removeDepartedNodes: %v did not rejoin", departed)
+	}
+	s.updateFailNodes(departed)
+}
+
+// updateFailNodes remove all the failed nodes, then re-replicate what they held at once
+func (s *SDFS) updateFailNodes(failNodes []string) {
+	if len(failNodes) == 0 {
+		return
+	}
 	start := time.Now()
-	failFailNodes := []string{}
 	for _, node := range failNodes {
-		pullList := s.index.RemoveNode(node)
-		for _, pull := range pullList {
-			err := s.askNodeToPullFileFromNode(pull.Filename, pull.Node, pull.PullFrom)
+		s.index.RemoveNode(node)
+	}
+	s.reReplicate()
+	fmt.Printf("Rereplication time for nodes %v:\n %v\n", failNodes, time.Since(start))
+}
+
+// reReplicate copy every retained version with too few replicas until each is back to the replication
+// of its file, most at-risk versions first. Failed pulls are planned again after a backoff. A call
+// while one runs makes it plan again and returns at once.
+func (s *SDFS) reReplicate() {
+	s.reReplicateLock.Lock()
+	if s.reReplicating {
+		s.reReplicateAgain = true
+		s.reReplicateLock.Unlock()
+		return
+	}
+	s.reReplicating = true
+	s.reReplicateLock.Unlock()
+
+	backoff := reReplicateBackoff
+	for {
+		pulls := []model.PullInstruction{}
+		if s.isMaster() {
+			pulls = s.index.PlanReReplication(s.defaultRetention(), time.Now())
+		}
+		if len(pulls) == 0 {
+			s.reReplicateLock.Lock()
+			if !s.reReplicateAgain {
+				s.reReplicating = false
+				s.reReplicateLock.Unlock()
+				return
+			}
+			s.reReplicateAgain = false
+			s.reReplicateLock.Unlock()
+			continue
+		}
+
+		done := []model.PullInstruction{}
+		for _, pull := range pulls {
+			err := s.runPull(pull)
+			if err != nil {
+				log.Printf("reReplicate: ask %v pull file: %v from list: %v failed: %v", pull.Node, pull.Filename, pull.PullFrom, err)
+				continue
+			}
+			done = append(done, pull)
+		}
+		s.index.AddReplicas(done)
+
+		failList := s.pushIndexToAll()
+		if len(failList) > 0 {
+			log.Printf("Push Index to nodes: %v failed", failList)
+		}
+
+		if len(done) < len(pulls) {
+			log.Printf("reReplicate: %d of %d pulls failed, retry in %d ms", len(pulls)-len(done), len(pulls), backoff)
+			time.Sleep(time.Duration(backoff) * time.Millisecond)
+			backoff *= 2
+			if backoff > maxReReplicateBackoff {
+				backoff = maxReReplicateBackoff
+			}
+		} else {
+			backoff = reReplicateBackoff
+		}
+	}
+}
+
+func (s *SDFS) getDecommission(nodeID string) (model.DecommissionStatus, bool) {
+	s.decommissionsLock.Lock()
+	defer s.decommissionsLock.Unlock()
+	status, ok := s.decommissions[nodeID]
+	return status, ok
+}
+
+func (s *SDFS) setDecommission(status model.DecommissionStatus) {
+	s.decommissionsLock.Lock()
+	defer s.decommissionsLock.Unlock()
+	s.decommissions[status.Node] = status
+}
+
+// decommission copy every replica on draining node nodeID to other nodes, confirm the copies are on
+// disk, then drop the node from the index and make it leave the group. Failed copies are planned again
+// after a backoff, up to maxDrainRounds rounds, then the node takes new replicas again.
+func (s *SDFS) decommission(nodeID string) {
+	status, _ := s.getDecommission(nodeID)
+	fail := func(err error) {
+		log.Printf("decommission: %v failed: %v", nodeID, err)
+		status.State = model.DecommissionFailed
+		status.Error = err.Error()
+		s.setDecommission(status)
+		s.index.Undrain(nodeID)
+		failList := s.pushIndexToAll()
+		if len(failList) > 0 {
+			log.Printf("Push Index to nodes: %v failed", failList)
+		}
+	}
+
+	backoff := reReplicateBackoff
+	for round := 0; ; round++ {
+		pulls, err := s.index.PlanDrain(nodeID)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if len(pulls) == 0 {
+			break
+		}
+		if round == maxDrainRounds {
+			fail(fmt.Errorf("%d copies still missing after %d rounds", len(pulls), maxDrainRounds))
+			return
+		}
+		status.Copies += len(pulls)
+		s.setDecommission(status)
+
+		done := []model.PullInstruction{}
+		for _, pull := range pulls {
+			err := s.runPull(pull)
+			if err != nil {
+				log.Printf("decommission: ask %v pull file: %v from list: %v failed: %v", pull.Node, pull.Filename, pull.PullFrom, err)
+				status.Failed++
+				s.setDecommission(status)
+				continue
+			}
+			done = append(done, pull)
+		}
+
+		confirmed := s.confirmPulls(done)
+		status.Copied += len(confirmed)
+		status.Failed += len(done) - len(confirmed)
+		s.setDecommission(status)
+		s.index.AddReplicas(confirmed)
+
+		failList := s.pushIndexToAll()
+		if len(failList) > 0 {
+			log.Printf("Push Index to nodes: %v failed", failList)
+		}
+
+		if len(confirmed) < len(pulls) {
+			log.Printf("decommission: %d of %d copies from %v failed, retry in %d ms", len(pulls)-len(confirmed), len(pulls), nodeID, backoff)
+			time.Sleep(time.Duration(backoff) * time.Millisecond)
+			backoff *= 2
+			if backoff > maxReReplicateBackoff {
+				backoff = maxReReplicateBackoff
+			}
+		}
+	}
+
+	status.State = model.DecommissionLeaving
+	s.setDecommission(status)
+	s.index.RemoveNode(nodeID)
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+
+	err := s.askNodeToLeave(nodeID)
+	if err != nil {
+		// the node holds nothing the index needs any more, it fails out of the group in time
+		log.Printf("decommission: ask %v to leave failed: %v", nodeID, err)
+		status.Error = err.Error()
+	}
+	status.State = model.DecommissionDone
+	s.setDecommission(status)
+}
+
+// confirmPulls pulls whose replica file is listed on the node which pulled it
+func (s *SDFS) confirmPulls(pulls []model.PullInstruction) []model.PullInstruction {
+	stored := make(map[string]map[string]bool)
+	confirmed := []model.PullInstruction{}
+	for _, pull := range pulls {
+		files, ok := stored[pull.Node]
+		if !ok {
+			files = make(map[string]bool)
+			list, err := s.listFilesOnNode(pull.Node)
 			if err != nil {
-				log.Printf("updateFailNodes: ask %v pull file: %v from list: %v failed", pull.Node, pull.Filename, pull.PullFrom)
-				failFailNodes = append(failFailNodes, node)
+				log.Printf("confirmPulls: list files on %v failed: %v", pull.Node, err)
+			}
+			for _, file := range list {
+				files[file] = true
 			}
+			stored[pull.Node] = files
 		}
+		if files[pull.Filename] {
+			confirmed = append(confirmed, pull)
+		}
+	}
+	return confirmed
+}
+
+func (s *SDFS) askNodeToLeave(nodeID string) error {
+	if nodeID == s.id {
+		var ok bool
+		return s.RPCLeaveGroup(&nodeID, &ok)
 	}
-	if len(failNodes) > 0 {
-		fmt.Printf("Rereplication time for nodes %v:\n %v\n", failNodes, time.Since(start))
+
+	client, err := s.getRPCClient(nodeID)
+	if err != nil {
+		return err
 	}
-	return failFailNodes
+
+	var ok bool
+	return client.Call("SDFS.RPCLeaveGroup", &nodeID, &ok)
 }
 
 func (s *SDFS) keepUpdatingMemberList() {
@@ -290,22 +744,172 @@ func (s *SDFS) keepUpdatingMemberList() {
 
 		for _, nodeID := range failNodes {
 			s.deleteRPCClientForNode(nodeID)
+			s.forgetFollower(nodeID)
 		}
 
 		if s.isMaster() {
 			go s.updateNewNodes(newNodes)
 			go s.updateFailNodes(failNodes)
+			go s.updateNodeInfo()
 
 			//log.Printf("keepUpdatingMemberList: nodesRPCclient: %v", s.nodesRPCClients)
 			//log.Printf("keepUpdatingMemberList: updated newNodes: %v, failNodes: %v", newNodes, failNodes)
-			log.Printf("keepUpdatingMemberList: s.sortedMemList: %v", s.sortedMemList)
+			log.Printf("keepUpdatingMemberList: s.sortedMemList: %v", s.getMemberList())
 			s.pushIndexToAll()
 		}
 	}
 }
 
+func (s *SDFS) keepCollectingGarbage() {
+	interval := s.config.GCInterval
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Millisecond)
+		if s.isMaster() {
+			s.collectGarbage()
+		}
+	}
+}
+
+func (s *SDFS) defaultRetention() model.RetentionPolicy {
+	return model.RetentionPolicy{
+		KeepVersions: s.config.KeepVersions,
+		MaxAge:       s.config.VersionMaxAge,
+	}
+}
+
+// collectGarbage drop expired versions and deleted files from the index, then from the disks of their replicas
+func (s *SDFS) collectGarbage() {
+	s.purgeTrash()
+
+	replicas := s.index.PruneVersions(s.defaultRetention(), time.Now())
+	if len(replicas) == 0 {
+		return
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+
+	deleted := 0
+	for _, replica := range replicas {
+		versionName := SDFSIndex.VersionName(replica.File)
+		err := s.deleteFileOnNode(versionName, replica.Node)
+		if err != nil {
+			log.Printf("collectGarbage: delete %v on %v failed: %v", versionName, replica.Node, err)
+			continue
+		}
+		deleted++
+	}
+	log.Printf("collectGarbage: deleted %d of %d replicas of expired versions", deleted, len(replicas))
+}
+
+func (s *SDFS) trashRetention() time.Duration {
+	retention := s.config.TrashRetention
+	if retention <= 0 {
+		retention = defaultTrashRetention
+	}
+	return time.Duration(retention) * time.Second
+}
+
+// purgeTrash delete the files which stayed in the trash longer than the retention from the disks of
+// their replicas. Only the replicas deleted leave the trash, the others are purged again next time.
+func (s *SDFS) purgeTrash() {
+	replicas := s.index.PlanPurge(s.trashRetention(), time.Now())
+	if len(replicas) == 0 {
+		return
+	}
+
+	deleted := []model.Replica{}
+	for _, replica := range replicas {
+		versionName := SDFSIndex.VersionName(replica.File)
+		err := s.deleteFileOnNode(versionName, replica.Node)
+		if err != nil {
+			log.Printf("purgeTrash: delete %v on %v failed: %v", versionName, replica.Node, err)
+			continue
+		}
+		deleted = append(deleted, replica)
+	}
+	log.Printf("purgeTrash: deleted %d of %d replicas of deleted files", len(deleted), len(replicas))
+	s.index.Purge(deleted)
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+}
+
+func (s *SDFS) keepRebalancing() {
+	interval := s.config.RebalanceInterval
+	if interval <= 0 {
+		interval = defaultRebalanceInterval
+	}
+	for {
+		time.Sleep(time.Duration(interval) * time.Millisecond)
+		if s.isMaster() {
+			s.rebalance()
+		}
+	}
+}
+
+func (s *SDFS) rebalanceMoves() int {
+	if s.config.RebalanceMoves <= 0 {
+		return defaultRebalanceMoves
+	}
+	return s.config.RebalanceMoves
+}
+
+// rebalance move replicas from the most to the least loaded nodes, one at a time.
+// The index changes only after the new replica is copied.
+func (s *SDFS) rebalance() []model.Move {
+	done := []model.Move{}
+	for _, move := range s.index.PlanRebalance(s.rebalanceMoves()) {
+		versionName := SDFSIndex.VersionName(move.File)
+		err := s.askNodeToPullFileFromNode(versionName, move.To, []string{move.From})
+		if err != nil {
+			log.Printf("rebalance: ask %v pull file: %v from %v failed: %v", move.To, versionName, move.From, err)
+			continue
+		}
+
+		if !s.index.MoveReplica(move) {
+			// another copy may have been placed on move.To while it pulled, that one is live
+			if s.index.HoldsReplica(move.To, move.File) {
+				log.Printf("rebalance: index changed, %v already holds %v", move.To, versionName)
+				continue
+			}
+			log.Printf("rebalance: index changed, drop copy of %v on %v", versionName, move.To)
+			s.deleteFileOnNode(versionName, move.To)
+			continue
+		}
+		failList := s.pushIndexToAll()
+		if len(failList) > 0 {
+			log.Printf("Push Index to nodes: %v failed", failList)
+		}
+
+		err = s.deleteFileOnNode(versionName, move.From)
+		if err != nil {
+			log.Printf("rebalance: delete %v on %v failed: %v", versionName, move.From, err)
+		}
+		done = append(done, move)
+
+		// throttle so rebalancing does not take over the network
+		time.Sleep(time.Duration(s.config.SleepTime) * time.Millisecond)
+	}
+
+	if len(done) > 0 {
+		log.Printf("rebalance: moved %d replicas", len(done))
+	}
+	return done
+}
+
+// getMemberList copy of the member list, it is replaced by keepUpdatingMemberList
 func (s *SDFS) getMemberList() []string {
-	return s.sortedMemList
+	s.memLock.RLock()
+	defer s.memLock.RUnlock()
+	return append([]string{}, s.sortedMemList...)
 }
 
 func (s *SDFS) setPort(port int) {
@@ -331,24 +935,77 @@ func (s *SDFS) startFailureDetector() {
 	fmt.Printf("failureDetector has been killed!")
 }
 
+// localPath where replica file filename is stored, SDFS directories are directories on disk
+func (s *SDFS) localPath(filename string) string {
+	return filepath.Join(s.filePath, filepath.FromSlash(SDFSIndex.CleanPath(filename)))
+}
+
 func (s *SDFS) writeFile(filename string, fileContent []byte) error {
-	err := ioutil.WriteFile(s.filePath+filename, fileContent, 0644)
+	err := os.MkdirAll(filepath.Dir(s.localPath(filename)), 0755)
 	if err != nil {
 		return err
 	}
-	return nil
+	// replicas with the same content are hard links to one file, never write one in place
+	tmp := s.localPath(filename) + ".tmp"
+	err = ioutil.WriteFile(tmp, fileContent, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.localPath(filename))
 }
 
 func (s *SDFS) readFileContent(filename string) ([]byte, error) {
-	content, err := ioutil.ReadFile(s.filePath + filename)
+	content, err := ioutil.ReadFile(s.localPath(filename))
 	if err != nil {
 		return nil, err
 	}
 	return content, nil
 }
 
+// listFiles paths of the replica files stored on this node
+func (s *SDFS) listFiles() ([]string, error) {
+	root := filepath.Clean(s.filePath)
+	indexDir := filepath.Clean(s.filePath + ".index")
+
+	files := []string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p == indexDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, SDFSIndex.CleanPath(filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// linkFile make replica file to another name of replica file from, a stale file named to is replaced
+func (s *SDFS) linkFile(from string, to string) error {
+	err := os.MkdirAll(filepath.Dir(s.localPath(to)), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(s.localPath(to))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(s.localPath(from), s.localPath(to))
+}
+
 func (s *SDFS) deleteFile(filename string) error {
-	files, err := filepath.Glob(s.filePath + filename)
+	files, err := filepath.Glob(s.localPath(filename))
 	if err != nil {
 		return err
 	}
@@ -363,7 +1020,7 @@ func (s *SDFS) deleteFile(filename string) error {
 
 // RPCPrintMemberList RPC
 func (s *SDFS) RPCPrintMemberList(a *string, b *string) error {
-	fmt.Printf("sortedMemList: %v\n", s.sortedMemList)
+	fmt.Printf("sortedMemList: %v\n", s.getMemberList())
 	return nil
 }
 
@@ -373,88 +1030,1076 @@ func (s *SDFS) RPCPrintIndex(a *string, b *string) error {
 	return nil
 }
 
-// RPCPrintRPCClients RPC
+// RPCNodeInfo RPC to report zone and disk usage of this node
+func (s *SDFS) RPCNodeInfo(nodeID *string, info *model.NodeInfo) error {
+	*info = s.nodeInfo()
+	return nil
+}
+
+// RPCPrintRPCClients RPC
 func (s *SDFS) RPCPrintRPCClients(a *string, b *string) error {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
 	fmt.Printf("RPCClients: \n%v\n", s.nodesRPCClients)
 	return nil
 }
 
-// RPCDeleteFile RPC to delete file
-func (s *SDFS) RPCDeleteFile(filename *string, ok *bool) error {
-	err := s.deleteFile(*filename)
+// RPCDeleteFile RPC to delete file
+func (s *SDFS) RPCDeleteFile(filename *string, ok *bool) error {
+	err := s.deleteFile(*filename)
+	if err != nil {
+		*ok = false
+		return err
+	}
+	*ok = true
+	return nil
+}
+
+// RPCLinkFile RPC to make a replica file available under another name
+func (s *SDFS) RPCLinkFile(args *model.RPCLinkFileArgs, ok *bool) error {
+	err := s.linkFile(args.From, args.To)
+	if err != nil {
+		*ok = false
+		return err
+	}
+	*ok = true
+	return nil
+}
+
+// RPCPutFile RPC to add file
+func (s *SDFS) RPCPutFile(file *model.RPCAddFileArgs, reply *model.RPCFilenameWithReplica) error {
+	file.Filename = SDFSIndex.CleanPath(file.Filename)
+	if s.isMaster() {
+		err := s.index.CheckQuota(file.Filename, file.MD5, file.Size, file.Meta.Uploader)
+		if err != nil {
+			return err
+		}
+
+		version, replicaList, stored := s.putStoredContent(file)
+		if !stored {
+			version, replicaList, err = s.index.AddFile(file.Filename, file.MD5, file.Size, file.Replicas, file.Meta)
+			if err != nil {
+				return err
+			}
+		}
+
+		failList := s.pushIndexToAll()
+		if len(failList) > 0 {
+			log.Printf("Push Index to nodes: %v failed", failList)
+		}
+		*reply = model.RPCFilenameWithReplica{
+			Filename:    fmt.Sprintf("%s_%d", file.Filename, version),
+			ReplicaList: replicaList,
+			Stored:      stored,
+		}
+		s.setLayout(reply, file.Filename, version)
+	} else {
+		err := s.putFile(file, reply)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putStoredContent add file on the nodes already storing its content by linking their replicas of it
+// under the new name, or the shards or blocks of a version storing it, so that nothing is uploaded.
+// False if no node stores the content.
+func (s *SDFS) putStoredContent(file *model.RPCAddFileArgs) (int, []string, bool) {
+	version, sources := s.index.PlanDedup(file.Filename, file.MD5, file.Replicas)
+	if len(sources) == 0 {
+		return s.putStoredLayout(file)
+	}
+
+	to := fmt.Sprintf("%s_%d", file.Filename, version)
+	nodes := []string{}
+	linked := []string{}
+	for _, source := range sources {
+		from := fmt.Sprintf("%s_%d", source.File.Filename, source.File.Version)
+		if from != to {
+			err := s.linkFileOnNode(from, to, source.Node)
+			if err != nil {
+				log.Printf("putStoredContent: link %v on %v failed: %v", from, source.Node, err)
+				continue
+			}
+			linked = append(linked, source.Node)
+		}
+		nodes = append(nodes, source.Node)
+	}
+
+	fs := model.FileStructure{
+		Version:  version,
+		Filename: file.Filename,
+		Hash:     file.MD5,
+		Size:     file.Size,
+	}
+	err := s.index.AddDedupFile(fs, file.Replicas, file.Meta, nodes)
+	if err != nil {
+		log.Printf("putStoredContent: %v, upload %s instead", err, file.Filename)
+		for _, node := range linked {
+			if err := s.deleteFileOnNode(to, node); err != nil {
+				log.Printf("putStoredContent: undo link %v on %v failed: %v", to, node, err)
+			}
+		}
+		return -1, nil, false
+	}
+
+	// fewer nodes than the file wants may store the content, the others copy it from them
+	err = s.matchReplication(file.Filename)
+	if err != nil {
+		log.Printf("putStoredContent: %v", err)
+	}
+	_, replicaList := s.index.GetFile(file.Filename)
+	return version, replicaList, true
+}
+
+// putStoredLayout add file with the layout of an erasure-coded or split version storing its content,
+// by linking each of its shards or blocks under the new name on the node holding it. False if no such
+// version stores the content.
+func (s *SDFS) putStoredLayout(file *model.RPCAddFileArgs) (int, []string, bool) {
+	version, sources := s.index.PlanLayoutDedup(file.Filename, file.MD5)
+	if len(sources) == 0 {
+		return -1, nil, false
+	}
+
+	renamed := func(fs model.FileStructure) string {
+		fs.Filename = file.Filename
+		fs.Version = version
+		return SDFSIndex.VersionName(fs)
+	}
+	linked := []model.Replica{}
+	for _, source := range sources {
+		from := SDFSIndex.VersionName(source.File)
+		err := s.linkFileOnNode(from, renamed(source.File), source.Node)
+		if err != nil {
+			log.Printf("putStoredLayout: link %v on %v failed: %v", from, source.Node, err)
+			continue
+		}
+		linked = append(linked, source)
+	}
+
+	fs := model.FileStructure{
+		Version:  version,
+		Filename: file.Filename,
+		Hash:     file.MD5,
+		Size:     file.Size,
+	}
+	err := s.index.AddLayoutDedupFile(fs, file.Meta, linked)
+	if err != nil {
+		log.Printf("putStoredLayout: %v, upload %s instead", err, file.Filename)
+		for _, replica := range linked {
+			if err := s.deleteFileOnNode(renamed(replica.File), replica.Node); err != nil {
+				log.Printf("putStoredLayout: undo link %v on %v failed: %v", renamed(replica.File), replica.Node, err)
+			}
+		}
+		return -1, nil, false
+	}
+	_, replicaList := s.index.GetFile(file.Filename)
+	return version, replicaList, true
+}
+
+// RPCRemoveFile RPC to add file
+func (s *SDFS) RPCRemoveFile(filename *string, nodes *[]string) error {
+	*filename = SDFSIndex.CleanPath(*filename)
+	if s.isMaster() {
+		*nodes = s.index.RemoveFile(*filename)
+
+		failList := s.pushIndexToAll()
+		if len(failList) > 0 {
+			return fmt.Errorf("Push Index to nodes: %v failed", failList)
+		}
+	} else {
+		err := s.removeFile(filename, nodes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RPCSetReplication RPC to add or drop replicas of file to match args.Replicas
+func (s *SDFS) RPCSetReplication(args *model.RPCSetReplicationArgs, reply *model.RPCFilenameWithReplica) error {
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCSetReplication", args, reply)
+	}
+
+	err := s.index.SetReplication(args.Filename, args.Replicas)
+	if err != nil {
+		return err
+	}
+	err = s.matchReplication(args.Filename)
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*reply = model.RPCFilenameWithReplica{
+		Filename:    args.Filename,
+		ReplicaList: s.index.GetNodesWithFile(args.Filename),
+	}
+	return err
+}
+
+// matchReplication copy or delete replicas of file until it has as many as the index wants
+func (s *SDFS) matchReplication(filename string) error {
+	pulls, drops := s.index.PlanReplication(filename)
+
+	done := []model.PullInstruction{}
+	for _, pull := range pulls {
+		err := s.askNodeToPullFileFromNode(pull.Filename, pull.Node, pull.PullFrom)
+		if err != nil {
+			log.Printf("matchReplication: ask %v pull file: %v from list: %v failed: %v", pull.Node, pull.Filename, pull.PullFrom, err)
+			continue
+		}
+		done = append(done, pull)
+	}
+	s.index.AddReplicas(done)
+
+	for _, replica := range s.index.DropReplicas(filename, drops) {
+		versionName := SDFSIndex.VersionName(replica.File)
+		err := s.deleteFileOnNode(versionName, replica.Node)
+		if err != nil {
+			log.Printf("matchReplication: delete %v on %v failed: %v", versionName, replica.Node, err)
+		}
+	}
+
+	if len(done) < len(pulls) {
+		return fmt.Errorf("only %d of %d new replicas of %s were copied", len(done), len(pulls), filename)
+	}
+	return nil
+}
+
+// RPCSetRetention RPC to override the retention policy of a file
+func (s *SDFS) RPCSetRetention(args *model.RPCSetRetentionArgs, ok *bool) error {
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCSetRetention", args, ok)
+	}
+
+	var policy *model.RetentionPolicy
+	if !args.Clear {
+		policy = &args.Policy
+	}
+	err := s.index.SetRetention(args.Filename, policy)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCSetCoding RPC to store new versions of a file, or of the files below a directory, erasure-coded
+func (s *SDFS) RPCSetCoding(args *model.RPCSetCodingArgs, ok *bool) error {
+	args.Name = SDFSIndex.CleanPath(args.Name)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCSetCoding", args, ok)
+	}
+
+	var coding *model.Coding
+	if !args.Clear {
+		coding = &args.Coding
+	}
+	err := s.index.SetCoding(args.Name, coding)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCCodings RPC to list the erasure codings set, by file or directory
+func (s *SDFS) RPCCodings(a *string, codings *map[string]model.Coding) error {
+	*codings = s.index.Codings()
+	return nil
+}
+
+// RPCSetQuota RPC to set the limits of the quota for an identity and prefix, no limits remove it
+func (s *SDFS) RPCSetQuota(q *model.Quota, ok *bool) error {
+	if q.Prefix != "" {
+		q.Prefix = SDFSIndex.CleanPath(q.Prefix)
+	}
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCSetQuota", q, ok)
+	}
+
+	err := s.index.SetQuota(*q)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCQuotas RPC to get every quota with its usage
+func (s *SDFS) RPCQuotas(a *string, usages *[]model.QuotaUsage) error {
+	*usages = s.index.Quotas()
+	return nil
+}
+
+// RPCMoveFile RPC to rename a file with all its versions. Every replica is linked under the new
+// name before the index changes, so a failed replica leaves the file as it was.
+func (s *SDFS) RPCMoveFile(args *model.RPCMoveFileArgs, dst *string) error {
+	args.Src = SDFSIndex.CleanPath(args.Src)
+	args.Dst = SDFSIndex.CleanPath(args.Dst)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCMoveFile", args, dst)
+	}
+
+	to, replicas, err := s.index.PlanRename(args.Src, args.Dst)
+	if err != nil {
+		return err
+	}
+
+	// name on disk of replica under the new name
+	renamed := func(replica model.Replica) string {
+		file := replica.File
+		file.Filename = to
+		return SDFSIndex.VersionName(file)
+	}
+	linked := []model.Replica{}
+	for _, replica := range replicas {
+		from := SDFSIndex.VersionName(replica.File)
+		err = s.linkFileOnNode(from, renamed(replica), replica.Node)
+		if err != nil {
+			err = fmt.Errorf("link %v on %v failed: %v", from, replica.Node, err)
+			break
+		}
+		linked = append(linked, replica)
+	}
+	if err == nil {
+		err = s.index.RenameFile(args.Src, to, replicas)
+	}
+	if err != nil {
+		for _, replica := range linked {
+			versionName := renamed(replica)
+			if err := s.deleteFileOnNode(versionName, replica.Node); err != nil {
+				log.Printf("RPCMoveFile: undo link %v on %v failed: %v", versionName, replica.Node, err)
+			}
+		}
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+
+	// the old names are garbage now, unless a new file took the name meanwhile
+	if version, _ := s.index.GetFile(args.Src); version == -1 {
+		for _, replica := range replicas {
+			versionName := SDFSIndex.VersionName(replica.File)
+			if err := s.deleteFileOnNode(versionName, replica.Node); err != nil {
+				log.Printf("RPCMoveFile: delete %v on %v failed: %v", versionName, replica.Node, err)
+			}
+		}
+	}
+	*dst = to
+	return nil
+}
+
+// RPCTrash RPC to list the deleted files which can be undeleted
+func (s *SDFS) RPCTrash(a *string, trash *[]model.Tombstone) error {
+	*trash = s.index.Trash()
+	return nil
+}
+
+// RPCUndelete RPC to restore a deleted file from the trash
+func (s *SDFS) RPCUndelete(filename *string, ok *bool) error {
+	*filename = SDFSIndex.CleanPath(*filename)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCUndelete", filename, ok)
+	}
+
+	err := s.index.Undelete(*filename)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	// replicas on nodes which failed since the delete are gone
+	err = s.matchReplication(*filename)
+	if err != nil {
+		log.Printf("RPCUndelete: %v", err)
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCCreateSnapshot RPC to take a named snapshot of the namespace
+func (s *SDFS) RPCCreateSnapshot(name *string, ok *bool) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCCreateSnapshot", name, ok)
+	}
+
+	err := s.index.CreateSnapshot(*name)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCDeleteSnapshot RPC to delete a snapshot
+func (s *SDFS) RPCDeleteSnapshot(name *string, ok *bool) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCDeleteSnapshot", name, ok)
+	}
+
+	err := s.index.DeleteSnapshot(*name)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCListSnapshots RPC to list the snapshots
+func (s *SDFS) RPCListSnapshots(a *string, infos *[]model.SnapshotInfo) error {
+	*infos = s.index.Snapshots()
+	return nil
+}
+
+// RPCDiffSnapshots RPC to compare two snapshots, or a snapshot with the current namespace
+func (s *SDFS) RPCDiffSnapshots(args *model.RPCDiffSnapshotsArgs, diff *model.SnapshotDiff) error {
+	d, err := s.index.DiffSnapshots(args.From, args.To)
+	if err != nil {
+		return err
+	}
+	*diff = d
+	return nil
+}
+
+// RPCRestoreSnapshot RPC to make the version of a file in a snapshot its latest again, or to do so for
+// every file in the snapshot and move the files added since to the trash. Reply with the files changed.
+func (s *SDFS) RPCRestoreSnapshot(args *model.RPCRestoreSnapshotArgs, restored *[]string) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCRestoreSnapshot", args, restored)
+	}
+
+	snap, err := s.index.GetSnapshot(args.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	*restored = []string{}
+	if args.Filename != "" {
+		filename := SDFSIndex.CleanPath(args.Filename)
+		fv, ok := snap.Files[filename]
+		if !ok {
+			return fmt.Errorf("%s is not in snapshot %s", filename, args.Snapshot)
+		}
+		err = s.restoreFile(filename, fv)
+		if err == nil {
+			*restored = append(*restored, filename)
+		}
+	} else {
+		err = s.restoreNamespace(snap, restored)
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	return err
+}
+
+// restoreNamespace make the namespace look like snap, appending the files changed to restored
+func (s *SDFS) restoreNamespace(snap model.Snapshot, restored *[]string) error {
+	diff, err := s.index.DiffSnapshots(snap.Name, "")
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range diff.Added {
+		s.index.RemoveFile(filename)
+		*restored = append(*restored, filename)
+	}
+	for _, dir := range snap.Dirs {
+		err := s.index.Mkdir(dir)
+		if err != nil {
+			log.Printf("restoreNamespace: mkdir %v failed: %v", dir, err)
+		}
+	}
+
+	failed := []string{}
+	for _, filename := range append(diff.Removed, diff.Changed...) {
+		err := s.restoreFile(filename, snap.Files[filename])
+		if err != nil {
+			log.Printf("restoreNamespace: %v", err)
+			failed = append(failed, filename)
+			continue
+		}
+		*restored = append(*restored, filename)
+	}
+	sort.Strings(*restored)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("files %v could not be restored", failed)
+	}
+	return nil
+}
+
+// restoreFile add the content of fv as a new version of filename, linked from the replicas, shards or
+// blocks still storing it, which the snapshot kept from being pruned or purged
+func (s *SDFS) restoreFile(filename string, fv model.FileVersion) error {
+	file := &model.RPCAddFileArgs{
+		Filename: filename,
+		MD5:      fv.Hash,
+		Size:     fv.Size,
+		Meta:     fv.Meta,
+	}
+	_, _, stored := s.putStoredContent(file)
+	if !stored {
+		return fmt.Errorf("version %d of %s is no longer stored", fv.Version, filename)
+	}
+	return nil
+}
+
+// RPCMkdir RPC to make a directory and its missing parents
+func (s *SDFS) RPCMkdir(dir *string, ok *bool) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCMkdir", dir, ok)
+	}
+
+	err := s.index.Mkdir(*dir)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCRmdir RPC to remove an empty directory
+func (s *SDFS) RPCRmdir(dir *string, ok *bool) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCRmdir", dir, ok)
+	}
+
+	err := s.index.Rmdir(*dir)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCListDir RPC to list a directory
+func (s *SDFS) RPCListDir(args *model.RPCListDirArgs, entries *[]model.DirEntry) error {
+	list, err := s.index.List(args.Dir, args.Recursive)
+	if err != nil {
+		return err
+	}
+	*entries = list
+	return nil
+}
+
+// RPCListAll RPC to list a page of the files matching a glob or prefix
+func (s *SDFS) RPCListAll(args *model.RPCListAllArgs, reply *model.RPCListAllReply) error {
+	reply.Files, reply.Next = s.index.ListFiles(args.Pattern, args.After, args.Limit)
+	return nil
+}
+
+// RPCRebalance RPC to run a rebalance round now, or only plan it
+func (s *SDFS) RPCRebalance(args *model.RPCRebalanceArgs, moves *[]model.Move) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCRebalance", args, moves)
+	}
+
+	if args.DryRun {
+		*moves = s.index.PlanRebalance(s.rebalanceMoves())
+		return nil
+	}
+	*moves = s.rebalance()
+	return nil
+}
+
+// RPCDecommission RPC to drain node nodeID and make it leave the group, runs in the background
+func (s *SDFS) RPCDecommission(nodeID *string, status *model.DecommissionStatus) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCDecommission", nodeID, status)
+	}
+
+	s.decommissionsLock.Lock()
+	defer s.decommissionsLock.Unlock()
+
+	current, ok := s.decommissions[*nodeID]
+	if ok && (current.State == model.DecommissionDraining || current.State == model.DecommissionLeaving) {
+		*status = current
+		return nil
+	}
+	err := s.index.Drain(*nodeID)
+	if err != nil {
+		return err
+	}
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+
+	*status = model.DecommissionStatus{
+		Node:    *nodeID,
+		State:   model.DecommissionDraining,
+		Started: time.Now(),
+	}
+	s.decommissions[*nodeID] = *status
+	go s.decommission(*nodeID)
+	return nil
+}
+
+// RPCDecommissionStatus RPC to get the progress of the decommission of node nodeID
+func (s *SDFS) RPCDecommissionStatus(nodeID *string, status *model.DecommissionStatus) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCDecommissionStatus", nodeID, status)
+	}
+
+	current, ok := s.getDecommission(*nodeID)
+	if !ok {
+		return fmt.Errorf("no decommission of %s", *nodeID)
+	}
+	*status = current
+	return nil
+}
+
+// RPCLeaveGroup RPC to make this node leave the group, by the same message cli_tool leave sends
+func (s *SDFS) RPCLeaveGroup(nodeID *string, ok *bool) error {
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", s.failureDetector.GetIP(), s.failureDetector.GetPort()))
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := []byte{byte(messageLeave), ':'}
+	buf = append(buf, []byte("127.0.0.1-0")...)
+	_, err = conn.Write(buf)
+	if err != nil {
+		return err
+	}
+	log.Printf("RPCLeaveGroup: %v leaves the group", s.id)
+	*ok = true
+	return nil
+}
+
+// RPCListFiles RPC to list replica files on this node
+func (s *SDFS) RPCListFiles(nodeID *string, files *[]string) error {
+	list, err := s.listFiles()
+	if err != nil {
+		return err
+	}
+	*files = list
+	return nil
+}
+
+// RPCFsck RPC to check the index against itself and the disks of all members
+func (s *SDFS) RPCFsck(args *model.RPCFsckArgs, reply *model.RPCFsckReply) error {
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
+		}
+		return client.Call("SDFS.RPCFsck", args, reply)
+	}
+
+	disk := make(map[string][]string)
+	unreachable := []string{}
+	for _, node := range s.getMemberList() {
+		files, err := s.listFilesOnNode(node)
+		if err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("%s: list files failed, disk not checked: %v", node, err))
+			continue
+		}
+		disk[node] = files
+	}
+
+	problems, orphans := s.index.Fsck(disk, args.Repair)
+	reply.Problems = append(unreachable, problems...)
+	if !args.Repair || len(problems) == 0 {
+		return nil
+	}
+
+	for _, orphan := range orphans {
+		versionName := SDFSIndex.VersionName(orphan.File)
+		err := s.deleteFileOnNode(versionName, orphan.Node)
+		if err != nil {
+			log.Printf("RPCFsck: delete orphan %v on %v failed: %v", versionName, orphan.Node, err)
+		}
+	}
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	reply.Repaired = true
+	return nil
+}
+
+// RPCGetFile RPC to get the latest version of file, or the version named by a tag as in file@tag
+func (s *SDFS) RPCGetFile(filename *string, reply *model.RPCFilenameWithReplica) error {
+	name, version, err := s.resolveName(SDFSIndex.CleanPath(*filename))
 	if err != nil {
-		*ok = false
 		return err
 	}
-	*ok = true
+
+	var replicaList []string
+	if version == -1 {
+		version, replicaList = s.index.GetFile(name)
+	} else {
+		stat, err := s.index.Stat(name, version)
+		if err != nil {
+			return err
+		}
+		replicaList = stat.Nodes
+	}
+
+	*reply = model.RPCFilenameWithReplica{
+		Filename:    fmt.Sprintf("%s_%d", name, version),
+		ReplicaList: replicaList,
+	}
+	s.setLayout(reply, name, version)
 	return nil
 }
 
-// RPCDeleteFileStar RPC to delete file
-func (s *SDFS) RPCDeleteFileStar(filename *string, ok *bool) error {
-	err := s.deleteFile(*filename + "*")
+// setLayout make reply of version of filename list its shards if it is erasure-coded, and its blocks
+// if it is split into blocks
+func (s *SDFS) setLayout(reply *model.RPCFilenameWithReplica, filename string, version int) {
+	stat, err := s.index.Stat(filename, version)
 	if err != nil {
-		*ok = false
-		return err
+		return
+	}
+	reply.Size = stat.Size
+	reply.Blocks = stat.Blocks
+	if stat.Coding.Data > 0 {
+		reply.Coding = stat.Coding
+		reply.ReplicaList = stat.Shards
 	}
-	*ok = true
-	return nil
 }
 
-// RPCPutFile RPC to add file
-func (s *SDFS) RPCPutFile(file *model.RPCAddFileArgs, reply *model.RPCFilenameWithReplica) error {
-	if s.isMaster() {
-		version, replicaList := s.index.AddFile(file.Filename, file.MD5)
-
-		failList := s.pushIndexToAll()
-		if len(failList) > 0 {
-			log.Printf("Push Index to nodes: %v failed", failList)
+// RPCDiffVersions RPC to diff two versions of file on a node holding both, only the diff is sent back
+func (s *SDFS) RPCDiffVersions(args *model.RPCDiffArgs, reply *model.RPCDiffReply) error {
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	from, err := s.index.Stat(args.Filename, args.From)
+	if err != nil {
+		return err
+	}
+	to, err := s.index.Stat(args.Filename, args.To)
+	if err != nil {
+		return err
+	}
+	args.From, args.To = from.Version, to.Version
+
+	if from.Hash == to.Hash {
+		*reply = model.RPCDiffReply{
+			Filename: args.Filename,
+			From:     from.Version,
+			To:       to.Version,
+			FromSize: from.Size,
+			ToSize:   to.Size,
 		}
-		*reply = model.RPCFilenameWithReplica{
-			Filename:    fmt.Sprintf("%s_%d", file.Filename, version),
-			ReplicaList: replicaList,
+		return nil
+	}
+
+	if len(from.Blocks) > 0 || len(to.Blocks) > 0 {
+		return fmt.Errorf("%s is split into blocks of %d bytes, too large to diff", args.Filename, SDFSIndex.BlockSize)
+	}
+
+	// no node holds an erasure-coded version whole, both are decoded here
+	if from.Coding.Data > 0 || to.Coding.Data > 0 {
+		a, err := s.readVersion(from)
+		if err != nil {
+			return err
 		}
-	} else {
-		err := s.putFile(file, reply)
+		b, err := s.readVersion(to)
 		if err != nil {
 			return err
 		}
+		*reply = s.diffContent(args, a, b)
+		return nil
+	}
+
+	nodes := []string{}
+	for _, id := range from.Nodes {
+		for _, other := range to.Nodes {
+			if id == other {
+				nodes = append(nodes, id)
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("no node holds both version %d and %d of %s", from.Version, to.Version, args.Filename)
+	}
+
+	for _, id := range nodes {
+		if id == s.id {
+			return s.RPCDiffReplicas(args, reply)
+		}
+	}
+	for _, id := range nodes {
+		client, err := s.getRPCClient(id)
+		if err != nil {
+			log.Printf("RPCDiffVersions: %v", err)
+			continue
+		}
+		err = client.Call("SDFS.RPCDiffReplicas", args, reply)
+		if err != nil {
+			log.Printf("RPCDiffVersions: diff on %s failed: %v", id, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("diff of %s failed on nodes %v", args.Filename, nodes)
+}
+
+// RPCDiffReplicas RPC to diff two versions of file stored on this node
+func (s *SDFS) RPCDiffReplicas(args *model.RPCDiffArgs, reply *model.RPCDiffReply) error {
+	fromName := fmt.Sprintf("%s_%d", args.Filename, args.From)
+	toName := fmt.Sprintf("%s_%d", args.Filename, args.To)
+	a, err := s.readFileContent(fromName)
+	if err != nil {
+		return err
+	}
+	b, err := s.readFileContent(toName)
+	if err != nil {
+		return err
 	}
+
+	*reply = s.diffContent(args, a, b)
 	return nil
 }
 
-// RPCRemoveFile RPC to add file
-func (s *SDFS) RPCRemoveFile(filename *string, nodes *[]string) error {
-	if s.isMaster() {
-		*nodes = s.index.RemoveFile(*filename)
+// diffContent diff of content a of version args.From and content b of version args.To
+func (s *SDFS) diffContent(args *model.RPCDiffArgs, a []byte, b []byte) model.RPCDiffReply {
+	reply := model.RPCDiffReply{
+		Filename: args.Filename,
+		From:     args.From,
+		To:       args.To,
+		Node:     s.id,
+		FromSize: int64(len(a)),
+		ToSize:   int64(len(b)),
+	}
+	if diff.IsBinary(a) || diff.IsBinary(b) {
+		reply.Binary = true
+		reply.Ranges, reply.TotalRanges = diff.ByteRanges(a, b, maxDiffRanges)
+		return reply
+	}
+	reply.Diff = diff.Unified(fmt.Sprintf("%s_%d", args.Filename, args.From), fmt.Sprintf("%s_%d", args.Filename, args.To), a, b)
+	return reply
+}
 
-		failList := s.pushIndexToAll()
-		if len(failList) > 0 {
-			return fmt.Errorf("Push Index to nodes: %v failed", failList)
+// RPCGetFileAsOf RPC to get the version of file which was the latest at args.AsOf
+func (s *SDFS) RPCGetFileAsOf(args *model.RPCGetFileAsOfArgs, reply *model.RPCFilenameWithReplica) error {
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	fv, err := s.index.VersionAt(args.Filename, args.AsOf)
+	if err != nil {
+		return err
+	}
+
+	*reply = model.RPCFilenameWithReplica{
+		Filename:    fmt.Sprintf("%s_%d", args.Filename, fv.Version),
+		ReplicaList: fv.Nodes,
+	}
+	s.setLayout(reply, args.Filename, fv.Version)
+	return nil
+}
+
+// resolveName split name "file@tag" into the file and the version the tag names.
+// A name without a tag, or which is a file itself, is returned with version -1.
+func (s *SDFS) resolveName(name string) (string, int, error) {
+	if version, _ := s.index.GetFile(name); version != -1 {
+		return name, -1, nil
+	}
+	filename, tag, ok := SDFSIndex.SplitTag(name)
+	if !ok {
+		return name, -1, nil
+	}
+	version, err := s.index.ResolveTag(filename, tag)
+	if err != nil {
+		return "", -1, err
+	}
+	return filename, version, nil
+}
+
+// RPCTag RPC to name a version of file with a tag
+func (s *SDFS) RPCTag(args *model.RPCTagArgs, ok *bool) error {
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
+		if err != nil {
+			return err
 		}
-	} else {
-		err := s.removeFile(filename, nodes)
+		return client.Call("SDFS.RPCTag", args, ok)
+	}
+
+	err := s.index.Tag(args.Filename, args.Version, args.Tag)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
+	return nil
+}
+
+// RPCUntag RPC to remove a tag of file
+func (s *SDFS) RPCUntag(args *model.RPCTagArgs, ok *bool) error {
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	if !s.isMaster() {
+		client, err := s.getRPCClient(s.getMaster())
 		if err != nil {
 			return err
 		}
+		return client.Call("SDFS.RPCUntag", args, ok)
 	}
+
+	err := s.index.Untag(args.Filename, args.Tag)
+	if err != nil {
+		*ok = false
+		return err
+	}
+
+	failList := s.pushIndexToAll()
+	if len(failList) > 0 {
+		log.Printf("Push Index to nodes: %v failed", failList)
+	}
+	*ok = true
 	return nil
 }
 
-// RPCGetFile RPC to get file
-func (s *SDFS) RPCGetFile(filename *string, reply *model.RPCFilenameWithReplica) error {
-	version, replicaList := s.index.GetFile(*filename)
+// RPCTags RPC to get the tags of file and the versions they name
+func (s *SDFS) RPCTags(filename *string, tags *map[string]int) error {
+	*tags = s.index.Tags(SDFSIndex.CleanPath(*filename))
+	return nil
+}
 
-	*reply = model.RPCFilenameWithReplica{
-		Filename:    fmt.Sprintf("%s_%d", *filename, version),
-		ReplicaList: replicaList,
+// RPCStat RPC to get the metadata of a version of file
+func (s *SDFS) RPCStat(args *model.RPCStatArgs, stat *model.FileStat) error {
+	name, version, err := s.resolveName(SDFSIndex.CleanPath(args.Filename))
+	if err != nil {
+		return err
+	}
+	if version == -1 {
+		version = args.Version
 	}
+	info, err := s.index.Stat(name, version)
+	if err != nil {
+		return err
+	}
+	*stat = info
 	return nil
 }
 
 // RPCLs RPC to get file
 func (s *SDFS) RPCLs(filename *string, reply *[]string) error {
-	_, replicaList := s.index.GetFile(*filename)
+	_, replicaList := s.index.GetFile(SDFSIndex.CleanPath(*filename))
 
 	*reply = replicaList
 	return nil
@@ -462,15 +2107,27 @@ func (s *SDFS) RPCLs(filename *string, reply *[]string) error {
 
 // RPCGetLatestVersions RPC to get latest versions of file
 func (s *SDFS) RPCGetLatestVersions(args *model.RPCGetLatestVersionsArgs, reply *[]model.RPCGetLatestVersionsReply) error {
-	fileList := s.index.GetVersions(args.Filename, args.Versions)
+	args.Filename = SDFSIndex.CleanPath(args.Filename)
+	fileList := s.index.GetVersionsBetween(args.Filename, args.Since, args.Until, args.Versions)
+	replication := s.index.Replication(args.Filename)
 
 	tmpReply := []model.RPCGetLatestVersionsReply{}
 	for _, file := range fileList {
-		tmpReply = append(tmpReply, model.RPCGetLatestVersionsReply{
+		version := model.RPCGetLatestVersionsReply{
 			Filename:    fmt.Sprintf("%s_%d", args.Filename, file.Version),
 			Version:     file.Version,
 			ReplicaList: file.Nodes,
-		})
+			Timestamp:   file.Timestamp,
+			Replication: replication,
+			Size:        file.Size,
+			Blocks:      file.Blocks,
+		}
+		if file.Coding.Data > 0 {
+			version.ReplicaList = file.Shards
+			version.Replication = file.Coding.Data + file.Coding.Parity
+			version.Coding = file.Coding
+		}
+		tmpReply = append(tmpReply, version)
 	}
 	*reply = tmpReply
 	return nil
@@ -496,11 +2153,38 @@ func (s *SDFS) RPCPullIndex(nodeID *string, index *model.GlobalIndexFile) error
 
 //RPCPushIndex RPC
 func (s *SDFS) RPCPushIndex(globalIndex *model.GlobalIndexFile, ok *bool) error {
-	s.index = SDFSIndex.LoadFromGlobalIndexFile(*globalIndex)
+	err := s.index.Reset(*globalIndex)
+	if err != nil {
+		log.Printf("RPCPushIndex: persist index failed: %v", err)
+	}
 	*ok = true
 	return nil
 }
 
+// RPCPushIndexEntries RPC to apply index changes from the master, reply with the position of the last change applied
+func (s *SDFS) RPCPushIndexEntries(entries *[]model.IndexEntry, pos *model.IndexPosition) error {
+	err := s.index.ApplyEntries(*entries)
+	if err != nil {
+		log.Printf("RPCPushIndexEntries: %v", err)
+	}
+	*pos = s.index.Position()
+	return nil
+}
+
+// RPCPullIndexEntries RPC to send the index changes after pos, or the whole index if they are no longer
+// kept or its history differs
+func (s *SDFS) RPCPullIndexEntries(pos *model.IndexPosition, reply *model.RPCPullIndexEntriesReply) error {
+	entries, ok := s.index.EntriesSince(*pos)
+	if ok {
+		reply.Entries = entries
+		return nil
+	}
+
+	globalIndex := s.index.GetGlobalIndexFile()
+	reply.Index = &globalIndex
+	return nil
+}
+
 // RPCPullFile RPC
 func (s *SDFS) RPCPullFile(filename *string, replyFile *model.RPCFile) error {
 	fmt.Println("File: ", *filename)
@@ -515,25 +2199,37 @@ func (s *SDFS) RPCPullFile(filename *string, replyFile *model.RPCFile) error {
 
 // RPCPullFileFrom RPC
 func (s *SDFS) RPCPullFileFrom(args *model.RPCPullFileFromArgs, ok *bool) error {
-	ch := make(chan []byte)
+	type pulled struct {
+		content []byte
+		ok      bool
+	}
+	// buffered so late responses do not block their goroutines
+	ch := make(chan pulled, len(args.PullList))
 	for _, nodeID := range args.PullList {
 		go func(nodeID string) {
-			select {
-			case ch <- s.pullFileFromNode(args.Filename, nodeID):
-			case <-time.After(time.Duration(s.config.PullFileTimeout) * time.Millisecond):
-				ch <- nil
-			}
+			content, ok := s.pullFileFromNode(args.Filename, nodeID)
+			ch <- pulled{content, ok}
 		}(nodeID)
 	}
 
+	var timeout <-chan time.Time
+	if s.config.PullFileTimeout > 0 {
+		timeout = time.After(time.Duration(s.config.PullFileTimeout) * time.Millisecond)
+	}
+
 	var fileContent []byte
-	i := len(args.PullList) - 1
+	found := false
 	// get first response
-	for fileContent == nil && i >= 0 {
-		fileContent = <-ch
+	for i := 0; !found && i < len(args.PullList); i++ {
+		select {
+		case p := <-ch:
+			fileContent, found = p.content, p.ok
+		case <-timeout:
+			i = len(args.PullList)
+		}
 	}
 
-	if fileContent == nil {
+	if !found {
 		*ok = false
 		return fmt.Errorf("RPCPullFileFrom: pull file failed")
 	}
@@ -548,8 +2244,112 @@ func (s *SDFS) RPCPullFileFrom(args *model.RPCPullFileFromArgs, ok *bool) error
 	return nil
 }
 
+// RPCRebuildShard RPC to decode a lost shard from the shards left and store it on this node
+func (s *SDFS) RPCRebuildShard(args *model.RPCRebuildShardArgs, ok *bool) error {
+	shards, err := s.pullShards(args.Filename, args.Coding, args.Shards)
+	if err != nil {
+		*ok = false
+		return err
+	}
+	if args.Shard < 0 || args.Shard >= len(shards) {
+		*ok = false
+		return fmt.Errorf("RPCRebuildShard: %s has no shard %d", args.Filename, args.Shard)
+	}
+
+	err = s.writeFile(args.Filename, shards[args.Shard])
+	if err != nil {
+		*ok = false
+		return err
+	}
+	*ok = true
+	return nil
+}
+
+// pullShards pull the shards of replica file filename from the nodes in shards, "" if lost, and
+// reconstruct the missing ones
+func (s *SDFS) pullShards(filename string, coding model.Coding, shards []string) ([][]byte, error) {
+	type pulled struct {
+		shard   int
+		content []byte
+		ok      bool
+	}
+	// buffered so late responses do not block their goroutines
+	ch := make(chan pulled, len(shards))
+	asked := 0
+	for k, nodeID := range shards {
+		if nodeID == "" {
+			continue
+		}
+		asked++
+		go func(k int, nodeID string) {
+			if nodeID == s.id {
+				content, err := s.readFileContent(filename)
+				if err != nil {
+					log.Printf("pullShards: read %v failed: %v", filename, err)
+				} else if content == nil {
+					content = []byte{}
+				}
+				ch <- pulled{k, content, err == nil}
+				return
+			}
+			content, ok := s.pullFileFromNode(filename, nodeID)
+			ch <- pulled{k, content, ok}
+		}(k, nodeID)
+	}
+
+	var timeout <-chan time.Time
+	if s.config.PullFileTimeout > 0 {
+		timeout = time.After(time.Duration(s.config.PullFileTimeout) * time.Millisecond)
+	}
+
+	contents := make([][]byte, len(shards))
+	got := 0
+	for i := 0; got < coding.Data && i < asked; i++ {
+		select {
+		case p := <-ch:
+			// an empty file has empty shards, nil marks a missing one
+			if p.ok {
+				contents[p.shard] = p.content
+				got++
+			}
+		case <-timeout:
+			i = asked
+		}
+	}
+
+	err := erasure.Reconstruct(contents, coding.Data, coding.Parity)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %v", filename, err)
+	}
+	return contents, nil
+}
+
+// readVersion content of a version, from a replica or decoded from its shards
+func (s *SDFS) readVersion(stat model.FileStat) ([]byte, error) {
+	filename := fmt.Sprintf("%s_%d", stat.Filename, stat.Version)
+	if stat.Coding.Data > 0 {
+		shards, err := s.pullShards(filename, stat.Coding, stat.Shards)
+		if err != nil {
+			return nil, err
+		}
+		return erasure.Join(shards, stat.Coding.Data, stat.Coding.Parity, stat.Size)
+	}
+
+	for _, nodeID := range stat.Nodes {
+		if nodeID == s.id {
+			return s.readFileContent(filename)
+		}
+	}
+	for _, nodeID := range stat.Nodes {
+		if content, ok := s.pullFileFromNode(filename, nodeID); ok {
+			return content, nil
+		}
+	}
+	return nil, fmt.Errorf("no node of %v holds %s", stat.Nodes, filename)
+}
+
 func (s *SDFS) putFile(file *model.RPCAddFileArgs, reply *model.RPCFilenameWithReplica) error {
-	client, err := s.getRPCClient(s.master)
+	client, err := s.getRPCClient(s.getMaster())
 	if err != nil {
 		return err
 	}
@@ -562,7 +2362,7 @@ func (s *SDFS) putFile(file *model.RPCAddFileArgs, reply *model.RPCFilenameWithR
 }
 
 func (s *SDFS) removeFile(filename *string, nodes *[]string) error {
-	client, err := s.getRPCClient(s.master)
+	client, err := s.getRPCClient(s.getMaster())
 	if err != nil {
 		return err
 	}
@@ -576,7 +2376,7 @@ func (s *SDFS) removeFile(filename *string, nodes *[]string) error {
 
 // RPCLsReplicasOfFile RPC
 func (s *SDFS) RPCLsReplicasOfFile(filename *string, replicaList *[]string) error {
-	*replicaList = s.index.LsReplicasOfFile(*filename)
+	*replicaList = s.index.LsReplicasOfFile(SDFSIndex.CleanPath(*filename))
 	return nil
 }
 
@@ -614,36 +2414,95 @@ func (s *SDFS) pushFileToNode(filename string, nodeID string) error {
 	return nil
 }
 
-func (s *SDFS) pullFileFromNode(filename string, nodeID string) []byte {
+// pullFileFromNode content of filename on nodeID, false if the pull failed. An empty file is pulled as
+// an empty content, not nil.
+func (s *SDFS) pullFileFromNode(filename string, nodeID string) ([]byte, bool) {
 	client, err := s.getRPCClient(nodeID)
 	if err != nil {
 		log.Printf("pullFileFromNode: get rpc client of %v failed", nodeID)
-		return nil
+		return nil, false
 	}
 
 	var file model.RPCFile
-	err = client.Call("Server.RPCPullFile", &filename, &file)
+	err = client.Call("SDFS.RPCPullFile", &filename, &file)
 	if err != nil {
 		log.Printf("pullFileFromNode: pull %v from %v failed", filename, nodeID)
-		return nil
+		return nil, false
 	}
 
-	return file.FileContent
+	// gob sends an empty content as nil
+	if file.FileContent == nil {
+		return []byte{}, true
+	}
+	return file.FileContent, true
 }
 
-func (s *SDFS) askNodeToPullFileFromNode(filename string, nodeID string, pullNodeList []string) error {
+func (s *SDFS) listFilesOnNode(nodeID string) ([]string, error) {
+	if nodeID == s.id {
+		return s.listFiles()
+	}
+
 	client, err := s.getRPCClient(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	err = client.Call("SDFS.RPCListFiles", &nodeID, &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// runPull ask pull.Node to copy the replica file of pull, or to rebuild it if it is a lost shard
+func (s *SDFS) runPull(pull model.PullInstruction) error {
+	if len(pull.Rebuild) == 0 {
+		return s.askNodeToPullFileFromNode(pull.Filename, pull.Node, pull.PullFrom)
+	}
+
+	args := &model.RPCRebuildShardArgs{
+		Filename: pull.Filename,
+		Coding:   pull.Coding,
+		Shard:    pull.Shard,
+		Shards:   pull.Rebuild,
+	}
+	var ok bool
+	if pull.Node == s.id {
+		return s.RPCRebuildShard(args, &ok)
+	}
+
+	client, err := s.getRPCClient(pull.Node)
+	if err != nil {
+		return err
+	}
+	err = client.Call("SDFS.RPCRebuildShard", args, &ok)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return fmt.Errorf("ask %v to rebuild shard %d of %v failed", pull.Node, pull.Shard, pull.Filename)
+	}
+	return nil
+}
 
+func (s *SDFS) askNodeToPullFileFromNode(filename string, nodeID string, pullNodeList []string) error {
 	args := &model.RPCPullFileFromArgs{
 		Filename: filename,
 		PullList: pullNodeList,
 	}
+	if nodeID == s.id {
+		var ok bool
+		return s.RPCPullFileFrom(args, &ok)
+	}
+
+	client, err := s.getRPCClient(nodeID)
+	if err != nil {
+		return err
+	}
 
 	var ok bool
-	err = client.Call("Server.RPCPullFileFrom", &args, &ok)
+	err = client.Call("SDFS.RPCPullFileFrom", &args, &ok)
 	if err != nil {
 		return err
 	}
@@ -654,14 +2513,44 @@ func (s *SDFS) askNodeToPullFileFromNode(filename string, nodeID string, pullNod
 
 	return nil
 }
+func (s *SDFS) linkFileOnNode(from string, to string, nodeID string) error {
+	args := &model.RPCLinkFileArgs{
+		From: from,
+		To:   to,
+	}
+	if nodeID == s.id {
+		return s.linkFile(from, to)
+	}
+
+	client, err := s.getRPCClient(nodeID)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	err = client.Call("SDFS.RPCLinkFile", args, &ok)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("link file on %s failed", nodeID)
+	}
+	return nil
+}
+
 func (s *SDFS) deleteFileOnNode(filename string, nodeID string) error {
+	if nodeID == s.id {
+		return s.deleteFile(filename)
+	}
+
 	client, err := s.getRPCClient(nodeID)
 	if err != nil {
 		return err
 	}
 
 	var ok bool
-	err = client.Call("Server.DeleteFile", &filename, &ok)
+	err = client.Call("SDFS.RPCDeleteFile", &filename, &ok)
 	if err != nil {
 		return err
 	}
@@ -703,11 +2592,14 @@ func main() {
 
 	go s.startFailureDetector()
 	go s.keepUpdatingMemberList()
+	go s.keepCollectingGarbage()
+	go s.keepRebalancing()
 
 	err = s.initIndex()
 	if err != nil {
 		log.Printf("main: Index init failed")
 	}
+	go s.removeDepartedNodes()
 
 	// init the rpc server
 	rpc.Register(s)
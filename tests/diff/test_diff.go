@@ -0,0 +1,135 @@
+package main
+
+// run with: go run ./tests/diff
+
+import (
+	"CS425/CS425-MP3/diff"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// patch apply unified diff d to a, as patch would
+func patch(a string, d string) (string, error) {
+	linesA := strings.SplitAfter(a, "\n")
+	if linesA[len(linesA)-1] == "" {
+		linesA = linesA[:len(linesA)-1]
+	}
+	if d == "" {
+		return a, nil
+	}
+
+	out := []string{}
+	next := 0
+	lines := strings.SplitAfter(d, "\n")
+	for k := 2; k < len(lines) && lines[k] != ""; k++ {
+		line := lines[k]
+		if strings.HasPrefix(line, "@@") {
+			var startA, countA, startB, countB int
+			_, err := fmt.Sscanf(line, "@@ -%d,%d +%d,%d @@", &startA, &countA, &startB, &countB)
+			if err != nil {
+				return "", err
+			}
+			if countA > 0 {
+				startA--
+			}
+			for ; next < startA; next++ {
+				out = append(out, linesA[next])
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "\\") {
+			// the line before has no newline
+			last := len(out) - 1
+			if lines[k-1][0] == '-' {
+				continue
+			}
+			out[last] = strings.TrimSuffix(out[last], "\n")
+			continue
+		}
+		switch line[0] {
+		case ' ':
+			if linesA[next] != line[1:] && linesA[next]+"\n" != line[1:] {
+				return "", fmt.Errorf("context %q does not match %q", line[1:], linesA[next])
+			}
+			out = append(out, linesA[next])
+			next++
+		case '-':
+			next++
+		case '+':
+			out = append(out, line[1:])
+		}
+	}
+	out = append(out, linesA[next:]...)
+	return strings.Join(out, ""), nil
+}
+
+// randomText lines drawn from a small alphabet so that versions share lines
+func randomText(r *rand.Rand, n int) string {
+	var b strings.Builder
+	for k := 0; k < n; k++ {
+		b.WriteString("line " + strconv.Itoa(r.Intn(8)) + "\n")
+	}
+	if r.Intn(4) == 0 {
+		b.WriteString("no newline")
+	}
+	return b.String()
+}
+
+func main() {
+	failed := false
+
+	fmt.Println("----- Unified -----")
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	b := "a\nb\nc\nD\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	fmt.Print(diff.Unified("f_0", "f_1", []byte(a), []byte(b)))
+	fmt.Printf("same: %q\n", diff.Unified("f_0", "f_1", []byte(a), []byte(a)))
+	fmt.Print(diff.Unified("f_0", "f_1", []byte(""), []byte("x\ny")))
+
+	r := rand.New(rand.NewSource(425))
+	for round := 0; round < 500; round++ {
+		a := randomText(r, r.Intn(30))
+		b := randomText(r, r.Intn(30))
+		d := diff.Unified("a", "b", []byte(a), []byte(b))
+		patched, err := patch(a, d)
+		if err != nil || patched != b {
+			fmt.Printf("round %d: patch gave %q, err: %v, want %q, diff:\n%s", round, patched, err, b, d)
+			failed = true
+			break
+		}
+	}
+
+	// too many changes for the edit script, the changed region is replaced as a whole
+	var many, others strings.Builder
+	for k := 0; k < 3000; k++ {
+		fmt.Fprintf(&many, "a %d\n", k)
+		fmt.Fprintf(&others, "b %d\n", k)
+	}
+	d := diff.Unified("a", "b", []byte(many.String()), []byte(others.String()))
+	patched, err := patch(many.String(), d)
+	fmt.Println("many changes patched:", patched == others.String(), err)
+	if patched != others.String() {
+		failed = true
+	}
+
+	fmt.Println("----- Binary -----")
+	bin := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	changed := append([]byte{}, bin...)
+	changed[2] = 0xff
+	changed[4] = 0xff
+	changed[17] = 0xff
+	changed = append(changed, 0xee, 0xee)
+	fmt.Println("binary:", diff.IsBinary(bin), diff.IsBinary([]byte("text\n")))
+	ranges, total := diff.ByteRanges(bin, changed, 10)
+	fmt.Println("ranges:", ranges, total)
+	ranges, total = diff.ByteRanges(bin, changed[:10], 1)
+	fmt.Println("truncated:", ranges, total)
+
+	if failed {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
@@ -0,0 +1,211 @@
+package main
+
+// run with: go run -race ./tests/race
+
+import (
+	"CS425/CS425-MP3/index"
+	"CS425/CS425-MP3/model"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	numNodes   = 6
+	numWorkers = 8
+	numRounds  = 200
+)
+
+func nodeID(n int) string {
+	return fmt.Sprintf("id%d", n%numNodes+1)
+}
+
+func fileName(n int) string {
+	return fmt.Sprintf("f%d", n%10)
+}
+
+// writer puts, copies, removes and undeletes files like RPCPutFile, RPCRemoveFile and RPCUndelete
+func writer(i *index.Index, w int) {
+	for r := 0; r < numRounds; r++ {
+		filename := fileName(w + r)
+		content := []byte(fmt.Sprintf("%s-%d-%d", filename, w, r))
+		i.AddFile(filename, md5.Sum(content), int64(len(content)), 0, model.FileMeta{Uploader: fmt.Sprintf("worker-%d", w)})
+		if r%7 == 0 {
+			i.RemoveFile(fileName(w + r + 1))
+		}
+		if r%13 == 0 {
+			i.Undelete(fileName(w + r + 3))
+		}
+		if r%17 == 0 {
+			i.Tag(filename, -1, fmt.Sprintf("w%d", w))
+		}
+		if r%5 == 0 {
+			copyName := fileName(w + r + 2)
+			version, sources := i.PlanDedup(copyName, md5.Sum(content), 0)
+			nodes := []string{}
+			for _, source := range sources {
+				nodes = append(nodes, source.Node)
+			}
+			fs := model.FileStructure{Filename: copyName, Version: version, Hash: md5.Sum(content), Size: int64(len(content))}
+			i.AddDedupFile(fs, 0, model.FileMeta{}, nodes)
+		}
+		if r%11 == 0 {
+			i.SetReplication(filename, 3+r%2)
+		}
+		if r%19 == 0 {
+			i.AddFile(filename, md5.Sum(append(content, 'b')), 2*index.BlockSize+int64(r), 0, model.FileMeta{})
+		}
+	}
+}
+
+// reader reads and encodes the index like RPCGetFile and RPCPullIndex
+func reader(i *index.Index, w int) {
+	for r := 0; r < numRounds; r++ {
+		filename := fileName(w + r)
+		_, nodes := i.GetFile(filename)
+		for k := range nodes {
+			nodes[k] = "scribbled"
+		}
+		for _, fv := range i.GetVersions(filename, 3) {
+			fv.Nodes = append(fv.Nodes, "scribbled")
+			for _, block := range fv.Blocks {
+				block.Nodes = append(block.Nodes, "scribbled")
+			}
+		}
+		if fv, err := i.VersionAt(filename, time.Now()); err == nil {
+			fv.Nodes = append(fv.Nodes, "scribbled")
+		}
+		i.GetVersionsBetween(filename, time.Now().Add(-time.Second), time.Time{}, 3)
+		i.GetNodesWithFile(filename)
+		i.LsReplicasOfFile(filename)
+		i.StoresOnNode(nodeID(r))
+		i.GetFilesOnNode(nodeID(r))
+		i.PrintIndex()
+
+		_, err := json.Marshal(i.GetGlobalIndexFile())
+		if err != nil {
+			fmt.Println("marshal:", err)
+		}
+	}
+}
+
+// member fails, rejoins and reports nodes like the membership goroutines
+func member(i *index.Index, w int) {
+	for r := 0; r < numRounds/10; r++ {
+		id := nodeID(w + r)
+		i.RemoveNode(id)
+		i.AddNewNode(id)
+		i.SetNodeZone(id, fmt.Sprintf("rack-%d", r%3))
+		i.SetNodeInfo(model.NodeInfo{ID: id, FreeBytes: 1 << 30})
+		if r%4 == 0 {
+			i.Drain(id)
+			pulls, _ := i.PlanDrain(id)
+			i.AddReplicas(pulls)
+			i.Draining()
+			i.Undrain(id)
+		}
+	}
+}
+
+// planner runs the background loops of the master
+func planner(i *index.Index, w int) {
+	for r := 0; r < numRounds/10; r++ {
+		filename := fileName(w + r)
+		pulls, drops := i.PlanReplication(filename)
+		i.AddReplicas(pulls)
+		i.DropReplicas(filename, drops)
+		i.AddReplicas(i.PlanReReplication(model.RetentionPolicy{KeepVersions: 5}, time.Now()))
+		for _, move := range i.PlanRebalance(2) {
+			i.MoveReplica(move)
+		}
+		i.PruneVersions(model.RetentionPolicy{KeepVersions: 5}, time.Now())
+		i.Purge(i.PlanPurge(time.Millisecond, time.Now()))
+		name := fmt.Sprintf("snap-%d-%d", w, r)
+		i.CreateSnapshot(name)
+		i.DiffSnapshots(name, "")
+		if r%2 == 0 {
+			i.DeleteSnapshot(name)
+		}
+		i.SetQuota(model.Quota{Identity: fmt.Sprintf("w%d", w), MaxFiles: 1000 + r})
+		i.Quotas()
+		switch r % 3 {
+		case 0:
+			i.SetCoding(filename, &model.Coding{Data: 2, Parity: 1})
+		case 1:
+			i.SetCoding(filename, nil)
+		}
+		i.Codings()
+		i.Fsck(nil, false)
+	}
+}
+
+// follower overwrites the index with pushed copies like RPCPushIndex
+func follower(i *index.Index, master *index.Index) {
+	for r := 0; r < numRounds/10; r++ {
+		err := i.Reset(master.GetGlobalIndexFile())
+		if err != nil {
+			fmt.Println("reset:", err)
+		}
+		i.GetFile(fileName(r))
+	}
+}
+
+func main() {
+	dir, err := ioutil.TempDir("", "sdfs-index-race")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := index.OpenWAL(dir, 50)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	i := index.NewIndex()
+	i.SetWAL(wal)
+	for n := 0; n < numNodes; n++ {
+		i.AddNewNode(nodeID(n))
+	}
+	pushed := index.NewIndex()
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(5)
+		go func(w int) { defer wg.Done(); writer(i, w) }(w)
+		go func(w int) { defer wg.Done(); reader(i, w) }(w)
+		go func(w int) { defer wg.Done(); member(i, w) }(w)
+		go func(w int) { defer wg.Done(); planner(i, w) }(w)
+		go func() { defer wg.Done(); follower(pushed, i) }()
+	}
+	wg.Wait()
+
+	failed := false
+	problems, _ := i.Fsck(nil, false)
+	fmt.Printf("index at seq %d, %d problems\n", i.Seq(), len(problems))
+	for _, problem := range problems {
+		fmt.Println(problem)
+		failed = true
+	}
+
+	replayed, err := index.LoadFromWAL(wal)
+	if err != nil {
+		fmt.Println("replay:", err)
+		failed = true
+	}
+	if replayed.Seq() != i.Seq() {
+		fmt.Printf("replayed up to seq %d, index at seq %d\n", replayed.Seq(), i.Seq())
+		failed = true
+	}
+
+	if failed {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"CS425/CS425-MP3/erasure"
 	"CS425/CS425-MP3/index"
+	"CS425/CS425-MP3/model"
 	"crypto/md5"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
 )
 
 func main() {
@@ -15,11 +20,11 @@ func main() {
 	i.AddNewNode("id5")
 	i.AddNewNode("id6")
 
-	i.AddFile("f1", md5.Sum([]byte("f1")))
-	i.AddFile("f2", md5.Sum([]byte("f2")))
-	i.AddFile("f2", md5.Sum([]byte("f2a")))
-	i.AddFile("f3", md5.Sum([]byte("f3")))
-	i.AddFile("f3", md5.Sum([]byte("f3a")))
+	i.AddFile("f1", md5.Sum([]byte("f1")), int64(len("f1")), 0, model.FileMeta{})
+	i.AddFile("f2", md5.Sum([]byte("f2")), int64(len("f2")), 0, model.FileMeta{})
+	i.AddFile("f2", md5.Sum([]byte("f2a")), int64(len("f2a")), 0, model.FileMeta{})
+	i.AddFile("f3", md5.Sum([]byte("f3")), int64(len("f3")), 0, model.FileMeta{})
+	i.AddFile("f3", md5.Sum([]byte("f3a")), int64(len("f3a")), 0, model.FileMeta{})
 
 	println("Files on id1")
 	fmt.Println(i.GetFilesOnNode("id1"))
@@ -42,7 +47,7 @@ func main() {
 	fmt.Println(i.GetNodesWithFile("f3"))
 
 	fmt.Println("----- Adding f2 -----")
-	i.AddFile("f2", md5.Sum([]byte("f2")))
+	i.AddFile("f2", md5.Sum([]byte("f2")), int64(len("f2")), 0, model.FileMeta{})
 	println("Nodes with f1")
 	fmt.Println(i.GetNodesWithFile("f1"))
 	println("Nodes with f2")
@@ -50,6 +55,504 @@ func main() {
 	println("Nodes with f3")
 	fmt.Println(i.GetNodesWithFile("f3"))
 
+	fmt.Println("----- Replaying index log -----")
+	dir, err := ioutil.TempDir("", "sdfs-index")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	wal, err := index.OpenWAL(dir, 2)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	i.SetWAL(wal)
+	i.AddFile("f4", md5.Sum([]byte("f4")), int64(len("f4")), 0, model.FileMeta{})
+	i.AddFile("f4", md5.Sum([]byte("f4a")), int64(len("f4a")), 0, model.FileMeta{})
+	i.AddFile("f5", md5.Sum([]byte("f5")), int64(len("f5")), 0, model.FileMeta{})
+	replayed, err := index.LoadFromWAL(wal)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("seq before: %d, after replay: %d\n", i.Seq(), replayed.Seq())
+	println("Nodes with f4")
+	fmt.Println(replayed.GetNodesWithFile("f4"))
+
+	fmt.Println("----- Following index changes -----")
+	follower := index.LoadFromGlobalIndexFile(i.GetGlobalIndexFile())
+	i.AddFile("f6", md5.Sum([]byte("f6")), int64(len("f6")), 0, model.FileMeta{})
+	i.AddFile("f6", md5.Sum([]byte("f6a")), int64(len("f6a")), 0, model.FileMeta{})
+	entries, ok := i.EntriesSince(follower.Position())
+	fmt.Printf("entries since %d: %d, ok: %v\n", follower.Seq(), len(entries), ok)
+	fmt.Println("apply with gap:", follower.ApplyEntries(entries[1:]))
+	fmt.Println("apply:", follower.ApplyEntries(entries))
+	fmt.Printf("seq of master: %d, follower: %d\n", i.Seq(), follower.Seq())
+	println("Nodes with f6 on follower")
+	fmt.Println(follower.GetNodesWithFile("f6"))
+	// after a failover the new master and a follower each have a change the other has not
+	failover := index.LoadFromGlobalIndexFile(i.GetGlobalIndexFile())
+	i.AddFile("f7", md5.Sum([]byte("f7")), int64(len("f7")), 0, model.FileMeta{})
+	entries, _ = i.EntriesSince(follower.Position())
+	follower.ApplyEntries(entries)
+	failover.AddFile("f8", md5.Sum([]byte("f8")), int64(len("f8")), 0, model.FileMeta{})
+	_, ok = failover.EntriesSince(follower.Position())
+	fmt.Printf("seq of new master: %d, follower: %d, entries ok: %v\n", failover.Seq(), follower.Seq(), ok)
+	before := failover.Position()
+	failover.AddFile("f9", md5.Sum([]byte("f9")), int64(len("f9")), 0, model.FileMeta{})
+	entries, _ = failover.EntriesSince(before)
+	fmt.Println("apply from the new master:", follower.ApplyEntries(entries))
+	i.SetMaxDeltas(1)
+	_, ok = i.EntriesSince(model.IndexPosition{Seq: i.Seq() - 2})
+	fmt.Println("entries kept after shrinking:", ok)
+
+	fmt.Println("----- Directories -----")
+	fmt.Println("mkdir:", i.Mkdir("/datasets/wiki"))
+	i.AddFile("/datasets/wiki/part-0001", md5.Sum([]byte("p1")), int64(len("p1")), 0, model.FileMeta{})
+	i.AddFile("/datasets/web/part-0001", md5.Sum([]byte("p1")), int64(len("p1")), 0, model.FileMeta{})
+	_, _, err = i.AddFile("/datasets", md5.Sum([]byte("d")), int64(len("d")), 0, model.FileMeta{})
+	fmt.Println("put on a directory:", err)
+	fmt.Println("rmdir non-empty:", i.Rmdir("/datasets/wiki"))
+	listing, err := i.List("/datasets", true)
+	fmt.Println("ls -r /datasets:", err)
+	for _, entry := range listing {
+		fmt.Printf("\t%s dir: %v\n", entry.Name, entry.IsDir)
+	}
+	i.RemoveFile("/datasets/wiki/part-0001")
+	fmt.Println("rmdir empty:", i.Rmdir("/datasets/wiki"))
+	listing, _ = i.List("/", false)
+	fmt.Println("ls /:", listing)
+
+	fmt.Println("----- Renaming f3 -----")
+	to, replicas, err := i.PlanRename("f3", "/datasets")
+	fmt.Printf("plan: %s, %d replicas, err: %v\n", to, len(replicas), err)
+	i.AddFile("f3", md5.Sum([]byte("f3b")), int64(len("f3b")), 0, model.FileMeta{})
+	fmt.Println("rename after put:", i.RenameFile("f3", to, replicas))
+	to, replicas, _ = i.PlanRename("f3", "/datasets")
+	fmt.Println("rename:", i.RenameFile("f3", to, replicas))
+	println("Nodes with f3")
+	fmt.Println(i.GetNodesWithFile("f3"))
+	println("Versions of /datasets/f3")
+	fmt.Println(i.GetVersions(to, 5))
+	problems, _ := i.Fsck(nil, false)
+	fmt.Println("fsck:", problems)
+
+	fmt.Println("----- Stat -----")
+	i.AddFile("/datasets/f3", md5.Sum([]byte("f3c")), int64(len("f3c")), 0, model.FileMeta{
+		Uploader:    "alice@host1",
+		ContentType: "text/plain",
+		Attributes:  map[string]string{"source": "crawl"},
+	})
+	stat, err := i.Stat("/datasets/f3", -1)
+	fmt.Printf("latest: version %d, %d bytes, %+v, err: %v\n", stat.Version, stat.Size, stat.Meta, err)
+	stat, err = i.Stat("/datasets/f3", 0)
+	fmt.Printf("version 0: %d bytes, %+v, err: %v\n", stat.Size, stat.Meta, err)
+	_, err = i.Stat("/datasets/f3", 9)
+	fmt.Println("missing version:", err)
+
+	fmt.Println("----- Listing -----")
+	files, next := i.ListFiles("", "", 3)
+	fmt.Printf("first page: %v, next: %q\n", files, next)
+	files, next = i.ListFiles("", next, 3)
+	fmt.Printf("second page: %v, next: %q\n", files, next)
+	files, _ = i.ListFiles("/datasets/", "", 0)
+	fmt.Println("prefix /datasets/:", files)
+	files, _ = i.ListFiles("/datasets/*", "", 0)
+	fmt.Println("glob /datasets/*:", files)
+	paged := []string{}
+	for after := ""; ; {
+		files, after = i.ListFiles("/datasets/", after, 1)
+		for _, file := range files {
+			paged = append(paged, file.Filename)
+		}
+		if after == "" {
+			break
+		}
+	}
+	fmt.Println("paged /datasets/:", paged)
+
+	fmt.Println("----- Dedup -----")
+	version, sources := i.PlanDedup("/copies/f5", md5.Sum([]byte("f5")), 0)
+	fmt.Printf("plan: version %d, %d stored replicas\n", version, len(sources))
+	nodes := []string{}
+	for _, source := range sources {
+		nodes = append(nodes, source.Node)
+	}
+	dedup := model.FileStructure{Filename: "/copies/f5", Version: version, Hash: md5.Sum([]byte("f5")), Size: int64(len("f5"))}
+	fmt.Println("add:", i.AddDedupFile(dedup, 0, model.FileMeta{}, nodes))
+	fmt.Println("add again:", i.AddDedupFile(dedup, 0, model.FileMeta{}, nodes))
+	fmt.Println("add stale:", i.AddDedupFile(model.FileStructure{Filename: "f5", Hash: md5.Sum([]byte("new"))}, 0, model.FileMeta{}, nodes))
+	stat, _ = i.Stat("/copies/f5", -1)
+	fmt.Printf("/copies/f5 on %v, shared by %d versions\n", stat.Nodes, stat.Refs)
+	_, sources = i.PlanDedup("/copies/new", md5.Sum([]byte("new")), 0)
+	fmt.Println("stored replicas of new content:", len(sources))
+
+	fmt.Println("----- Trash -----")
+	i.RemoveFile("/copies/f5")
+	for _, tomb := range i.Trash() {
+		fmt.Printf("in trash: %s, %d versions\n", tomb.Filename, len(tomb.Versions))
+	}
+	fmt.Println("undelete:", i.Undelete("/copies/f5"))
+	fmt.Println("undelete again:", i.Undelete("/copies/f5"))
+	i.RemoveFile("/copies/f5")
+	i.AddFile("/copies/f5", md5.Sum([]byte("f5b")), int64(len("f5b")), 0, model.FileMeta{})
+	version, _ = i.GetFile("/copies/f5")
+	fmt.Println("version after a re-put:", version)
+	fmt.Println("undelete over a file:", i.Undelete("/copies/f5"))
+	i.RemoveFile("/copies/f5")
+	fmt.Println("purge too early:", i.PlanPurge(time.Hour, time.Now()))
+	purged := i.PlanPurge(0, time.Now())
+	fmt.Println("purge:", len(purged), "replicas")
+	i.Purge(purged)
+	tomb, kept := i.GetGlobalIndexFile().Trash["/copies/f5"]
+	fmt.Println("trash after purge:", i.Trash(), "tombstone kept:", kept, "version:", tomb.Version)
+	disk := map[string][]string{purged[0].Node: {"/copies/f5_0"}}
+	_, orphans := i.Fsck(disk, false)
+	for _, orphan := range orphans {
+		fmt.Printf("stale replica: %s_%d on %s\n", orphan.File.Filename, orphan.File.Version, orphan.Node)
+	}
+
+	fmt.Println("----- Snapshots -----")
+	fmt.Println("snapshot:", i.CreateSnapshot("before"))
+	fmt.Println("snapshot again:", i.CreateSnapshot("before"))
+	i.AddFile("/datasets/f3", md5.Sum([]byte("f3d")), int64(len("f3d")), 0, model.FileMeta{})
+	i.AddFile("/datasets/new", md5.Sum([]byte("new")), int64(len("new")), 0, model.FileMeta{})
+	i.RemoveFile("f1")
+	diff, err := i.DiffSnapshots("before", "")
+	fmt.Printf("diff with now: %+v, err: %v\n", diff, err)
+	pruned := i.PruneVersions(model.RetentionPolicy{KeepVersions: 1}, time.Now())
+	fmt.Println("pruned replicas:", len(pruned))
+	fmt.Println("versions of /datasets/f3 kept:", len(i.GetVersions("/datasets/f3", 10)))
+	fmt.Println("purge f1:", i.PlanPurge(0, time.Now()))
+	snap, _ := i.GetSnapshot("before")
+	_, sources = i.PlanDedup("f1", snap.Files["f1"].Hash, 0)
+	fmt.Println("stored replicas of f1 in the snapshot:", len(sources))
+	fmt.Println("snapshots:", len(i.Snapshots()))
+	fmt.Println("delete snapshot:", i.DeleteSnapshot("before"))
+	fmt.Println("purge f1 after delete:", len(i.PlanPurge(0, time.Now())))
+
+	fmt.Println("----- Tags -----")
+	versions := i.GetVersions("/datasets/f3", 10)
+	oldest := versions[len(versions)-1].Version
+	fmt.Printf("tag version %d: %v\n", oldest, i.Tag("/datasets/f3", oldest, "golden"))
+	fmt.Println("bad tag:", i.Tag("/datasets/f3", oldest, "a@b"))
+	fmt.Println("tag missing version:", i.Tag("/datasets/f3", 99, "x"))
+	fmt.Println("tag latest:", i.Tag("/datasets/f3", -1, "release-2026-10"))
+	filename, tag, _ := index.SplitTag("/datasets/f3@golden")
+	version, err = i.ResolveTag(filename, tag)
+	fmt.Printf("%s@%s: version %d, err: %v\n", filename, tag, version, err)
+	i.AddFile("/datasets/f3", md5.Sum([]byte("f3e")), int64(len("f3e")), 0, model.FileMeta{})
+	i.PruneVersions(model.RetentionPolicy{KeepVersions: 1}, time.Now())
+	for _, fv := range i.GetVersions("/datasets/f3", 10) {
+		stat, _ = i.Stat("/datasets/f3", fv.Version)
+		fmt.Printf("kept version %d, tags %v\n", fv.Version, stat.Tags)
+	}
+	fmt.Println("untag:", i.Untag("/datasets/f3", "golden"))
+	fmt.Println("tags:", i.Tags("/datasets/f3"))
+
+	fmt.Println("----- Time travel -----")
+	i.AddFile("/history", md5.Sum([]byte("h0")), int64(len("h0")), 0, model.FileMeta{})
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	i.AddFile("/history", md5.Sum([]byte("h1")), int64(len("h1")), 0, model.FileMeta{})
+	at, err := i.VersionAt("/history", between)
+	fmt.Printf("as of between: version %d, err: %v\n", at.Version, err)
+	at, err = i.VersionAt("/history", time.Now())
+	fmt.Printf("as of now: version %d, err: %v\n", at.Version, err)
+	_, err = i.VersionAt("/history", between.Add(-time.Hour))
+	fmt.Println("as of an hour before:", err)
+	fmt.Println("since between:", len(i.GetVersionsBetween("/history", between, time.Time{}, 10)))
+	fmt.Println("until between:", len(i.GetVersionsBetween("/history", time.Time{}, between, 10)))
+	// the commit timestamps come with the index pushed to followers
+	pushed := index.LoadFromGlobalIndexFile(i.GetGlobalIndexFile())
+	at, err = pushed.VersionAt("/history", between)
+	fmt.Printf("follower as of between: version %d, err: %v\n", at.Version, err)
+	i.AddFile("/history", md5.Sum([]byte("h2")), int64(len("h2")), 0, model.FileMeta{})
+	i.Tag("/history", 0, "first")
+	i.PruneVersions(model.RetentionPolicy{KeepVersions: 1}, time.Now())
+	_, err = i.VersionAt("/history", between)
+	fmt.Println("as of between after prune:", err)
+
+	fmt.Println("----- Quotas -----")
+	bob := model.FileMeta{Uploader: "bob@host2"}
+	fmt.Println("set bob:", i.SetQuota(model.Quota{Identity: "bob@host2", MaxBytes: 10, MaxFiles: 2}))
+	fmt.Println("set /quota:", i.SetQuota(model.Quota{Prefix: "/quota", MaxFiles: 3}))
+	fmt.Println("negative:", i.SetQuota(model.Quota{Prefix: "/quota", MaxBytes: -1}))
+	_, _, err = i.AddFile("/quota/q1", md5.Sum([]byte("q1")), 6, 0, bob)
+	fmt.Println("bob puts 6 bytes:", err)
+	_, _, err = i.AddFile("/quota/q1", md5.Sum([]byte("q1b")), 6, 0, bob)
+	fmt.Println("bob puts 6 more bytes:", err)
+	_, _, err = i.AddFile("/quota/q1", md5.Sum([]byte("q1")), 6, 0, bob)
+	fmt.Println("bob puts the same content:", err)
+	fmt.Println("check alice:", i.CheckQuota("/quota/q1", md5.Sum([]byte("q1c")), 6, "alice@host1"))
+	i.AddFile("/quota/q2", md5.Sum([]byte("q2")), 1, 0, bob)
+	_, _, err = i.AddFile("/quota/q3", md5.Sum([]byte("q3")), 1, 0, bob)
+	fmt.Println("bob puts a third file:", err)
+	i.AddFile("/quota/q3", md5.Sum([]byte("q3")), 1, 0, model.FileMeta{Uploader: "alice@host1"})
+	_, _, err = i.AddFile("/quota/q4", md5.Sum([]byte("q4")), 1, 0, model.FileMeta{})
+	fmt.Println("a fourth file under /quota:", err)
+	for _, usage := range i.Quotas() {
+		fmt.Printf("%+v\n", usage)
+	}
+	// a version counts toward whoever uploaded it, overwriting a file leaves the older versions where they are
+	_, _, err = i.AddFile("/quota/q2", md5.Sum([]byte("q2a")), 3, 0, model.FileMeta{Uploader: "alice@host1"})
+	fmt.Println("alice overwrites q2:", err)
+	for _, usage := range i.Quotas() {
+		fmt.Printf("%+v\n", usage)
+	}
+	fmt.Println("set alice:", i.SetQuota(model.Quota{Identity: "alice@host1", MaxBytes: 5}), i.CheckQuota("/quota/q2", md5.Sum([]byte("q2b")), 2, "alice@host1"))
+	fmt.Println("clear bob:", i.SetQuota(model.Quota{Identity: "bob@host2"}))
+	fmt.Println("clear bob again:", i.SetQuota(model.Quota{Identity: "bob@host2"}))
+	fmt.Println("quotas pushed:", index.LoadFromGlobalIndexFile(i.GetGlobalIndexFile()).Quotas())
+
+	fmt.Println("----- Re-replication -----")
+	rr := index.NewIndex()
+	for n := 1; n <= 6; n++ {
+		rr.AddNewNode(fmt.Sprintf("id%d", n))
+	}
+	rr.AddFile("/r1", md5.Sum([]byte("r1")), 2, 4, model.FileMeta{})
+	rr.AddFile("/r2", md5.Sum([]byte("r2")), 2, 2, model.FileMeta{})
+	// two nodes fail together, /r1 and /r2 lose copies
+	_, holders := rr.GetFile("/r1")
+	rr.RemoveNode(holders[0])
+	_, holders = rr.GetFile("/r2")
+	rr.RemoveNode(holders[0])
+	for _, filename := range []string{"/r1", "/r2"} {
+		_, nodes := rr.GetFile(filename)
+		fmt.Printf("%s has %d of %d copies\n", filename, len(nodes), rr.Replication(filename))
+	}
+	pulls := rr.PlanReReplication(model.RetentionPolicy{}, time.Now())
+	for _, pull := range pulls {
+		fmt.Printf("pull %s to a node which is not one of %d holders\n", pull.Filename, len(pull.PullFrom))
+	}
+	// a failed pull is planned again
+	rr.AddReplicas(pulls[1:])
+	fmt.Println("pulls left:", len(rr.PlanReReplication(model.RetentionPolicy{}, time.Now())))
+	rr.AddReplicas(rr.PlanReReplication(model.RetentionPolicy{}, time.Now()))
+	for _, filename := range []string{"/r1", "/r2"} {
+		_, nodes := rr.GetFile(filename)
+		fmt.Printf("%s has %d of %d copies\n", filename, len(nodes), rr.Replication(filename))
+	}
+	fmt.Println("pulls left:", len(rr.PlanReReplication(model.RetentionPolicy{}, time.Now())))
+	rr.AddReplicas(pulls)
+	_, holders = rr.GetFile(pulls[0].File.Filename)
+	fmt.Printf("repeated pulls skipped: %d copies of %s\n", len(holders), pulls[0].File.Filename)
+	// older versions lose copies too
+	rr.AddFile("/r3", md5.Sum([]byte("r3")), 2, 3, model.FileMeta{})
+	rr.AddFile("/r3", md5.Sum([]byte("r3a")), 2, 3, model.FileMeta{})
+	rr.AddFile("/r3", md5.Sum([]byte("r3b")), 2, 3, model.FileMeta{})
+	stat, _ = rr.Stat("/r3", 0)
+	rr.RemoveNode(stat.Nodes[0])
+	for _, pull := range rr.PlanReReplication(model.RetentionPolicy{}, time.Now()) {
+		fmt.Println("keep all, pull", pull.Filename)
+	}
+	for _, pull := range rr.PlanReReplication(model.RetentionPolicy{KeepVersions: 2}, time.Now()) {
+		fmt.Println("keep 2, pull", pull.Filename)
+	}
+	// a copy pulled to the target of a move while the move copied is live
+	rb := index.NewIndex()
+	rb.AddNewNode("id1")
+	for n := 1; n <= 4; n++ {
+		rb.AddFile(fmt.Sprintf("/m%d", n), md5.Sum([]byte{byte(n)}), 10, 1, model.FileMeta{})
+	}
+	rb.AddNewNode("id2")
+	move := rb.PlanRebalance(1)[0]
+	rb.AddReplicas([]model.PullInstruction{{Filename: move.File.Filename, Node: move.To, PullFrom: []string{move.From}, File: move.File}})
+	fmt.Printf("move %s to %s: %v, held there: %v\n", move.File.Filename, move.To, rb.MoveReplica(move), rb.HoldsReplica(move.To, move.File))
+
+	fmt.Println("----- Drain -----")
+	dr := index.NewIndex()
+	for n := 1; n <= 4; n++ {
+		dr.AddNewNode(fmt.Sprintf("id%d", n))
+	}
+	dr.AddFile("/d1", md5.Sum([]byte("d1")), 2, 3, model.FileMeta{})
+	dr.AddFile("/d1", md5.Sum([]byte("d1a")), 2, 3, model.FileMeta{})
+	dr.AddFile("/d2", md5.Sum([]byte("d2")), 2, 2, model.FileMeta{})
+	fmt.Println("drain unknown node:", dr.Drain("id9"))
+	dr.Drain("id1")
+	fmt.Println("draining:", dr.Draining())
+	_, placed, _ := dr.AddFile("/d3", md5.Sum([]byte("d3")), 2, 3, model.FileMeta{})
+	fmt.Println("new file on:", placed)
+	drainPulls, err := dr.PlanDrain("id1")
+	fmt.Println("copies to make:", len(drainPulls), err, "versions on id1:", len(dr.GetFilesOnNode("id1")))
+	for _, pull := range drainPulls {
+		if pull.Node == "id1" {
+			fmt.Println("pull to the draining node:", pull.Filename)
+		}
+	}
+	dr.AddReplicas(drainPulls)
+	drainPulls, err = dr.PlanDrain("id1")
+	fmt.Println("copies left:", len(drainPulls), err)
+	dr.RemoveNode("id1")
+	fmt.Println("draining after remove:", dr.Draining())
+	dr.Drain("id2")
+	dr.Undrain("id2")
+	fmt.Println("draining after undrain:", dr.Draining())
+	// a deleted version in a snapshot whose only copy is on the draining node
+	_, placed, _ = dr.AddFile("/d4", md5.Sum([]byte("d4")), 2, 1, model.FileMeta{})
+	dr.CreateSnapshot("drain")
+	dr.RemoveFile("/d4")
+	dr.Drain(placed[0])
+	drainPulls, err = dr.PlanDrain(placed[0])
+	fmt.Println("copies of deleted versions to make:", len(drainPulls), err)
+	dr.AddReplicas(drainPulls)
+	drainPulls, err = dr.PlanDrain(placed[0])
+	fmt.Println("copies left:", len(drainPulls), err)
+	dr.RemoveNode(placed[0])
+	snap, _ = dr.GetSnapshot("drain")
+	version, sources = dr.PlanDedup("/d4", snap.Files["/d4"].Hash, 1)
+	fmt.Println("restore from:", len(sources), "nodes, off the drained node:", sources[0].Node != placed[0])
+	fmt.Println("restore:", dr.AddDedupFile(model.FileStructure{Version: version, Filename: "/d4", Hash: snap.Files["/d4"].Hash, Size: 2}, 1, model.FileMeta{}, []string{sources[0].Node}))
+
+	fmt.Println("----- Erasure coding -----")
+	ec := index.NewIndex()
+	for n := 1; n <= 6; n++ {
+		ec.AddNewNode(fmt.Sprintf("id%d", n))
+	}
+	fmt.Println("bad coding:", ec.SetCoding("/ec", &model.Coding{Data: 3, Parity: 0}))
+	ec.SetCoding("/ec", &model.Coding{Data: 3, Parity: 2})
+	fmt.Println("codings:", ec.Codings(), "coding of /ec/a/e1:", ec.CodingFor("/ec/a/e1"))
+	content := []byte("erasure coded content of e1")
+	ec.AddFile("/ec/a/e1", md5.Sum(content), int64(len(content)), 0, model.FileMeta{})
+	ec.AddFile("/r1", md5.Sum([]byte("r1")), 2, 0, model.FileMeta{})
+	stat, _ = ec.Stat("/ec/a/e1", -1)
+	fmt.Printf("e1: %d bytes, %d shards on %d nodes, coding %+v\n", stat.Size, len(stat.Shards), len(stat.Nodes), stat.Coding)
+	// the client splits the content the same way
+	shards, _ := erasure.Encode(content, 3, 2)
+	shards[0], shards[3] = nil, nil
+	joined, err := erasure.Join(shards, 3, 2, int64(len(content)))
+	fmt.Printf("joined without shards 0 and 3: %q %v\n", joined, err)
+	// Join filled shards 0 and 3 back in
+	shards[0], shards[1], shards[3] = nil, nil, nil
+	_, err = erasure.Join(shards, 3, 2, int64(len(content)))
+	fmt.Println("join without 3 shards:", err)
+	// an empty file has empty shards, only the missing ones are nil
+	shards, _ = erasure.Encode([]byte{}, 3, 2)
+	shards[0], shards[4] = nil, nil
+	joined, err = erasure.Join(shards, 3, 2, 0)
+	fmt.Printf("joined empty file: %q %v\n", joined, err)
+	// a node holding a shard fails, the shard is rebuilt on a node holding none
+	ec.RemoveNode(stat.Shards[1])
+	ecPulls := ec.PlanReReplication(model.RetentionPolicy{}, time.Now())
+	for _, pull := range ecPulls {
+		if pull.Rebuild != nil {
+			fmt.Printf("rebuild shard %d of %s from %d shards, on a new node: %v\n", pull.Shard, pull.Filename, len(pull.Rebuild), shardNode(pull.Rebuild, pull.Node) == -1)
+		}
+	}
+	ec.AddReplicas(ecPulls)
+	stat, _ = ec.Stat("/ec/a/e1", -1)
+	fmt.Println("shards after rebuild:", len(stat.Shards), "lost:", shardNode(stat.Shards, ""))
+	// a draining node moves its shard to a new node
+	ec.AddNewNode("id7")
+	ec.Drain(stat.Shards[0])
+	ecPulls, err = ec.PlanDrain(stat.Shards[0])
+	fmt.Println("drain pulls of /ec/a/e1 and /r1:", len(ecPulls), err)
+	ec.AddReplicas(ecPulls)
+	ec.RemoveNode(stat.Shards[0])
+	stat, _ = ec.Stat("/ec/a/e1", -1)
+	fmt.Println("shards after drain:", len(stat.Shards), "lost:", shardNode(stat.Shards, ""))
+	ecProblems, _ := ec.Fsck(nil, false)
+	fmt.Println("fsck problems:", ecProblems)
+	// restore a snapshot of a coded file by linking its shards under a new version
+	ec.CreateSnapshot("coded")
+	ec.AddFile("/ec/a/e1", md5.Sum([]byte("changed")), 7, 0, model.FileMeta{})
+	snap, _ = ec.GetSnapshot("coded")
+	hash := snap.Files["/ec/a/e1"].Hash
+	_, whole := ec.PlanDedup("/ec/a/e1", hash, 0)
+	version, sources = ec.PlanLayoutDedup("/ec/a/e1", hash)
+	fmt.Println("whole replicas:", len(whole), "shards to link:", len(sources), "as version", version)
+	// one link failed, its shard is lost and rebuilt later
+	fmt.Println("restore:", ec.AddLayoutDedupFile(model.FileStructure{Version: version, Filename: "/ec/a/e1", Hash: hash}, model.FileMeta{}, sources[1:]))
+	restored, _ := ec.Stat("/ec/a/e1", -1)
+	moved := 0
+	for k, id := range restored.Shards {
+		if id != "" && id != stat.Shards[k] {
+			moved++
+		}
+	}
+	fmt.Printf("restored: %d bytes, coding %+v, lost shards: %d, moved shards: %d\n", restored.Size, restored.Coding, len(restored.Shards)-len(restored.Nodes), moved)
+	fmt.Println("restore again:", ec.AddLayoutDedupFile(model.FileStructure{Version: version, Filename: "/ec/a/e1", Hash: hash}, model.FileMeta{}, sources))
+	fmt.Println("clear coding:", ec.SetCoding("/ec", nil), ec.SetCoding("/ec", nil))
+
+	fmt.Println("----- Blocks -----")
+	bl := index.NewIndex()
+	for n := 1; n <= 6; n++ {
+		bl.AddNewNode(fmt.Sprintf("id%d", n))
+	}
+	bl.AddFile("/big", md5.Sum([]byte("big")), 3*index.BlockSize+10, 3, model.FileMeta{})
+	stat, _ = bl.Stat("/big", -1)
+	fmt.Printf("/big: %d blocks on %d nodes\n", len(stat.Blocks), len(stat.Nodes))
+	for k, block := range stat.Blocks {
+		fmt.Printf("block %d: %d bytes, %d copies\n", k, block.Size, len(block.Nodes))
+	}
+	// the disk of every node as the index has it
+	blockDisk := func() map[string][]string {
+		disk := make(map[string][]string)
+		for _, id := range bl.Nodes() {
+			disk[id] = []string{}
+			for _, fs := range bl.GetFilesOnNode(id) {
+				disk[id] = append(disk[id], index.VersionName(fs))
+			}
+		}
+		return disk
+	}
+	blockProblems, _ := bl.Fsck(blockDisk(), false)
+	fmt.Println("fsck problems:", blockProblems, "block 1 on disk as:", index.VersionName(model.FileStructure{Filename: "/big", Blocks: 4, Block: 1}))
+	// a node fails, each block it held is copied from the nodes left
+	bl.RemoveNode(stat.Blocks[0].Nodes[0])
+	blockPulls := bl.PlanReReplication(model.RetentionPolicy{}, time.Now())
+	for _, pull := range blockPulls {
+		stat, _ = bl.Stat("/big", -1)
+		fmt.Printf("pull %s from %d copies, to a node without it: %v\n", pull.Filename, len(pull.PullFrom), shardNode(stat.Blocks[pull.File.Block].Nodes, pull.Node) == -1)
+	}
+	bl.AddReplicas(blockPulls)
+	bl.AddReplicas(blockPulls)
+	fmt.Println("pulls left:", len(bl.PlanReReplication(model.RetentionPolicy{}, time.Now())))
+	// a draining node hands its blocks over
+	stat, _ = bl.Stat("/big", -1)
+	drained := stat.Blocks[1].Nodes[0]
+	bl.Drain(drained)
+	blockPulls, err = bl.PlanDrain(drained)
+	fmt.Println("drain pulls:", len(blockPulls), "blocks on the node:", len(bl.GetFilesOnNode(drained)), err)
+	bl.AddReplicas(blockPulls)
+	bl.RemoveNode(drained)
+	stat, _ = bl.Stat("/big", -1)
+	for k, block := range stat.Blocks {
+		fmt.Printf("block %d: %d copies\n", k, len(block.Nodes))
+	}
+	// a block missing on disk and one of no indexed version
+	disk = blockDisk()
+	holder := stat.Blocks[2].Nodes[0]
+	for k, name := range disk[holder] {
+		if name == "/big_0.2" {
+			disk[holder] = append(disk[holder][:k:k], disk[holder][k+1:]...)
+		}
+	}
+	disk[holder] = append(disk[holder], "/big_7.0")
+	blockProblems, orphans = bl.Fsck(disk, false)
+	fmt.Println("fsck problems:", blockProblems, "orphan:", index.VersionName(orphans[0].File))
+	// set-replication adds and drops copies of every block
+	blockCopies := func() []int {
+		stat, _ := bl.Stat("/big", -1)
+		counts := []int{}
+		for _, block := range stat.Blocks {
+			counts = append(counts, len(block.Nodes))
+		}
+		return counts
+	}
+	for _, n := range []int{4, 2, 3} {
+		bl.SetReplication("/big", n)
+		blockPulls, drops := bl.PlanReplication("/big")
+		bl.AddReplicas(blockPulls)
+		dropped := bl.DropReplicas("/big", drops)
+		fmt.Printf("replication %d: %d block pulls, %d blocks dropped, copies %v\n", n, len(blockPulls), len(dropped), blockCopies())
+	}
+	_, renamed, _ := bl.PlanRename("/big", "/big2")
+	fmt.Println("replicas to link on rename:", len(renamed), "first:", index.VersionName(renamed[0].File))
+	bl.RemoveFile("/big")
+	fmt.Println("replicas to purge:", len(bl.PlanPurge(0, time.Now())))
+
 	// fmt.Println("----- Removing id1 -----")
 	// println("Files on id1")
 	// fmt.Println(i.GetFilesOnNode("id1"))
@@ -74,3 +577,13 @@ func main() {
 
 	// fmt.Printf("Time: %v\n", time.Since(t0))
 }
+
+// shardNode shard of the node id in shards, -1 if none
+func shardNode(shards []string, id string) int {
+	for k, node := range shards {
+		if node == id {
+			return k
+		}
+	}
+	return -1
+}